@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// command is an administration command, run instead of the server when its name is the first argument.
+type command func(args []string) error
+
+var commands = map[string]command{
+	"replay":      replayCommand,
+	"overwritten": overwrittenCommand,
+	"restore":     restoreCommand,
+	"decrypt":     decryptCommand,
+}
+
+// replayCommand runs a stored delivery through the handler again. The deliveries with an invalid signature can't
+// be replayed, since their body isn't archived.
+func replayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: ghmirror replay <delivery id>")
+	}
+	id := fs.Arg(0)
+
+	h, err := newHandler(&conf)
+	if err != nil {
+		return err
+	}
+
+	d, err := h.ds.GetByID(id)
+	switch {
+	case err != nil:
+		return fmt.Errorf("error while getting delivery from the datastore. err=%v", err)
+	case d == nil:
+		return fmt.Errorf("delivery %s does not exist", id)
+	case !d.SignatureValid || d.Body == nil:
+		return fmt.Errorf("the body of delivery %s was not archived because its signature is invalid", id)
+	}
+
+	pr := findProvider(h.providers, d.Provider)
+	if pr == nil {
+		return fmt.Errorf("delivery %s comes from provider %s, which is not configured anymore", d.ID, d.Provider)
+	}
+
+	log.Printf("replaying %s delivery %s received at %s", d.Event, d.ID, d.ReceivedAt)
+
+	if err := h.handleEvent(pr, d.Event, d.Body); err != nil {
+		return err
+	}
+
+	return h.ds.MarkProcessed(d.ID)
+}
+
+// parseFlags parses args into fs and returns the positional arguments. Unlike fs.Parse it doesn't stop at the
+// first positional argument, so the flags can come after them; everything after "--" is positional.
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+
+	for {
+		fs.Parse(args)
+
+		consumed := len(args) - fs.NArg()
+		if consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, fs.Args()...)
+		}
+
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// localRepositoryPath returns the local copy of a repository given by its path relative to RepositoriesPath:
+// <owner>/<name> for the default GitHub account, <account path>/<owner>/<name> for the other accounts and
+// <provider>/<owner>/<name> for the other providers.
+func localRepositoryPath(rel string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(rel))
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid repository path %q, it must be relative to REPOSITORIES_PATH", rel)
+	}
+
+	dir := filepath.Join(conf.RepositoriesPath, clean)
+	if _, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("no local copy at %s, the repository path is <owner>/<name>, <account path>/<owner>/<name> or <provider>/<owner>/<name>", dir)
+	}
+
+	return dir, nil
+}
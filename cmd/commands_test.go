@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	testCases := []struct {
+		args       []string
+		positional []string
+		yes        bool
+		to         string
+	}{
+		{[]string{"foo/bar"}, []string{"foo/bar"}, false, ""},
+		{[]string{"-yes", "foo/bar"}, []string{"foo/bar"}, true, ""},
+		{[]string{"foo/bar", "-yes", "-to", "url"}, []string{"foo/bar"}, true, "url"},
+		{[]string{"-to", "url", "foo/bar", "baz", "-yes"}, []string{"foo/bar", "baz"}, true, "url"},
+		{[]string{"foo/bar", "--", "-yes"}, []string{"foo/bar", "-yes"}, false, ""},
+	}
+
+	for _, tc := range testCases {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		flYes := fs.Bool("yes", false, "")
+		flTo := fs.String("to", "", "")
+
+		positional := parseFlags(fs, tc.args)
+		if !reflect.DeepEqual(positional, tc.positional) || *flYes != tc.yes || *flTo != tc.to {
+			t.Errorf("%v: expected %v, yes=%v and to=%q, got %v, yes=%v and to=%q", tc.args, tc.positional, tc.yes, tc.to, positional, *flYes, *flTo)
+		}
+	}
+}
+
+func TestLocalRepositoryPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldConf := conf
+	defer func() { conf = oldConf }()
+	conf.RepositoriesPath = filepath.Join(dir, "repositories")
+
+	for _, path := range []string{"foo/bar", "alice/foo/bar", "gitlab/group/subgroup/bar"} {
+		if err := os.MkdirAll(filepath.Join(conf.RepositoriesPath, path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := localRepositoryPath(path)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+
+		if exp := filepath.Join(conf.RepositoriesPath, path); got != exp {
+			t.Errorf("%s: expected %s, got %s", path, exp, got)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "outside"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"foo/baz", "bar", "../outside", "/foo/bar", ".", ""} {
+		if got, err := localRepositoryPath(path); err == nil {
+			t.Errorf("%s: expected an error, got %s", path, got)
+		}
+	}
+}
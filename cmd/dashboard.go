@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+	"github.com/vrischmann/ghmirror/internal/postgres"
+)
+
+const (
+	dashboardPrefix = "/dashboard/"
+	// dashboardHistory is the number of syncs shown on the page of a repository.
+	dashboardHistory = 50
+)
+
+// dashboardHandler serves an HTML page listing the repositories and their state, and a page per repository
+// with its sync history.
+type dashboardHandler struct {
+	rs  datastore.Repository
+	obs datastore.OwnerBlacklist
+	rbs datastore.RepositoryBlacklist
+	ss  datastore.Sync
+	fs  datastore.Fsck
+	ps  datastore.PushStatus
+}
+
+type dashboardRow struct {
+	Repository  *internal.Repository
+	LastSync    *internal.Sync
+	Fsck        *internal.FsckResult
+	Blacklisted bool
+}
+
+// Status is "ok" or "error" depending on the last sync, or "never" if the repository was never synced.
+func (r *dashboardRow) Status() string {
+	switch {
+	case r.LastSync == nil:
+		return "never"
+	case r.LastSync.Error != "":
+		return "error"
+	default:
+		return "ok"
+	}
+}
+
+// HookStatus is "error" if creating or updating the webhook failed, "none" if the repository has no webhook of
+// its own, because of the hook policy or an organization webhook, and "ok" otherwise.
+func (r *dashboardRow) HookStatus() string {
+	switch {
+	case r.Repository.HookError != "":
+		return "error"
+	case r.Repository.HookID == 0:
+		return "none"
+	default:
+		return "ok"
+	}
+}
+
+func (r *dashboardRow) Corrupted() bool { return r.Fsck != nil && !r.Fsck.OK }
+
+type dashboardFilter struct {
+	Query       string
+	Status      string
+	Hook        string
+	Blacklisted bool
+}
+
+func (f *dashboardFilter) match(r *dashboardRow) bool {
+	fullName := r.Repository.Owner + "/" + r.Repository.Name
+
+	switch {
+	case f.Query != "" && !strings.Contains(strings.ToLower(fullName), strings.ToLower(f.Query)):
+		return false
+	case f.Status == "corrupted" && !r.Corrupted():
+		return false
+	case f.Status != "" && f.Status != "corrupted" && f.Status != r.Status():
+		return false
+	case f.Hook != "" && f.Hook != r.HookStatus():
+		return false
+	case f.Blacklisted && !r.Blacklisted:
+		return false
+	default:
+		return true
+	}
+}
+
+func newDashboardHandler(conf *config.Config) (*dashboardHandler, error) {
+	h := new(dashboardHandler)
+
+	var err error
+
+	h.rs, err = postgres.NewRepositoryStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create repository store. err=%v", err)
+	}
+
+	h.obs, err = postgres.NewOwnerBlacklistStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create owner blacklist store. err=%v", err)
+	}
+
+	h.rbs, err = postgres.NewRepositoryBlacklistStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create repository blacklist store. err=%v", err)
+	}
+
+	h.ss, err = postgres.NewSyncStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create sync store. err=%v", err)
+	}
+
+	h.fs, err = postgres.NewFsckStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create fsck store. err=%v", err)
+	}
+
+	h.ps, err = postgres.NewPushStatusStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create push status store. err=%v", err)
+	}
+
+	return h, nil
+}
+
+func (h *dashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, dashboardPrefix)
+	if id == "" {
+		h.serveList(w, r)
+		return
+	}
+
+	repoID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	h.serveRepository(w, r, repoID)
+}
+
+func (h *dashboardHandler) rows() ([]*dashboardRow, error) {
+	repos, err := h.rs.GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting repositories from the datastore. err=%v", err)
+	}
+
+	syncs, err := h.ss.GetLatest()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting syncs from the datastore. err=%v", err)
+	}
+
+	results, err := h.fs.GetLatest()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting fsck results from the datastore. err=%v", err)
+	}
+
+	owners, err := h.obs.Get()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting blacklisted owners from the datastore. err=%v", err)
+	}
+
+	blacklist, err := h.rbs.Get()
+	if err != nil {
+		return nil, fmt.Errorf("error while getting blacklisted repositories from the datastore. err=%v", err)
+	}
+
+	blacklistedOwners := make(map[string]bool)
+	for _, o := range owners {
+		blacklistedOwners[o.Name] = true
+	}
+
+	blacklisted := make(map[[2]string]bool)
+	for _, b := range blacklist {
+		blacklisted[[2]string{b.Organization, b.Name}] = true
+	}
+
+	rows := make(map[int64]*dashboardRow)
+	res := make([]*dashboardRow, 0, len(repos))
+
+	for _, repo := range repos {
+		owner := ownerKey(repo.Provider, repo.Owner)
+
+		row := &dashboardRow{
+			Repository:  repo,
+			Blacklisted: blacklistedOwners[owner] || blacklisted[[2]string{owner, repo.Name}],
+		}
+
+		rows[repo.ID] = row
+		res = append(res, row)
+	}
+
+	for _, s := range syncs {
+		if row, ok := rows[s.RepositoryID]; ok {
+			row.LastSync = s
+		}
+	}
+
+	for _, fr := range results {
+		if row, ok := rows[fr.RepositoryID]; ok {
+			row.Fsck = fr
+		}
+	}
+
+	return res, nil
+}
+
+func (h *dashboardHandler) serveList(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.rows()
+	if err != nil {
+		log.Printf("%v", err)
+		writeInternalServerError(w)
+		return
+	}
+
+	filter := dashboardFilter{
+		Query:       r.FormValue("q"),
+		Status:      r.FormValue("status"),
+		Hook:        r.FormValue("hook"),
+		Blacklisted: r.FormValue("blacklisted") != "",
+	}
+
+	var data struct {
+		Filter dashboardFilter
+		Total  int
+		Rows   []*dashboardRow
+	}
+	data.Filter = filter
+	data.Total = len(rows)
+
+	for _, row := range rows {
+		if filter.match(row) {
+			data.Rows = append(data.Rows, row)
+		}
+	}
+
+	writeDashboard(w, dashboardListTemplate, data)
+}
+
+func (h *dashboardHandler) serveRepository(w http.ResponseWriter, r *http.Request, id int64) {
+	rows, err := h.rows()
+	if err != nil {
+		log.Printf("%v", err)
+		writeInternalServerError(w)
+		return
+	}
+
+	var data struct {
+		Row     *dashboardRow
+		History internal.Syncs
+		Pushes  []*internal.PushStatus
+	}
+
+	for _, row := range rows {
+		if row.Repository.ID == id {
+			data.Row = row
+		}
+	}
+
+	if data.Row == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data.History, err = h.ss.GetByRepositoryID(id, dashboardHistory)
+	if err != nil {
+		log.Printf("error while getting syncs from the datastore. err=%v", err)
+		writeInternalServerError(w)
+		return
+	}
+
+	data.Pushes, err = h.ps.GetByRepositoryID(id)
+	if err != nil {
+		log.Printf("error while getting push statuses from the datastore. err=%v", err)
+		writeInternalServerError(w)
+		return
+	}
+
+	writeDashboard(w, dashboardRepositoryTemplate, data)
+}
+
+func writeDashboard(w http.ResponseWriter, t *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, data); err != nil {
+		log.Printf("error while rendering dashboard. err=%v", err)
+	}
+}
+
+// formatSize formats a size in bytes with a binary unit.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+var dashboardFuncs = template.FuncMap{
+	"list": func(s ...string) []string { return s },
+	"size": formatSize,
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("2006-01-02 15:04:05 MST")
+	},
+	"duration": func(d time.Duration) string { return d.Round(time.Millisecond).String() },
+}
+
+const dashboardHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ghmirror</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { border-bottom: 1px solid #ddd; padding: 4px 8px; text-align: left; vertical-align: top; }
+pre { margin: 0; white-space: pre-wrap; }
+.ok { color: #080; }
+.error, .corrupted { color: #c00; }
+.never, .none { color: #888; }
+</style>
+</head>
+<body>
+`
+
+var dashboardListTemplate = template.Must(template.New("list").Funcs(dashboardFuncs).Parse(dashboardHead + `<h1>ghmirror</h1>
+<form method="get">
+<input type="text" name="q" placeholder="owner/name" value="{{ .Filter.Query }}">
+<select name="status">
+<option value="">any status</option>
+{{ range $s := (list "ok" "error" "never" "corrupted") }}<option value="{{ $s }}"{{ if eq $s $.Filter.Status }} selected{{ end }}>{{ $s }}</option>{{ end }}
+</select>
+<select name="hook">
+<option value="">any webhook</option>
+{{ range $s := (list "ok" "error" "none") }}<option value="{{ $s }}"{{ if eq $s $.Filter.Hook }} selected{{ end }}>{{ $s }}</option>{{ end }}
+</select>
+<label><input type="checkbox" name="blacklisted" value="1"{{ if .Filter.Blacklisted }} checked{{ end }}> blacklisted</label>
+<input type="submit" value="Filter">
+</form>
+<p>{{ len .Rows }} of {{ .Total }} repositories</p>
+<table>
+<tr><th>Repository</th><th>Last sync</th><th>Status</th><th>Size</th><th>Webhook</th><th>Integrity</th><th>Blacklisted</th></tr>
+{{ range .Rows }}<tr>
+<td><a href="{{ .Repository.ID }}">{{ .Repository.Owner }}/{{ .Repository.Name }}</a></td>
+<td>{{ with .LastSync }}{{ time .StartedAt }}{{ else }}-{{ end }}</td>
+<td class="{{ .Status }}">{{ .Status }}{{ with .LastSync }}{{ if .Error }}<pre>{{ .Error }}</pre>{{ end }}{{ end }}</td>
+<td>{{ if .Repository.Size }}{{ size .Repository.Size }}{{ else }}-{{ end }}</td>
+<td class="{{ .HookStatus }}">{{ .HookStatus }}{{ if .Repository.HookError }}<pre>{{ .Repository.HookError }}</pre>{{ end }}</td>
+<td>{{ with .Fsck }}{{ if .OK }}<span class="ok">ok</span>{{ else }}<span class="corrupted">corrupted</span>{{ end }}{{ else }}-{{ end }}</td>
+<td>{{ if .Blacklisted }}yes{{ end }}</td>
+</tr>{{ end }}
+</table>
+</body>
+</html>
+`))
+
+var dashboardRepositoryTemplate = template.Must(template.New("repository").Funcs(dashboardFuncs).Parse(dashboardHead + `{{ $r := .Row.Repository }}<p><a href=".">All repositories</a></p>
+<h1>{{ $r.Owner }}/{{ $r.Name }}</h1>
+<table>
+<tr><th>ID</th><td>{{ $r.ID }}</td></tr>
+<tr><th>Local path</th><td>{{ $r.LocalPath }}</td></tr>
+<tr><th>Clone URL</th><td>{{ $r.CloneURL }}</td></tr>
+<tr><th>Private</th><td>{{ $r.Private }}</td></tr>
+<tr><th>Status</th><td class="{{ .Row.Status }}">{{ .Row.Status }}</td></tr>
+<tr><th>Webhook</th><td class="{{ .Row.HookStatus }}">{{ .Row.HookStatus }}{{ if $r.HookID }} ({{ $r.HookID }}){{ end }}{{ if $r.HookError }}<pre>{{ $r.HookError }}</pre>{{ end }}</td></tr>
+<tr><th>Integrity</th><td>{{ with .Row.Fsck }}{{ if .OK }}<span class="ok">ok</span>{{ else }}<span class="corrupted">corrupted</span><pre>{{ .Output }}</pre>{{ end }}, checked {{ time .CheckedAt }}{{ else }}never checked{{ end }}</td></tr>
+<tr><th>Size</th><td>{{ if $r.Size }}{{ size $r.Size }}{{ else }}not measured yet{{ end }}</td></tr>
+<tr><th>LFS size</th><td>{{ size $r.LFSSize }}</td></tr>
+<tr><th>Blacklisted</th><td>{{ .Row.Blacklisted }}</td></tr>
+</table>
+{{ if .Pushes }}<h2>Push targets</h2>
+<table>
+<tr><th>Target</th><th>Pushed at</th><th>Attempts</th><th>Error</th></tr>
+{{ range .Pushes }}<tr><td>{{ .Target }}</td><td>{{ time .PushedAt }}</td><td>{{ .Attempts }}</td><td class="error"><pre>{{ .Error }}</pre></td></tr>
+{{ end }}</table>
+{{ end }}<h2>Sync history</h2>
+<table>
+<tr><th>Started at</th><th>Duration</th><th>Error</th></tr>
+{{ range .History }}<tr><td>{{ time .StartedAt }}</td><td>{{ duration .Duration }}</td><td class="error"><pre>{{ .Error }}</pre></td></tr>
+{{ else }}<tr><td colspan="3">No sync recorded yet.</td></tr>
+{{ end }}</table>
+</body>
+</html>
+`))
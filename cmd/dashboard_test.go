@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+func TestFormatSize(t *testing.T) {
+	testCases := []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 40, "3.0 TiB"},
+	}
+
+	for _, tc := range testCases {
+		if got := formatSize(tc.size); got != tc.expected {
+			t.Errorf("%d: expected %q, got %q", tc.size, tc.expected, got)
+		}
+	}
+}
+
+func TestDashboardFilter(t *testing.T) {
+	ok := &dashboardRow{
+		Repository: &internal.Repository{Owner: "Foo", Name: "bar", HookID: 1},
+		LastSync:   &internal.Sync{},
+	}
+	failed := &dashboardRow{
+		Repository:  &internal.Repository{Owner: "foo", Name: "baz", HookError: "forbidden"},
+		LastSync:    &internal.Sync{Error: "clone failed"},
+		Fsck:        &internal.FsckResult{OK: false},
+		Blacklisted: true,
+	}
+	never := &dashboardRow{Repository: &internal.Repository{Owner: "qux", Name: "bar"}}
+
+	testCases := []struct {
+		filter  dashboardFilter
+		matches []*dashboardRow
+	}{
+		{dashboardFilter{}, []*dashboardRow{ok, failed, never}},
+		{dashboardFilter{Query: "foo/"}, []*dashboardRow{ok, failed}},
+		{dashboardFilter{Query: "BAR"}, []*dashboardRow{ok, never}},
+		{dashboardFilter{Status: "ok"}, []*dashboardRow{ok}},
+		{dashboardFilter{Status: "error"}, []*dashboardRow{failed}},
+		{dashboardFilter{Status: "never"}, []*dashboardRow{never}},
+		{dashboardFilter{Status: "corrupted"}, []*dashboardRow{failed}},
+		{dashboardFilter{Hook: "none"}, []*dashboardRow{never}},
+		{dashboardFilter{Hook: "error"}, []*dashboardRow{failed}},
+		{dashboardFilter{Blacklisted: true}, []*dashboardRow{failed}},
+		{dashboardFilter{Query: "foo", Status: "ok", Hook: "error"}, nil},
+	}
+
+	for _, tc := range testCases {
+		var matches []*dashboardRow
+		for _, r := range []*dashboardRow{ok, failed, never} {
+			if tc.filter.match(r) {
+				matches = append(matches, r)
+			}
+		}
+
+		if len(matches) != len(tc.matches) {
+			t.Errorf("%+v: expected %d matches, got %d", tc.filter, len(tc.matches), len(matches))
+			continue
+		}
+		for i := range matches {
+			if matches[i] != tc.matches[i] {
+				t.Errorf("%+v: unexpected match %s/%s", tc.filter, matches[i].Repository.Owner, matches[i].Repository.Name)
+			}
+		}
+	}
+}
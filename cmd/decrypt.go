@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// decryptCommand decrypts a snapshot bundle or backup archive, given as a local file or as its key in the storage.
+func decryptCommand(args []string) error {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	flKey := fs.String("key", "", "Path of the RSA private key to decrypt with, if the file was encrypted with a public key")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return errors.New("usage: ghmirror decrypt [-key <private key>] <file or storage key> <output>")
+	}
+	src, dst := fs.Arg(0), fs.Arg(1)
+
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		tmp, err := ioutil.TempDir("", "ghmirror-decrypt")
+		if err != nil {
+			return fmt.Errorf("unable to create temporary directory. err=%v", err)
+		}
+		defer os.RemoveAll(tmp)
+
+		path := filepath.Join(tmp, filepath.Base(src))
+		if err := fetchSnapshot(src, path); err != nil {
+			return err
+		}
+		src = path
+	}
+
+	return decryptFile(src, dst, *flKey)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// recordDelivery archives every webhook delivery of a provider, whether its signature is valid or not. The body
+// of a delivery with an invalid signature isn't archived, as anyone can send one.
+//
+// A delivery GitHub sends again keeps its ID, so it is only archived the first time.
+func (h *handler) recordDelivery(pr Provider) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		id, event := pr.Delivery(r)
+		if id == "" {
+			next(w, r)
+			return
+		}
+
+		rewind(r.Body)
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("error while reading body. err=%v", err)
+			writeInternalServerError(w)
+			return
+		}
+
+		d := &internal.Delivery{
+			ID:             id,
+			Provider:       pr.Name(),
+			Event:          event,
+			ReceivedAt:     time.Now(),
+			SignatureValid: pr.VerifySignature(r),
+		}
+
+		if d.SignatureValid {
+			d.Body = body
+
+			if _, hb, err := pr.ParseEvent(event, body); err == nil {
+				d.RepositoryID, _ = repositoryID(pr, hb.Repository.ID)
+				d.RepositoryName = hb.Repository.FullName
+			}
+		}
+
+		if err := h.ds.Add(d); err != nil {
+			log.Printf("error while adding delivery to the datastore. err=%v", err)
+			writeInternalServerError(w)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// pruneDeliveries regularly deletes the deliveries older than the configured retention.
+func (h *handler) pruneDeliveries() {
+	ticker := time.NewTicker(time.Hour)
+
+	for range ticker.C {
+		n, err := h.ds.DeleteOlderThan(time.Now().Add(-h.conf.Deliveries.Retention))
+		if err != nil {
+			log.Printf("error while deleting old deliveries. err=%v", err)
+			continue
+		}
+
+		log.Printf("%d deliveries deleted", n)
+	}
+}
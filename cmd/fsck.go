@@ -0,0 +1,180 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+	"github.com/vrischmann/ghmirror/internal/postgres"
+)
+
+// corruptedRepositories is the number of repositories whose latest integrity check failed.
+var corruptedRepositories = expvar.NewInt("corrupted_repositories")
+
+// checker regularly checks the integrity of the local copies with git fsck.
+//
+// Each run only checks the repositories checked the longest time ago, just enough
+// so that every repository is checked once per configured period.
+type checker struct {
+	conf *config.Config
+
+	rs datastore.Repository
+	fs datastore.Fsck
+}
+
+func newChecker(conf *config.Config) (*checker, error) {
+	c := &checker{conf: conf}
+
+	var err error
+
+	c.rs, err = postgres.NewRepositoryStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create repository store. err=%v", err)
+	}
+
+	c.fs, err = postgres.NewFsckStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create fsck store. err=%v", err)
+	}
+
+	return c, nil
+}
+
+func (c *checker) run() {
+	ticker := time.NewTicker(c.conf.Fsck.Frequency)
+
+	for range ticker.C {
+		c.checkRepositories()
+	}
+}
+
+func (c *checker) checkRepositories() {
+	repos, err := c.rs.GetAll()
+	if err != nil {
+		log.Printf("error while getting repositories from the datastore. err=%v", err)
+		return
+	}
+
+	results, err := c.fs.GetLatest()
+	if err != nil {
+		log.Printf("error while getting fsck results from the datastore. err=%v", err)
+		return
+	}
+
+	latest := make(map[int64]*internal.FsckResult)
+	for _, res := range results {
+		latest[res.RepositoryID] = res
+	}
+
+	// Never checked repositories come first since their check time is the zero time.
+	sort.Sort(byLastCheck{repos, latest})
+
+	runs := int64(c.conf.Fsck.Period / c.conf.Fsck.Frequency)
+	if runs < 1 {
+		runs = 1
+	}
+	n := (int64(len(repos)) + runs - 1) / runs
+
+	for _, r := range repos[:n] {
+		res, err := c.check(r)
+		if err != nil {
+			log.Printf("error while checking repository %d, %s. err=%v", r.ID, r.LocalPath, err)
+			continue
+		}
+
+		latest[r.ID] = res
+	}
+
+	var corrupted int64
+	for _, res := range latest {
+		if !res.OK {
+			corrupted++
+		}
+	}
+	corruptedRepositories.Set(corrupted)
+
+	log.Printf("%d repositories checked, %d corrupted", n, corrupted)
+}
+
+// check runs git fsck on a repository and records the result. The repository is cloned again if it's
+// corrupted and we're configured to.
+func (c *checker) check(r *internal.Repository) (*internal.FsckResult, error) {
+	defer lockRepository(r.LocalPath)()
+
+	if _, err := os.Stat(r.LocalPath); err != nil {
+		return nil, fmt.Errorf("unable to check the local copy. err=%v", err)
+	}
+
+	res, err := c.fsck(r)
+	if err != nil || res.OK {
+		return res, err
+	}
+
+	log.Printf("repository %d, %s is corrupted: %s", r.ID, r.LocalPath, res.Output)
+
+	if !c.conf.Fsck.RecloneOnCorruption {
+		return res, nil
+	}
+
+	// Keep the corrupted copy around, it might still have something upstream lost.
+	corruptedPath := r.LocalPath + ".corrupted-" + time.Now().UTC().Format("20060102T150405Z")
+
+	log.Printf("moving %s to %s and cloning it again", r.LocalPath, corruptedPath)
+
+	if err := os.Rename(r.LocalPath, corruptedPath); err != nil {
+		return nil, err
+	}
+
+	// Sync the new copy fully, so that it gets back the pull request refs, the LFS objects and the refs served
+	// over HTTP. The lock is already held, so this is syncLocalCopy and not syncRepository.
+	if err := syncLocalCopy(c.rs, r); err != nil {
+		return nil, fmt.Errorf("error while cloning repository again. err=%v", err)
+	}
+
+	// Check the new copy right away, so that the repository isn't reported as corrupted until its next check.
+	return c.fsck(r)
+}
+
+// fsck runs git fsck on a repository and records the result.
+func (c *checker) fsck(r *internal.Repository) (*internal.FsckResult, error) {
+	log.Printf("git fsck in %s", r.LocalPath)
+
+	output, err := gitFsck(r.LocalPath)
+
+	res := &internal.FsckResult{
+		RepositoryID: r.ID,
+		CheckedAt:    time.Now(),
+		OK:           err == nil,
+		Output:       output,
+	}
+
+	if err := c.fs.Add(res); err != nil {
+		return nil, fmt.Errorf("error while adding fsck result to the datastore. err=%v", err)
+	}
+
+	return res, nil
+}
+
+type byLastCheck struct {
+	repos  internal.Repositories
+	latest map[int64]*internal.FsckResult
+}
+
+func (s byLastCheck) Len() int      { return len(s.repos) }
+func (s byLastCheck) Swap(i, j int) { s.repos[i], s.repos[j] = s.repos[j], s.repos[i] }
+func (s byLastCheck) Less(i, j int) bool {
+	return s.checkedAt(s.repos[i].ID).Before(s.checkedAt(s.repos[j].ID))
+}
+
+func (s byLastCheck) checkedAt(id int64) time.Time {
+	if res, ok := s.latest[id]; ok {
+		return res.CheckedAt
+	}
+	return time.Time{}
+}
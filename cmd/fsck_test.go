@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+type testFsckStore struct {
+	results internal.FsckResults
+}
+
+func (s *testFsckStore) Close() error { return nil }
+
+func (s *testFsckStore) GetLatest() (internal.FsckResults, error) { return s.results, nil }
+
+func (s *testFsckStore) Add(res *internal.FsckResult) error {
+	s.results = append(s.results, res)
+	return nil
+}
+
+func TestCheckerRecloneOnCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	conf.Fsck.RecloneOnCorruption = true
+	conf.PullRequestRefs.Enabled = true
+	conf.GitHTTP.Enabled = true
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "hello\n")
+	testGit(t, upstream, "update-ref", "refs/pull/1/head", "HEAD")
+
+	r := &internal.Repository{
+		ID:        1,
+		Owner:     "foo",
+		Name:      "bar",
+		LocalPath: filepath.Join(dir, "mirror"),
+		CloneURL:  "file://" + upstream,
+	}
+	rs := &testRepositoryStore{repos: internal.Repositories{r}}
+
+	if err := syncLocalCopy(rs, r); err != nil {
+		t.Fatal(err)
+	}
+	synced := testRefs(t, r.LocalPath)
+
+	for _, ref := range []string{pullRequestRefs + "1/head", "refs/namespaces/" + gitHTTPNamespace + "/refs/heads/master"} {
+		if !stringSliceContains(synced, ref) {
+			t.Fatalf("expected the sync to create %s, got %v", ref, synced)
+		}
+	}
+
+	packs, err := filepath.Glob(filepath.Join(r.LocalPath, ".git", "objects", "pack", "*.pack"))
+	if err != nil || len(packs) == 0 {
+		t.Fatalf("expected a pack in the local copy. err=%v", err)
+	}
+	for _, pack := range packs {
+		if err := os.Remove(pack); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := new(testFsckStore)
+	c := &checker{conf: &conf, rs: rs, fs: fs}
+
+	res, err := c.check(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.OK {
+		t.Errorf("expected the clone to be checked again and be OK, got %s", res.Output)
+	}
+
+	if len(fs.results) != 2 || fs.results[0].OK || !fs.results[1].OK {
+		t.Fatalf("expected a failed check then a successful one, got %d results", len(fs.results))
+	}
+
+	corrupted, err := filepath.Glob(r.LocalPath + ".corrupted-*")
+	if err != nil || len(corrupted) != 1 {
+		t.Errorf("expected the corrupted copy to be kept. err=%v", err)
+	}
+
+	// The new copy is synced like the first one, with the pull request refs and the refs served over HTTP.
+	if got := testRefs(t, r.LocalPath); !reflect.DeepEqual(got, synced) {
+		t.Errorf("expected the new copy to have the refs %v, got %v", synced, got)
+	}
+}
@@ -1,11 +1,186 @@
 package main
 
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+// newGitHubClient returns a GitHub client authenticated with the personal access token, or with the installation
+// tokens of the GitHub App, using the API of the configured GitHub instance.
+func newGitHubClient(conf *config.Config) (*github.Client, error) {
+	if ghApp != nil {
+		return setGitHubAPIURLs(conf, github.NewClient(&http.Client{Transport: ghApp}))
+	}
+
+	return newGitHubTokenClient(conf, conf.PersonalAccessToken)
+}
+
+// newGitHubTokenClient returns a GitHub client authenticated with a personal access token. Each client has its
+// own rate limit budget, the one of its token.
+func newGitHubTokenClient(conf *config.Config, token string) (*github.Client, error) {
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})
+
+	return setGitHubAPIURLs(conf, github.NewClient(&http.Client{Transport: &oauth2.Transport{Source: ts, Base: githubTransport}}))
+}
+
+// githubTransport is the transport of the GitHub clients, the only ones which trust the CA bundle.
+var githubTransport http.RoundTripper = http.DefaultTransport
+
+// githubHTTPClient is used by the GitHub App to call the API directly.
+var githubHTTPClient = &http.Client{Timeout: time.Minute}
+
+// setGitHubAPIURLs points a client to the API of the configured GitHub instance.
+func setGitHubAPIURLs(conf *config.Config, gh *github.Client) (*github.Client, error) {
+	if conf.Github.BaseURL == "" {
+		return gh, nil
+	}
+
+	var err error
+
+	gh.BaseURL, err = parseAPIURL(conf.Github.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub API URL. err=%v", err)
+	}
+
+	uploadURL := conf.Github.UploadURL
+	if uploadURL == "" {
+		uploadURL = gh.BaseURL.String()
+		if strings.HasSuffix(uploadURL, "/api/v3/") {
+			uploadURL = strings.TrimSuffix(uploadURL, "v3/") + "uploads/"
+		}
+	}
+
+	gh.UploadURL, err = parseAPIURL(uploadURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub upload URL. err=%v", err)
+	}
+
+	return gh, nil
+}
+
+// parseAPIURL parses the URL of an API, which must end with a / for go-github to resolve the paths against it.
+func parseAPIURL(s string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(s, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute URL", s)
+	}
+
+	return u, nil
+}
+
+// cloneHost returns the host the clone URLs of the repositories must point to.
+func cloneHost(conf *config.GitHub) string {
+	if conf.CloneHost != "" {
+		return conf.CloneHost
+	}
+
+	u, err := url.Parse(conf.BaseURL)
+	if conf.BaseURL == "" || err != nil || u.Hostname() == "api.github.com" {
+		return "github.com"
+	}
+
+	return u.Hostname()
+}
+
+// cloneURLHost returns the host of an HTTPS clone URL or of an scp-like SSH clone URL such as git@github.com:owner/name.git.
+func cloneURLHost(cloneURL string) string {
+	if u, err := url.Parse(cloneURL); err == nil && u.Host != "" {
+		return u.Hostname()
+	}
+
+	i := strings.Index(cloneURL, ":")
+	if i < 0 {
+		return ""
+	}
+	host := cloneURL[:i]
+
+	if j := strings.LastIndex(host, "@"); j >= 0 {
+		host = host[j+1:]
+	}
+
+	return host
+}
+
+// checkCloneURL checks that a clone URL points to the clone host of its provider, so that we never clone from
+// another host. The gists of github.com are on the gist subdomain.
+func checkCloneURL(expected, cloneURL string) error {
+	switch host := cloneURLHost(cloneURL); host {
+	case expected, "gist." + expected:
+		return nil
+	default:
+		return fmt.Errorf("clone URL %s does not point to %s", cloneURL, expected)
+	}
+}
+
+// setupCABundle makes the GitHub clients trust the certificates of the CA bundle, in addition to the system ones.
+// The clients of the storage and of the other providers keep the default transport. git is given it by
+// gitConfigEnv.
+func setupCABundle(conf *config.GitHub) error {
+	if conf.CABundle == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(conf.CABundle)
+	if err != nil {
+		return fmt.Errorf("unable to read CA bundle. err=%v", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(data) {
+		return errors.New("no certificate found in the CA bundle")
+	}
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return errors.New("unable to configure the GitHub HTTP transport")
+	}
+	transport = transport.Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	githubTransport = transport
+	githubHTTPClient.Transport = transport
+
+	return nil
+}
+
 type hookBody struct {
+	Action     string `json:"action"`
+	HookID     int64  `json:"hook_id"`
 	Repository struct {
 		ID       int64  `json:"id"`
 		Name     string `json:"name"`
 		FullName string `json:"full_name"`
+		Owner    struct {
+			Login string `json:"login"`
+		} `json:"owner"`
 		SSHURL   string `json:"ssh_url"`
 		CloneURL string `json:"clone_url"`
+		Private  bool   `json:"private"`
 	} `json:"repository"`
+	Release struct {
+		ID int `json:"id"`
+	} `json:"release"`
+	Organization struct {
+		Login string `json:"login"`
+	} `json:"organization"`
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+func TestSetupCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `{"login": "foo"}`)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bundle := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConf, oldTransport, oldClientTransport := conf, githubTransport, githubHTTPClient.Transport
+	defer func() {
+		conf, githubTransport, githubHTTPClient.Transport = oldConf, oldTransport, oldClientTransport
+	}()
+
+	conf.Github = config.GitHub{BaseURL: srv.URL + "/api/v3/", CABundle: bundle}
+
+	if err := setupCABundle(&conf.Github); err != nil {
+		t.Fatal(err)
+	}
+
+	gh, err := newGitHubTokenClient(&conf, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := gh.Users.Get(""); err != nil {
+		t.Errorf("expected the GitHub client to trust the CA bundle, got %v", err)
+	}
+
+	if _, err := doJSON(githubHTTPClient, "GET", srv.URL+"/api/v3/user", nil, nil, nil); err != nil {
+		t.Errorf("expected the GitHub App client to trust the CA bundle, got %v", err)
+	}
+
+	// The clients of the other providers and of the storage don't.
+	if _, err := doJSON(providerHTTPClient, "GET", srv.URL+"/api/v1/user", nil, nil, nil); err == nil {
+		t.Error("expected the provider client to not trust the CA bundle")
+	}
+
+	resp, err := http.Get(srv.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Error("expected the default client to not trust the CA bundle")
+	}
+}
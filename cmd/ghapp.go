@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/encryption"
+)
+
+// ghApp authenticates to GitHub as a GitHub App, when one is configured.
+var ghApp *githubApp
+
+// githubApp authenticates the API requests and the git commands with the tokens of the installations of a
+// GitHub App. The tokens are minted when first needed and refreshed before they expire.
+//
+// An API request is authenticated with the token of the installation on the account owning what it targets,
+// found from its path, so the usual go-github client can be used.
+type githubApp struct {
+	id        int64
+	key       *rsa.PrivateKey
+	baseURL   *url.URL
+	uploadURL *url.URL
+
+	mu            sync.Mutex
+	installations map[string]int64
+	listedAt      time.Time
+	tokens        map[int64]*installationToken
+}
+
+type installation struct {
+	ID      int64 `json:"id"`
+	Account struct {
+		Login string `json:"login"`
+	} `json:"account"`
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// installationTokenMargin is how long before its expiration an installation token is refreshed.
+const installationTokenMargin = 5 * time.Minute
+
+// setupGitHubApp sets ghApp if a GitHub App is configured. Either the app or a personal access token is required.
+func setupGitHubApp(conf *config.Config) error {
+	switch {
+	case conf.Github.AppID == 0 && conf.PersonalAccessToken == "":
+		return errors.New("one of PERSONAL_ACCESS_TOKEN and GITHUB_APP_ID is required")
+	case conf.Github.AppID == 0:
+		return nil
+	}
+
+	key, err := encryption.LoadPrivateKey(conf.Github.AppPrivateKey)
+	if err != nil {
+		return fmt.Errorf("unable to load the GitHub App private key. err=%v", err)
+	}
+
+	// The API requests are routed by their path relative to the URLs of the API.
+	gh, err := setGitHubAPIURLs(conf, github.NewClient(nil))
+	if err != nil {
+		return err
+	}
+
+	ghApp = &githubApp{
+		id:            conf.Github.AppID,
+		key:           key,
+		baseURL:       gh.BaseURL,
+		uploadURL:     gh.UploadURL,
+		installations: make(map[string]int64),
+		tokens:        make(map[int64]*installationToken),
+	}
+
+	return nil
+}
+
+// jwt returns a JSON Web Token signed with the private key of the app, valid for 9 minutes. It's backdated by a
+// minute in case our clock is ahead of GitHub's.
+func (a *githubApp) jwt() (string, error) {
+	now := time.Now()
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": a.id,
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, a.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// do calls the API authenticated as the app itself.
+func (a *githubApp) do(method, path string, out interface{}) (*http.Response, error) {
+	jwt, err := a.jwt()
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign the GitHub App token. err=%v", err)
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+jwt)
+	header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+
+	return doJSON(githubHTTPClient, method, a.baseURL.String()+path, header, nil, out)
+}
+
+// listInstallations refreshes the installations of the app by account.
+func (a *githubApp) listInstallations() error {
+	installations := make(map[string]int64)
+
+	for page := 1; ; page++ {
+		var res []installation
+		if _, err := a.do("GET", fmt.Sprintf("app/installations?per_page=100&page=%d", page), &res); err != nil {
+			return fmt.Errorf("unable to get the GitHub App installations. err=%v", err)
+		}
+
+		for _, inst := range res {
+			installations[inst.Account.Login] = inst.ID
+		}
+
+		if len(res) < 100 {
+			break
+		}
+	}
+
+	a.mu.Lock()
+	a.installations = installations
+	a.listedAt = time.Now()
+	a.mu.Unlock()
+
+	return nil
+}
+
+// installationID returns the installation of the app on an account. The installations are listed again when
+// the account isn't known, at most once a minute.
+func (a *githubApp) installationID(account string) (int64, error) {
+	a.mu.Lock()
+	id, ok := a.installations[account]
+	stale := time.Since(a.listedAt) > time.Minute
+	a.mu.Unlock()
+
+	if ok {
+		return id, nil
+	}
+
+	if stale {
+		if err := a.listInstallations(); err != nil {
+			return 0, err
+		}
+
+		a.mu.Lock()
+		id, ok = a.installations[account]
+		a.mu.Unlock()
+
+		if ok {
+			return id, nil
+		}
+	}
+
+	return 0, fmt.Errorf("the GitHub App is not installed on %s", account)
+}
+
+// token returns a token of an installation, minting a new one if it expires soon.
+func (a *githubApp) token(installationID int64) (string, error) {
+	a.mu.Lock()
+	t, ok := a.tokens[installationID]
+	a.mu.Unlock()
+
+	if ok && time.Until(t.ExpiresAt) > installationTokenMargin {
+		return t.Token, nil
+	}
+
+	t = new(installationToken)
+	if _, err := a.do("POST", fmt.Sprintf("app/installations/%d/access_tokens", installationID), t); err != nil {
+		return "", fmt.Errorf("unable to create a token for installation %d. err=%v", installationID, err)
+	}
+
+	a.mu.Lock()
+	a.tokens[installationID] = t
+	a.mu.Unlock()
+
+	return t.Token, nil
+}
+
+// repositories returns the repositories every installation of the app can access.
+func (a *githubApp) repositories() ([]github.Repository, error) {
+	if err := a.listInstallations(); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	installations := make(map[string]int64, len(a.installations))
+	for account, id := range a.installations {
+		installations[account] = id
+	}
+	a.mu.Unlock()
+
+	var repos []github.Repository
+
+	for account, id := range installations {
+		token, err := a.token(id)
+		if err != nil {
+			return nil, err
+		}
+
+		header := http.Header{}
+		header.Set("Authorization", "token "+token)
+		header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+
+		for page := 1; ; page++ {
+			var res struct {
+				Repositories []github.Repository `json:"repositories"`
+			}
+
+			if _, err := doJSON(githubHTTPClient, "GET", fmt.Sprintf("%sinstallation/repositories?per_page=100&page=%d", a.baseURL, page), header, nil, &res); err != nil {
+				return nil, fmt.Errorf("unable to get the repositories of installation %d. err=%v", id, err)
+			}
+
+			log.Printf("got %d repositories of installation %d on %s for page %d", len(res.Repositories), id, account, page)
+
+			repos = append(repos, res.Repositories...)
+
+			if len(res.Repositories) < 100 {
+				break
+			}
+		}
+	}
+
+	return repos, nil
+}
+
+// RoundTrip authenticates a request with the token of the installation on the account in its path, which
+// starts with repos/<owner> or orgs/<org> relative to the API or the uploads API.
+func (a *githubApp) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := req.URL.Path
+	for _, u := range []*url.URL{a.baseURL, a.uploadURL} {
+		if req.URL.Host == u.Host && strings.HasPrefix(path, u.Path) {
+			path = strings.TrimPrefix(path, u.Path)
+			break
+		}
+	}
+
+	tokens := strings.Split(path, "/")
+	if len(tokens) < 2 || (tokens[0] != "repos" && tokens[0] != "orgs") {
+		return nil, fmt.Errorf("%s can't be called with a GitHub App installation token", req.URL.Path)
+	}
+
+	token, err := a.installationToken(tokens[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// A RoundTripper must not modify the request.
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "token "+token)
+
+	return githubTransport.RoundTrip(r)
+}
+
+// installationToken returns a token of the installation of the app on an account.
+func (a *githubApp) installationToken(account string) (string, error) {
+	id, err := a.installationID(account)
+	if err != nil {
+		return "", err
+	}
+
+	return a.token(id)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+// newTestGitHubApp sets up ghApp against a stand-in of the API of a GitHub Enterprise Server, where the app is
+// installed on foo. It returns the Authorization header of every request to a repository by path. The other
+// requests are given to handler, if any.
+func newTestGitHubApp(t *testing.T, handler http.Handler) (*rsa.PrivateKey, *sync.Map, func()) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyPath := filepath.Join(dir, "app.pem")
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var authorizations sync.Map
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/api/v3/app/installations":
+			w.Write([]byte(`[{"id": 1, "account": {"login": "foo"}}]`))
+		case r.URL.Path == "/api/v3/app/installations/1/access_tokens" && r.Method == "POST":
+			json.NewEncoder(w).Encode(installationToken{Token: "installation-token", ExpiresAt: time.Now().Add(time.Hour)})
+		case strings.HasPrefix(r.URL.Path, "/api/v3/repos/"), strings.HasPrefix(r.URL.Path, "/api/uploads/repos/"):
+			authorizations.Store(r.URL.Path, r.Header.Get("Authorization"))
+			w.Write([]byte(`{}`))
+		case handler != nil:
+			handler.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	oldConf := conf
+	conf.Github = config.GitHub{
+		BaseURL:       srv.URL + "/api/v3/",
+		CloneHost:     "git.example.com",
+		AppID:         42,
+		AppPrivateKey: keyPath,
+	}
+
+	if err := setupGitHubApp(&conf); err != nil {
+		t.Fatal(err)
+	}
+
+	return key, &authorizations, func() {
+		ghApp = nil
+		conf = oldConf
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGitHubAppJWT(t *testing.T) {
+	key, _, cleanup := newTestGitHubApp(t, nil)
+	defer cleanup()
+
+	token, err := ghApp.jwt()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts in the JWT, got %d", len(parts))
+	}
+
+	var header map[string]string
+	decodeJWTPart(t, parts[0], &header)
+	if header["alg"] != "RS256" || header["typ"] != "JWT" {
+		t.Errorf("unexpected header %v", header)
+	}
+
+	var claims map[string]int64
+	decodeJWTPart(t, parts[1], &claims)
+
+	now := time.Now().Unix()
+	if claims["iss"] != 42 {
+		t.Errorf("expected the issuer to be the app ID, got %d", claims["iss"])
+	}
+	if iat := claims["iat"]; iat > now-50 || iat < now-70 {
+		t.Errorf("expected the token to be backdated by a minute, iat is %d for now %d", iat, now)
+	}
+	if exp := claims["exp"]; exp-claims["iat"] > 10*60 || exp <= now {
+		t.Errorf("expected the token to expire in at most 10 minutes, exp is %d for now %d", exp, now)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		t.Errorf("invalid signature. err=%v", err)
+	}
+}
+
+func decodeJWTPart(t *testing.T, part string, v interface{}) {
+	buf, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal(buf, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGitHubAppRoundTrip(t *testing.T) {
+	_, authorizations, cleanup := newTestGitHubApp(t, nil)
+	defer cleanup()
+
+	gh, err := newGitHubClient(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := gh.Repositories.Get("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ioutil.TempFile("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, _, err := gh.Repositories.UploadReleaseAsset("foo", "bar", 1, &github.UploadOptions{Name: "asset"}, f); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/api/v3/repos/foo/bar", "/api/uploads/repos/foo/bar/releases/1/assets"} {
+		v, ok := authorizations.Load(path)
+		if !ok {
+			t.Errorf("%s was not requested", path)
+			continue
+		}
+
+		if v != "token installation-token" {
+			t.Errorf("%s: expected the installation token, got %q", path, v)
+		}
+	}
+
+	if _, _, err := gh.Repositories.Get("other", "bar"); err == nil {
+		t.Error("expected an error for a repository of an account the app isn't installed on")
+	}
+
+	if _, _, err := gh.Users.Get(""); err == nil {
+		t.Error("expected an error for a path which isn't about a repository or an organization")
+	}
+}
+
+func TestGitCredentials(t *testing.T) {
+	_, _, cleanup := newTestGitHubApp(t, nil)
+	defer cleanup()
+
+	header := basicAuthorization("x-access-token", "installation-token")
+
+	testCases := []struct {
+		url   string
+		pairs [][2]string
+	}{
+		{"https://git.example.com/foo/bar.git", [][2]string{{"http.https://git.example.com/foo/.extraHeader", header}}},
+		{"https://git.example.com/foo/bar.wiki.git", [][2]string{{"http.https://git.example.com/foo/.extraHeader", header}}},
+		{"https://git.example.com/other/bar.git", nil},
+		{"https://evil.example.com/foo/bar.git", nil},
+		{"http://git.example.com/foo/bar.git", nil},
+		{"git@git.example.com:foo/bar.git", nil},
+		{"/tmp/bundle", nil},
+	}
+
+	for _, tc := range testCases {
+		if got := gitCredentials(tc.url); !equalPairs(got, tc.pairs) {
+			t.Errorf("%s: expected %v, got %v", tc.url, tc.pairs, got)
+		}
+	}
+
+	ghApp = nil
+	conf.Accounts = []config.Account{{Name: "alice", Token: "alice-token"}}
+
+	pairs := gitCredentials("https://alice@git.example.com/foo/bar.git")
+	expected := [][2]string{{"http.https://alice@git.example.com/.extraHeader", basicAuthorization("alice", "alice-token")}}
+	if !equalPairs(pairs, expected) {
+		t.Errorf("expected %v, got %v", expected, pairs)
+	}
+
+	for _, u := range []string{"https://bob@git.example.com/foo/bar.git", "https://git.example.com/foo/bar.git"} {
+		if pairs := gitCredentials(u); pairs != nil {
+			t.Errorf("%s: expected no credentials, got %v", u, pairs)
+		}
+	}
+}
+
+func equalPairs(a, b [][2]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// updateGists mirrors the gists of the authenticated user under the gists directory.
+func (p *poller) updateGists() {
+	count := 0
+	for page := 0; ; {
+		gists, resp, err := p.gh.Gists.List("", &github.GistListOptions{ListOptions: github.ListOptions{Page: page}})
+		if err != nil {
+			log.Printf("unable to get user gists. err=%v", err)
+			return
+		}
+
+		log.Printf("got %d gists for page %d", len(gists), page)
+
+		for i := range gists {
+			if err := p.updateGist(&gists[i]); err != nil {
+				log.Printf("error while updating gist %s. err=%v", *gists[i].ID, err)
+				continue
+			}
+
+			count++
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		page = resp.NextPage
+	}
+
+	log.Printf("%d gists updated", count)
+}
+
+func (p *poller) updateGist(gist *github.Gist) error {
+	g, err := p.gs.GetByID(*gist.ID)
+	if err != nil {
+		return fmt.Errorf("error while getting gist from the datastore. err=%v", err)
+	}
+
+	if g == nil {
+		log.Printf("gist %s does not exist yet, adding it", *gist.ID)
+
+		// Secret gists are cloned from their pull URL too, gitCredentials gives git the token for it.
+		cloneURL := *gist.GitPullURL
+
+		if err := checkCloneURL(cloneHost(&p.conf.Github), cloneURL); err != nil {
+			return err
+		}
+
+		var description string
+		if gist.Description != nil {
+			description = *gist.Description
+		}
+
+		g = internal.NewGist(*gist.ID, description, filepath.Join(p.conf.RepositoriesPath, "gists", *gist.ID), cloneURL)
+
+		if err := p.gs.Add(g); err != nil {
+			return fmt.Errorf("error while adding gist to the datastore. err=%v", err)
+		}
+	}
+
+	log.Printf("updating gist %s", g.ID)
+
+	return UpdateGist(g)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+func TestGitCredentialsGists(t *testing.T) {
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	conf.PersonalAccessToken = "pat"
+
+	header := basicAuthorization("x-access-token", "pat")
+
+	testCases := []struct {
+		cloneHost string
+		url       string
+		pairs     [][2]string
+	}{
+		{"github.com", "https://gist.github.com/abc.git", [][2]string{{"http.https://gist.github.com/abc.git.extraHeader", header}}},
+		{"ghe.example.com", "https://ghe.example.com/gist/abc.git", [][2]string{{"http.https://ghe.example.com/gist/abc.git.extraHeader", header}}},
+		{"github.com", "https://gist.evil.com/abc.git", nil},
+		{"github.com", "https://gist.github.com.evil.com/abc.git", nil},
+		{"github.com", "http://gist.github.com/abc.git", nil},
+		{"github.com", "git@gist.github.com:abc.git", nil},
+	}
+
+	for _, tc := range testCases {
+		conf.Github = config.GitHub{CloneHost: tc.cloneHost}
+
+		if got := gitCredentials(tc.url); !equalPairs(got, tc.pairs) {
+			t.Errorf("%s: expected %v, got %v", tc.url, tc.pairs, got)
+		}
+	}
+}
@@ -2,15 +2,22 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 func gitClone(url, dest string) error {
 	var buf bytes.Buffer
-	err := runGitCommand(nil, &buf, "", "clone", "-q", url, dest)
+	err := runGitRemoteCommand(url, &buf, "", "clone", "-q", url, dest)
 	if err != nil {
 		return errors.New(buf.String())
 	}
@@ -18,19 +25,45 @@ func gitClone(url, dest string) error {
 	return nil
 }
 
-func gitPull(dir string) error {
+// gitCloneMirror clones url into a bare repository at dest, keeping all its refs as they are.
+func gitCloneMirror(url, dest string) error {
 	var buf bytes.Buffer
 
-	err := runGitCommand(nil, &buf, dir, "fetch", "--all")
+	err := runGitCommand(nil, &buf, "", "clone", "-q", "--mirror", url, dest)
+	if err != nil {
+		return fmt.Errorf(`running command "git clone --mirror %s", err=%v`, url, buf.String())
+	}
+
+	return nil
+}
+
+// gitPull updates the working copy at dir from its origin, which is at url.
+func gitPull(url, dir string) error {
+	var buf bytes.Buffer
+
+	err := runGitRemoteCommand(url, &buf, dir, "fetch", "--all")
 	if err != nil {
 		return fmt.Errorf(`running command "git fetch --all", err=%v`, buf.String())
 	}
 
 	buf.Reset()
 
-	err = runGitCommand(nil, &buf, dir, "fetch", "-p")
+	// The tags deleted upstream are pruned too, so that preserveOverwrittenRefs sees them go.
+	err = runGitRemoteCommand(url, &buf, dir, "fetch", "-p", "--prune-tags")
 	if err != nil {
-		return fmt.Errorf(`running command "git fetch -p", err=%v`, buf.String())
+		return fmt.Errorf(`running command "git fetch -p --prune-tags", err=%v`, buf.String())
+	}
+
+	buf.Reset()
+
+	// The pushes of older versions deleted refs/remotes/origin/HEAD, which fetch never sets again.
+	if err := runGitCommand(nil, &buf, dir, "symbolic-ref", "-q", "refs/remotes/origin/HEAD"); err != nil {
+		buf.Reset()
+
+		err = runGitRemoteCommand(url, &buf, dir, "remote", "set-head", "origin", "--auto")
+		if err != nil {
+			return fmt.Errorf(`running command "git remote set-head origin --auto", err=%v`, buf.String())
+		}
 	}
 
 	buf.Reset()
@@ -50,7 +83,7 @@ func gitPull(dir string) error {
 
 	buf.Reset()
 
-	err = runGitCommand(nil, &buf, dir, "pull", "--rebase")
+	err = runGitRemoteCommand(url, &buf, dir, "pull", "--rebase")
 	if err != nil {
 		return fmt.Errorf(`running command "git pull --rebase", err=%v`, buf.String())
 	}
@@ -58,12 +91,372 @@ func gitPull(dir string) error {
 	return nil
 }
 
+// pullRequestRefs is the namespace where the pull request refs are kept in the mirror.
+const pullRequestRefs = "refs/ghmirror/pull/"
+
+// gitFetchPullRequests fetches refs/pull/*/head and refs/pull/*/merge into the pullRequestRefs namespace.
+//
+// The refs deleted upstream are pruned, like the branches: preserveOverwrittenRefs keeps their old tip, so the
+// commits of a pull request are still kept after the fork it came from is deleted.
+func gitFetchPullRequests(url, dir string) error {
+	var buf bytes.Buffer
+
+	refspec := "+refs/pull/*:" + pullRequestRefs + "*"
+
+	err := runGitRemoteCommand(url, &buf, dir, "fetch", "-q", "--prune", "origin", refspec)
+	if err != nil {
+		return fmt.Errorf(`running command "git fetch --prune origin %s", err=%v`, refspec, buf.String())
+	}
+
+	return nil
+}
+
+func gitBundleCreate(dir, file string) error {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, dir, "bundle", "create", file, "--all")
+	if err != nil {
+		return fmt.Errorf(`running command "git bundle create %s --all", err=%v`, file, buf.String())
+	}
+
+	return nil
+}
+
+func gitBundleListHeads(file string) (string, error) {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, "", "bundle", "list-heads", file)
+	if err != nil {
+		return "", fmt.Errorf(`running command "git bundle list-heads %s", err=%v`, file, buf.String())
+	}
+
+	return buf.String(), nil
+}
+
+// gitFsck checks the integrity of a repository and returns the output of git fsck.
+func gitFsck(dir string) (string, error) {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, dir, "fsck", "--full", "--no-progress")
+
+	return buf.String(), err
+}
+
+// gitCountObjects returns the output of git count-objects -v as a map.
+func gitCountObjects(dir string) (map[string]int64, error) {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, dir, "count-objects", "-v")
+	if err != nil {
+		return nil, fmt.Errorf(`running command "git count-objects -v", err=%v`, buf.String())
+	}
+
+	res := make(map[string]int64)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		tokens := strings.SplitN(line, ": ", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+
+		n, err := strconv.ParseInt(tokens[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse git count-objects output %q. err=%v", line, err)
+		}
+		res[tokens[0]] = n
+	}
+
+	return res, nil
+}
+
+func gitGC(dir string) error {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, dir, "gc", "--quiet")
+	if err != nil {
+		return fmt.Errorf(`running command "git gc", err=%v`, buf.String())
+	}
+
+	return nil
+}
+
+func gitRepack(dir string) error {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, dir, "repack", "-d", "-l", "-q")
+	if err != nil {
+		return fmt.Errorf(`running command "git repack -d -l", err=%v`, buf.String())
+	}
+
+	return nil
+}
+
+func gitCommitGraphWrite(dir string) error {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, dir, "commit-graph", "write", "--reachable")
+	if err != nil {
+		return fmt.Errorf(`running command "git commit-graph write --reachable", err=%v`, buf.String())
+	}
+
+	return nil
+}
+
+// gitForEachRef returns the object name of the refs matching the patterns, by ref name.
+func gitForEachRef(dir string, patterns ...string) (map[string]string, error) {
+	var buf bytes.Buffer
+
+	args := append([]string{"for-each-ref", "--format=%(objectname) %(refname)"}, patterns...)
+
+	err := runGitCommand(nil, &buf, dir, args...)
+	if err != nil {
+		return nil, fmt.Errorf(`running command "git for-each-ref", err=%v`, buf.String())
+	}
+
+	res := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		tokens := strings.SplitN(line, " ", 2)
+		if len(tokens) != 2 {
+			continue
+		}
+		res[tokens[1]] = tokens[0]
+	}
+
+	return res, nil
+}
+
+// gitIsAncestor checks if the commit a is an ancestor of the commit b.
+func gitIsAncestor(dir, a, b string) (bool, error) {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, dir, "merge-base", "--is-ancestor", a, b)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf(`running command "git merge-base --is-ancestor %s %s", err=%v`, a, b, buf.String())
+	}
+
+	return true, nil
+}
+
+func gitUpdateRef(dir, ref, object string) error {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, dir, "update-ref", ref, object)
+	if err != nil {
+		return fmt.Errorf(`running command "git update-ref %s %s", err=%v`, ref, object, buf.String())
+	}
+
+	return nil
+}
+
+// gitDeleteRefNoDeref deletes a ref itself, and not the ref it points to if it's a symbolic ref.
+func gitDeleteRefNoDeref(dir, ref string) error {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, dir, "update-ref", "--no-deref", "-d", ref)
+	if err != nil {
+		return fmt.Errorf(`running command "git update-ref --no-deref -d %s", err=%v`, ref, buf.String())
+	}
+
+	return nil
+}
+
+func gitDeleteRef(dir, ref string) error {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, dir, "update-ref", "-d", ref)
+	if err != nil {
+		return fmt.Errorf(`running command "git update-ref -d %s", err=%v`, ref, buf.String())
+	}
+
+	return nil
+}
+
+// gitPush pushes refspecs from dir to remote with env added to the environment.
+func gitPush(env []string, dir, remote string, refspecs ...string) error {
+	var buf bytes.Buffer
+
+	args := append([]string{"push", "-q", remote}, refspecs...)
+
+	err := runGitCommandWithEnv(env, nil, &buf, dir, args...)
+	if err != nil {
+		return fmt.Errorf(`running command "git push %s", err=%v`, remote, buf.String())
+	}
+
+	return nil
+}
+
+// errLFSObjectsMissing is returned when some LFS objects referenced in the repository couldn't be fetched,
+// usually because the LFS server doesn't have them.
+var errLFSObjectsMissing = errors.New("some LFS objects could not be fetched")
+
+// gitLFSFetch fetches the LFS objects of all the refs. When it fails, the objects which are still missing from
+// the LFS storage are listed in the error.
+func gitLFSFetch(url, dir string) error {
+	var buf bytes.Buffer
+
+	err := runGitRemoteCommand(url, &buf, dir, "lfs", "fetch", "--all")
+	if err == nil {
+		return nil
+	}
+
+	missing, merr := gitLFSMissingObjects(dir)
+	if merr == nil && len(missing) > 0 {
+		return fmt.Errorf("%v: %s. err=%v", errLFSObjectsMissing, strings.Join(missing, ", "), buf.String())
+	}
+
+	return fmt.Errorf(`running command "git lfs fetch --all", err=%v`, buf.String())
+}
+
+// gitLFSMissingObjects returns the files of all the refs whose LFS object isn't in the LFS storage of dir.
+func gitLFSMissingObjects(dir string) ([]string, error) {
+	var buf bytes.Buffer
+
+	err := runGitCommand(nil, &buf, dir, "lfs", "ls-files", "--all", "--long")
+	if err != nil {
+		return nil, fmt.Errorf(`running command "git lfs ls-files --all --long", err=%v`, buf.String())
+	}
+
+	return lfsMissingObjects(filepath.Join(dir, ".git", "lfs", "objects"), buf.String()), nil
+}
+
+// lfsMissingObjects parses the output of git lfs ls-files --long, made of lines like "<oid> * <file>", and
+// returns the files whose object isn't in storage.
+func lfsMissingObjects(storage, lsFiles string) []string {
+	var missing []string
+	for _, line := range strings.Split(strings.TrimSpace(lsFiles), "\n") {
+		tokens := strings.SplitN(line, " ", 3)
+		if len(tokens) != 3 || len(tokens[0]) < 5 {
+			continue
+		}
+
+		oid, file := tokens[0], tokens[2]
+		if _, err := os.Stat(filepath.Join(storage, oid[0:2], oid[2:4], oid)); err != nil {
+			missing = append(missing, file)
+		}
+	}
+
+	return missing
+}
+
+// gitGrepTips checks if a fixed string appears in the files matching pathspec of any of the given commits.
+func gitGrepTips(dir, s, pathspec string, tips []string) (bool, error) {
+	var buf bytes.Buffer
+
+	args := append([]string{"grep", "-q", "-F", "-e", s}, tips...)
+	args = append(args, "--", pathspec)
+
+	err := runGitCommand(nil, &buf, dir, args...)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf(`running command "git grep %s", err=%v`, s, buf.String())
+	}
+
+	return true, nil
+}
+
 func runGitCommand(input io.Reader, output io.Writer, cwd string, args ...string) error {
+	return runGitCommandWithEnv(nil, input, output, cwd, args...)
+}
+
+// runGitCommandWithEnv runs git with env added to the environment.
+func runGitCommandWithEnv(env []string, input io.Reader, output io.Writer, cwd string, args ...string) error {
 	c := exec.Command("git", args...)
 	c.Dir = cwd
+	if len(env) > 0 {
+		c.Env = append(os.Environ(), env...)
+	}
 	c.Stdin = input
 	c.Stdout = output
 	c.Stderr = output
 
 	return c.Run()
 }
+
+// runGitRemoteCommand runs a git command talking to the remote at url, with the configuration of gitConfigEnv.
+func runGitRemoteCommand(url string, output io.Writer, cwd string, args ...string) error {
+	return runGitCommandWithEnv(gitConfigEnv(url), nil, output, cwd, args...)
+}
+
+// gitConfigEnv returns the environment giving git its configuration to talk to the remote at url: the CA bundle
+// to trust for the clone host, and the credentials for url, see gitCredentials. It's only used for the commands
+// fetching from the clone host and for the push to a repository created by restore, so the local commands and
+// the pushes to the push targets never get credentials.
+func gitConfigEnv(url string) []string {
+	var pairs [][2]string
+	if conf.Github.CABundle != "" {
+		pairs = append(pairs, [2]string{"http.https://" + cloneHost(&conf.Github) + "/.sslCAInfo", conf.Github.CABundle})
+	}
+	pairs = append(pairs, gitCredentials(url)...)
+
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	env := []string{"GIT_CONFIG_COUNT=" + strconv.Itoa(len(pairs))}
+	for i, pair := range pairs {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, pair[0]),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, pair[1]),
+		)
+	}
+
+	return env
+}
+
+// gitCredentials returns the git configuration giving the credentials for an HTTPS clone URL of the clone host:
+// the personal access token for a gist, the token of the account in its user, see accountCloneURL, or else the
+// token of the GitHub App installation on its owner. The header is scoped to that gist, account or owner only.
+func gitCredentials(cloneURL string) [][2]string {
+	u, err := url.Parse(cloneURL)
+	if err != nil || u.Scheme != "https" {
+		return nil
+	}
+
+	host := cloneHost(&conf.Github)
+
+	// The gists are on the gist subdomain of github.com, and under /gist/ on GitHub Enterprise Server.
+	if u.Hostname() == "gist."+host || (u.Hostname() == host && strings.HasPrefix(u.Path, "/gist/")) {
+		if u.User != nil || conf.PersonalAccessToken == "" {
+			return nil
+		}
+
+		return [][2]string{{"http." + cloneURL + ".extraHeader", basicAuthorization("x-access-token", conf.PersonalAccessToken)}}
+	}
+
+	if u.Hostname() != host {
+		return nil
+	}
+
+	if u.User != nil {
+		for _, a := range conf.Accounts {
+			if a.Name == u.User.Username() {
+				return [][2]string{{"http.https://" + a.Name + "@" + u.Host + "/.extraHeader", basicAuthorization(a.Name, a.Token)}}
+			}
+		}
+
+		return nil
+	}
+
+	if ghApp == nil {
+		return nil
+	}
+
+	owner := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+
+	token, err := ghApp.installationToken(owner)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil
+	}
+
+	return [][2]string{{"http.https://" + u.Host + "/" + owner + "/.extraHeader", basicAuthorization("x-access-token", token)}}
+}
+
+// basicAuthorization returns an Authorization header with basic credentials.
+func basicAuthorization(user, password string) string {
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
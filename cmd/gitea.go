@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+// giteaHookEvents are the events the Gitea webhooks subscribe to.
+var giteaHookEvents = []string{"push", "create", "delete", "wiki"}
+
+// giteaProvider mirrors the repositories of a Gitea user, with the Gitea API v1.
+type giteaProvider struct {
+	conf *config.Provider
+}
+
+func newGiteaProvider(conf *config.Provider) *giteaProvider {
+	return &giteaProvider{conf: conf}
+}
+
+type giteaRepository struct {
+	ID    int64 `json:"id"`
+	Owner struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+	Private  bool   `json:"private"`
+	CloneURL string `json:"clone_url"`
+	SSHURL   string `json:"ssh_url"`
+	HasWiki  bool   `json:"has_wiki"`
+}
+
+type giteaHook struct {
+	ID     int64             `json:"id,omitempty"`
+	Type   string            `json:"type,omitempty"`
+	Config map[string]string `json:"config"`
+	Events []string          `json:"events"`
+	Active bool              `json:"active"`
+}
+
+func (g *giteaProvider) Name() string { return g.conf.Name }
+
+func (g *giteaProvider) CloneHost() string {
+	u, _ := url.Parse(g.conf.URL)
+	return u.Hostname()
+}
+
+func (g *giteaProvider) do(method, path string, in, out interface{}) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Authorization", "token "+g.conf.Token)
+
+	return doJSON(providerHTTPClient, method, strings.TrimSuffix(g.conf.URL, "/")+"/api/v1"+path, header, in, out)
+}
+
+func (g *giteaProvider) repositoryPath(owner, name string) string {
+	return "/repos/" + url.PathEscape(owner) + "/" + url.PathEscape(name)
+}
+
+func (g *giteaProvider) ListRepositories() ([]*remoteRepository, error) {
+	var res []*remoteRepository
+
+	for page := 1; ; page++ {
+		var repos []giteaRepository
+		if _, err := g.do("GET", fmt.Sprintf("/user/repos?page=%d&limit=50", page), nil, &repos); err != nil {
+			return nil, fmt.Errorf("unable to get user repositories. err=%v", err)
+		}
+
+		log.Printf("got %d repositories of %s for page %d", len(repos), g.conf.Name, page)
+
+		if len(repos) == 0 {
+			break
+		}
+
+		for _, repo := range repos {
+			res = append(res, &remoteRepository{
+				ID:       repo.ID,
+				Owner:    repo.Owner.Login,
+				Name:     repo.Name,
+				FullName: repo.FullName,
+				CloneURL: repo.CloneURL,
+				SSHURL:   repo.SSHURL,
+				Private:  repo.Private,
+				HasWiki:  repo.HasWiki,
+			})
+		}
+	}
+
+	return res, nil
+}
+
+func (g *giteaProvider) AddHook(r *internal.Repository) error {
+	endpoint := providerHookURL(g.conf.Name)
+
+	var hooks []giteaHook
+	if _, err := g.do("GET", g.repositoryPath(r.Owner, r.Name)+"/hooks", nil, &hooks); err != nil {
+		return fmt.Errorf("error while listing webhooks. err=%v", err)
+	}
+
+	for _, hook := range hooks {
+		if hook.Config["url"] == endpoint {
+			log.Printf("webhook already exists for %d, %s/%s", r.ID, r.Owner, r.Name)
+			r.HookID = hook.ID
+			return nil
+		}
+	}
+
+	log.Printf("creating webhook for repository %d, %s/%s", r.ID, r.Owner, r.Name)
+
+	hook := giteaHook{
+		Type: "gitea",
+		Config: map[string]string{
+			"url":          endpoint,
+			"content_type": "json",
+			"secret":       g.conf.Secret,
+		},
+		Events: giteaHookEvents,
+		Active: true,
+	}
+
+	if _, err := g.do("POST", g.repositoryPath(r.Owner, r.Name)+"/hooks", &hook, &hook); err != nil {
+		return fmt.Errorf("error while creating webhook. err=%v", err)
+	}
+
+	r.HookID = hook.ID
+
+	return nil
+}
+
+func (g *giteaProvider) Delivery(r *http.Request) (string, string) {
+	return r.Header.Get("X-Gitea-Delivery"), r.Header.Get("X-Gitea-Event")
+}
+
+// VerifySignature checks the hex encoded HMAC-SHA256 of the body in the X-Gitea-Signature header.
+func (g *giteaProvider) VerifySignature(r *http.Request) bool {
+	rewind(r.Body)
+
+	messageMAC, err := hex.DecodeString(r.Header.Get("X-Gitea-Signature"))
+	if err != nil {
+		log.Printf("error while decoding message MAC. err=%v", err)
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(g.conf.Secret))
+	io.Copy(mac, r.Body)
+
+	return hmac.Equal(mac.Sum(nil), messageMAC)
+}
+
+// ParseEvent decodes the Gitea payloads, whose repository is the same as in the GitHub ones.
+func (g *giteaProvider) ParseEvent(event string, body []byte) (string, *hookBody, error) {
+	var hb hookBody
+	if err := json.Unmarshal(body, &hb); err != nil {
+		return "", nil, fmt.Errorf("error while decoding json. err=%v", err)
+	}
+
+	switch event {
+	case "push", "create", "delete":
+	case "wiki":
+		event = "gollum"
+	default:
+		event = g.conf.Name + "/" + event
+	}
+
+	return event, &hb, nil
+}
+
+var _ Provider = (*giteaProvider)(nil)
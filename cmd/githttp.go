@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+	"github.com/vrischmann/ghmirror/internal/postgres"
+)
+
+const gitHTTPPrefix = "/git/"
+
+// gitHTTPNamespace is the git namespace http-backend serves. The local copies are working clones where the
+// branches are remote-tracking branches, so exposeRefs copies them there as branches, with the tags.
+const gitHTTPNamespace = "git-http"
+
+// gitHTTPHandler serves the local copies read-only over the git smart HTTP protocol, using git http-backend.
+type gitHTTPHandler struct {
+	rs datastore.Repository
+
+	backend *cgi.Handler
+}
+
+func newGitHTTPHandler(conf *config.Config) (*gitHTTPHandler, error) {
+	h := new(gitHTTPHandler)
+
+	var err error
+
+	h.rs, err = postgres.NewRepositoryStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create repository store. err=%v", err)
+	}
+
+	h.backend, err = newGitHTTPBackend(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func newGitHTTPBackend(conf *config.Config) (*cgi.Handler, error) {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return nil, fmt.Errorf("unable to find git. err=%v", err)
+	}
+
+	return &cgi.Handler{
+		Path: git,
+		Args: []string{"http-backend"},
+		Root: "/git",
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + conf.RepositoriesPath,
+			"GIT_HTTP_EXPORT_ALL=1",
+			"GIT_NAMESPACE=" + gitHTTPNamespace,
+			// Refuse pushes even if http-backend gets a REMOTE_USER one day, and let clients fetch
+			// commits which are only reachable from the remote-tracking branches.
+			"GIT_CONFIG_COUNT=2",
+			"GIT_CONFIG_KEY_0=http.receivepack",
+			"GIT_CONFIG_VALUE_0=false",
+			"GIT_CONFIG_KEY_1=uploadpack.allowReachableSHA1InWant",
+			"GIT_CONFIG_VALUE_1=true",
+		},
+	}, nil
+}
+
+func (h *gitHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("service") == "git-receive-pack" || strings.HasSuffix(r.URL.Path, "/git-receive-pack") {
+		writeForbidden(w)
+		return
+	}
+
+	// The path is /git/<owner>/<name>.git/<rest>, with the provider first for the repositories not from GitHub.
+	path := strings.TrimPrefix(r.URL.Path, gitHTTPPrefix)
+
+	i := strings.Index(path, ".git/")
+	if i == -1 {
+		http.NotFound(w, r)
+		return
+	}
+
+	fullName, rest := path[:i], path[i+len(".git/"):]
+
+	tokens := strings.Split(fullName, "/")
+	if len(tokens) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	for _, token := range tokens {
+		if !validPathElement(token) {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	repo, err := h.rs.GetByLocalPath(filepath.Join(conf.RepositoriesPath, filepath.Join(tokens...)))
+	if err != nil {
+		log.Printf("error while getting repository from the datastore. err=%v", err)
+		writeInternalServerError(w)
+		return
+	}
+
+	if repo == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if repo.Private && !validToken(r, conf.GitHTTP.Tokens) {
+		writeUnauthorized(w)
+		return
+	}
+
+	// The local copies synced before serving over HTTP was enabled don't have their refs exposed yet.
+	if _, err := os.Stat(filepath.Join(repo.LocalPath, ".git", "refs", "namespaces", gitHTTPNamespace, "HEAD")); os.IsNotExist(err) {
+		unlock := lockRepository(repo.LocalPath)
+		err := exposeRefs(repo.LocalPath)
+		unlock()
+
+		if err != nil {
+			log.Printf("error while exposing the refs of repository %d, %s. err=%v", repo.ID, repo.LocalPath, err)
+			writeInternalServerError(w)
+			return
+		}
+	}
+
+	// The local copies are working clones, so http-backend must be pointed to their .git directory.
+	r.URL.Path = gitHTTPPrefix + fullName + "/.git/" + rest
+
+	h.backend.ServeHTTP(w, r)
+}
+
+// exposeRefs updates the gitHTTPNamespace namespace of the local copy at dir so that it has the remote-tracking
+// branches as branches, and the tags. Its HEAD points to the default branch of the remote.
+func exposeRefs(dir string) error {
+	prefix := "refs/namespaces/" + gitHTTPNamespace + "/"
+
+	refs, err := gitForEachRef(dir, "refs/remotes/origin/", "refs/tags/", prefix)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]string)
+	for ref, object := range refs {
+		switch {
+		case ref == "refs/remotes/origin/HEAD":
+		case strings.HasPrefix(ref, "refs/remotes/origin/"):
+			wanted[prefix+"refs/heads/"+strings.TrimPrefix(ref, "refs/remotes/origin/")] = object
+		case strings.HasPrefix(ref, "refs/tags/"):
+			wanted[prefix+ref] = object
+		}
+	}
+
+	var commands bytes.Buffer
+	for ref, object := range wanted {
+		if refs[ref] != object {
+			fmt.Fprintf(&commands, "update %s %s\n", ref, object)
+		}
+	}
+	for ref := range refs {
+		if _, ok := wanted[ref]; !ok && strings.HasPrefix(ref, prefix) {
+			fmt.Fprintf(&commands, "delete %s\n", ref)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if commands.Len() > 0 {
+		if err := runGitCommand(&commands, &buf, dir, "update-ref", "--stdin"); err != nil {
+			return fmt.Errorf(`running command "git update-ref --stdin", err=%v`, buf.String())
+		}
+	}
+
+	head := "master"
+
+	buf.Reset()
+	if err := runGitCommand(nil, &buf, dir, "symbolic-ref", "-q", "refs/remotes/origin/HEAD"); err == nil {
+		head = strings.TrimPrefix(strings.TrimSpace(buf.String()), "refs/remotes/origin/")
+	}
+
+	buf.Reset()
+	if err := runGitCommand(nil, &buf, dir, "symbolic-ref", prefix+"HEAD", prefix+"refs/heads/"+head); err != nil {
+		return fmt.Errorf(`running command "git symbolic-ref %sHEAD", err=%v`, prefix, buf.String())
+	}
+
+	return nil
+}
+
+// validPathElement rejects the path elements which could escape RepositoriesPath.
+func validPathElement(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
+
+// validToken checks that the request has one of the tokens, given either as the password of a basic
+// authentication, which is what git and the browsers send, or as a bearer token.
+func validToken(r *http.Request, tokens []string) bool {
+	token, ok := "", false
+	if _, password, basic := r.BasicAuth(); basic {
+		token, ok = password, true
+	} else if s := r.Header.Get("Authorization"); strings.HasPrefix(s, "Bearer ") {
+		token, ok = strings.TrimPrefix(s, "Bearer "), true
+	}
+
+	if !ok || token == "" {
+		return false
+	}
+
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+// testRepositoryStore is an in-memory repository store. It doesn't implement the sizes and resetting the fetch
+// count, those methods panic.
+type testRepositoryStore struct {
+	datastore.Repository
+
+	mu    sync.Mutex
+	repos internal.Repositories
+}
+
+// get returns the stored repository with id, which must be called with mu held.
+func (s *testRepositoryStore) get(id int64) *internal.Repository {
+	for _, r := range s.repos {
+		if r.ID == id {
+			return r
+		}
+	}
+
+	return nil
+}
+
+func (s *testRepositoryStore) GetAll() (internal.Repositories, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var repos internal.Repositories
+	for _, r := range s.repos {
+		clone := *r
+		repos = append(repos, &clone)
+	}
+
+	return repos, nil
+}
+
+func (s *testRepositoryStore) GetByID(id int64) (*internal.Repository, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.get(id)
+	if r == nil {
+		return nil, nil
+	}
+
+	clone := *r
+	return &clone, nil
+}
+
+func (s *testRepositoryStore) GetByLocalPath(path string) (*internal.Repository, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.repos {
+		if r.LocalPath == path {
+			return r, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *testRepositoryStore) Has(id int64) (bool, error) {
+	r, err := s.GetByID(id)
+	return r != nil, err
+}
+
+func (s *testRepositoryStore) Add(repo *internal.Repository) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clone := *repo
+	s.repos = append(s.repos, &clone)
+	return nil
+}
+
+func (s *testRepositoryStore) SetHook(id, hookID int64, fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r := s.get(id); r != nil {
+		r.HookID, r.HookFingerprint = hookID, fingerprint
+	}
+	return nil
+}
+
+func (s *testRepositoryStore) SetHookError(id int64, hookErr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r := s.get(id); r != nil {
+		r.HookError = hookErr
+	}
+	return nil
+}
+
+func (s *testRepositoryStore) IncrementFetchCount(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r := s.get(id); r != nil {
+		r.FetchCount++
+	}
+	return nil
+}
+
+func (s *testRepositoryStore) SetPrivate(id int64, private bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r := s.get(id); r != nil {
+		r.Private = private
+	}
+	return nil
+}
+
+func TestGitHTTPHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "hello\n")
+	testGit(t, upstream, "checkout", "-q", "-b", "feature")
+	testCommitFile(t, upstream, "FEATURE", "feature\n")
+	testGit(t, upstream, "checkout", "-q", "master")
+	testGit(t, upstream, "tag", "-a", "-m", "v1", "v1")
+
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	conf.RepositoriesPath = filepath.Join(dir, "repositories")
+	conf.GitHTTP.Tokens = []string{"secret"}
+
+	public := &internal.Repository{ID: 1, LocalPath: filepath.Join(conf.RepositoriesPath, "foo", "public"), CloneURL: "file://" + upstream}
+	private := &internal.Repository{ID: 2, LocalPath: filepath.Join(conf.RepositoriesPath, "foo", "private"), CloneURL: "file://" + upstream, Private: true}
+
+	for _, r := range []*internal.Repository{public, private} {
+		if err := UpdateRepository(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The refs of public are exposed like after a sync, those of private when it's first requested.
+	if err := exposeRefs(public.LocalPath); err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := newGitHTTPBackend(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(&gitHTTPHandler{
+		rs:      &testRepositoryStore{repos: internal.Repositories{public, private}},
+		backend: backend,
+	})
+	defer srv.Close()
+
+	clone := func(rawurl, dest string, args ...string) (string, error) {
+		args = append(append([]string{"clone", "-q"}, args...), rawurl, filepath.Join(dir, dest))
+
+		c := exec.Command("git", args...)
+		c.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+		out, err := c.CombinedOutput()
+		return string(out), err
+	}
+
+	if out, err := clone(srv.URL+"/git/foo/public.git", "public-feature", "-b", "feature"); err != nil {
+		t.Fatalf("unable to clone the feature branch. err=%v, output=%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "public-feature", "FEATURE")); err != nil {
+		t.Errorf("expected the clone to be of the feature branch. err=%v", err)
+	}
+
+	if out, err := clone(srv.URL+"/git/foo/public.git", "public-master"); err != nil {
+		t.Fatalf("unable to clone. err=%v, output=%s", err, out)
+	}
+
+	clonePath := filepath.Join(dir, "public-master")
+	if head := strings.TrimSpace(testGit(t, clonePath, "symbolic-ref", "HEAD")); head != "refs/heads/master" {
+		t.Errorf("expected the default branch to be master, got %s", head)
+	}
+	if refs := testGit(t, clonePath, "ls-remote", srv.URL+"/git/foo/public.git"); strings.Contains(refs, "refs/remotes/") || strings.Contains(refs, "refs/heads/HEAD") || !strings.Contains(refs, "refs/tags/v1") {
+		t.Errorf("unexpected refs served:\n%s", refs)
+	}
+
+	if _, err := clone(srv.URL+"/git/foo/private.git", "private-anonymous"); err == nil {
+		t.Error("expected the anonymous clone of a private repository to fail")
+	}
+
+	u, _ := url.Parse(srv.URL + "/git/foo/private.git")
+	u.User = url.UserPassword("git", "secret")
+
+	if out, err := clone(u.String(), "private-feature", "-b", "feature"); err != nil {
+		t.Fatalf("unable to clone the private repository with a token. err=%v, output=%s", err, out)
+	}
+
+	// A branch deleted upstream disappears at the next sync.
+	testGit(t, upstream, "branch", "-D", "feature")
+	if err := UpdateRepository(public); err != nil {
+		t.Fatal(err)
+	}
+	if err := exposeRefs(public.LocalPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if refs := testGit(t, clonePath, "ls-remote", srv.URL+"/git/foo/public.git"); strings.Contains(refs, "feature") {
+		t.Errorf("expected the feature branch to be deleted, got:\n%s", refs)
+	}
+
+	// The namespace isn't restored.
+	refs, err := gitForEachRef(public.LocalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref := range restoredRefs(refs) {
+		if strings.HasPrefix(ref, "refs/namespaces/") {
+			t.Errorf("%s would be restored", ref)
+		}
+	}
+}
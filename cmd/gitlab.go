@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+// gitlabPublic is the visibility_level of the public projects in the GitLab webhook payloads.
+const gitlabPublic = 20
+
+// gitlabProvider mirrors the projects a GitLab user is a member of, with the GitLab API v4.
+//
+// The owner of a project is its namespace, which can contain slashes with subgroups.
+type gitlabProvider struct {
+	conf *config.Provider
+}
+
+func newGitLabProvider(conf *config.Provider) *gitlabProvider {
+	return &gitlabProvider{conf: conf}
+}
+
+type gitlabProject struct {
+	ID                int64  `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+	Visibility        string `json:"visibility"`
+	HTTPURLToRepo     string `json:"http_url_to_repo"`
+	SSHURLToRepo      string `json:"ssh_url_to_repo"`
+	WikiEnabled       bool   `json:"wiki_enabled"`
+}
+
+type gitlabHook struct {
+	ID             int64  `json:"id,omitempty"`
+	URL            string `json:"url"`
+	Token          string `json:"token,omitempty"`
+	PushEvents     bool   `json:"push_events"`
+	TagPushEvents  bool   `json:"tag_push_events"`
+	WikiPageEvents bool   `json:"wiki_page_events"`
+}
+
+type gitlabHookBody struct {
+	Project struct {
+		ID                int64  `json:"id"`
+		PathWithNamespace string `json:"path_with_namespace"`
+		GitHTTPURL        string `json:"git_http_url"`
+		GitSSHURL         string `json:"git_ssh_url"`
+		VisibilityLevel   int    `json:"visibility_level"`
+	} `json:"project"`
+}
+
+func (g *gitlabProvider) Name() string { return g.conf.Name }
+
+func (g *gitlabProvider) CloneHost() string {
+	u, _ := url.Parse(g.conf.URL)
+	return u.Hostname()
+}
+
+func (g *gitlabProvider) do(method, path string, in, out interface{}) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Private-Token", g.conf.Token)
+
+	return doJSON(providerHTTPClient, method, strings.TrimSuffix(g.conf.URL, "/")+"/api/v4"+path, header, in, out)
+}
+
+func (g *gitlabProvider) ListRepositories() ([]*remoteRepository, error) {
+	var res []*remoteRepository
+
+	for page := "1"; page != ""; {
+		var projects []gitlabProject
+
+		resp, err := g.do("GET", "/projects?membership=true&per_page=100&page="+page, nil, &projects)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get user projects. err=%v", err)
+		}
+
+		log.Printf("got %d repositories of %s for page %s", len(projects), g.conf.Name, page)
+
+		for _, project := range projects {
+			owner, name := splitFullName(project.PathWithNamespace)
+
+			res = append(res, &remoteRepository{
+				ID:       project.ID,
+				Owner:    owner,
+				Name:     name,
+				FullName: project.PathWithNamespace,
+				CloneURL: project.HTTPURLToRepo,
+				SSHURL:   project.SSHURLToRepo,
+				Private:  project.Visibility != "public",
+				HasWiki:  project.WikiEnabled,
+			})
+		}
+
+		page = resp.Header.Get("X-Next-Page")
+	}
+
+	return res, nil
+}
+
+func (g *gitlabProvider) AddHook(r *internal.Repository) error {
+	endpoint := providerHookURL(g.conf.Name)
+	path := "/projects/" + url.PathEscape(r.Owner+"/"+r.Name) + "/hooks"
+
+	var hooks []gitlabHook
+	if _, err := g.do("GET", path, nil, &hooks); err != nil {
+		return fmt.Errorf("error while listing webhooks. err=%v", err)
+	}
+
+	for _, hook := range hooks {
+		if hook.URL == endpoint {
+			log.Printf("webhook already exists for %d, %s/%s", r.ID, r.Owner, r.Name)
+			r.HookID = hook.ID
+			return nil
+		}
+	}
+
+	log.Printf("creating webhook for repository %d, %s/%s", r.ID, r.Owner, r.Name)
+
+	hook := gitlabHook{
+		URL:            endpoint,
+		Token:          g.conf.Secret,
+		PushEvents:     true,
+		TagPushEvents:  true,
+		WikiPageEvents: true,
+	}
+
+	if _, err := g.do("POST", path, &hook, &hook); err != nil {
+		return fmt.Errorf("error while creating webhook. err=%v", err)
+	}
+
+	r.HookID = hook.ID
+
+	return nil
+}
+
+func (g *gitlabProvider) Delivery(r *http.Request) (string, string) {
+	return r.Header.Get("X-Gitlab-Event-UUID"), r.Header.Get("X-Gitlab-Event")
+}
+
+// VerifySignature checks the X-Gitlab-Token header, as GitLab sends the secret itself instead of a signature.
+func (g *gitlabProvider) VerifySignature(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(g.conf.Secret)) == 1
+}
+
+// ParseEvent turns the project of the GitLab payloads into the repository of a hookBody.
+func (g *gitlabProvider) ParseEvent(event string, body []byte) (string, *hookBody, error) {
+	var gb gitlabHookBody
+	if err := json.Unmarshal(body, &gb); err != nil {
+		return "", nil, fmt.Errorf("error while decoding json. err=%v", err)
+	}
+
+	var hb hookBody
+	hb.Repository.ID = gb.Project.ID
+	hb.Repository.Owner.Login, hb.Repository.Name = splitFullName(gb.Project.PathWithNamespace)
+	hb.Repository.FullName = gb.Project.PathWithNamespace
+	hb.Repository.CloneURL = gb.Project.GitHTTPURL
+	hb.Repository.SSHURL = gb.Project.GitSSHURL
+	hb.Repository.Private = gb.Project.VisibilityLevel != gitlabPublic
+
+	switch event {
+	case "Push Hook", "Tag Push Hook":
+		event = "push"
+	case "Wiki Page Hook":
+		event = "gollum"
+	default:
+		event = g.conf.Name + "/" + event
+	}
+
+	return event, &hb, nil
+}
+
+var _ Provider = (*gitlabProvider)(nil)
@@ -1,13 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"path/filepath"
 
+	"github.com/google/go-github/github"
 	"github.com/vrischmann/ghmirror/internal"
 	"github.com/vrischmann/ghmirror/internal/config"
 	"github.com/vrischmann/ghmirror/internal/datastore"
@@ -20,6 +22,16 @@ type handler struct {
 	rs  datastore.Repository
 	obs datastore.OwnerBlacklist
 	rbs datastore.RepositoryBlacklist
+	ohs datastore.OrganizationHook
+	ws  datastore.Wiki
+	ms  datastore.MetadataBackup
+	rls datastore.Release
+	ps  datastore.PushStatus
+	ss  datastore.Sync
+	ds  datastore.Delivery
+
+	gh        *github.Client
+	providers []Provider
 }
 
 func newHandler(conf *config.Config) (*handler, error) {
@@ -27,6 +39,16 @@ func newHandler(conf *config.Config) (*handler, error) {
 
 	var err error
 
+	h.gh, err = newGitHubClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	h.providers, err = newProviders(conf, h.gh)
+	if err != nil {
+		return nil, err
+	}
+
 	h.rs, err = postgres.NewRepositoryStore(&conf.Postgres)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create repository store. err=%v", err)
@@ -42,67 +64,365 @@ func newHandler(conf *config.Config) (*handler, error) {
 		return nil, fmt.Errorf("unable to create repository blacklist store. err=%v", err)
 	}
 
+	h.ohs, err = postgres.NewOrganizationHookStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create organization hook store. err=%v", err)
+	}
+
+	h.ws, err = postgres.NewWikiStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create wiki store. err=%v", err)
+	}
+
+	h.ms, err = postgres.NewMetadataBackupStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create metadata backup store. err=%v", err)
+	}
+
+	h.rls, err = postgres.NewReleaseStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create release store. err=%v", err)
+	}
+
+	h.ps, err = postgres.NewPushStatusStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create push status store. err=%v", err)
+	}
+
+	h.ss, err = postgres.NewSyncStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create sync store. err=%v", err)
+	}
+
+	h.ds, err = postgres.NewDeliveryStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create delivery store. err=%v", err)
+	}
+
 	return h, nil
 }
 
-func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	rewind(r.Body)
+// unhandledEvents counts the webhook events we receive but don't act upon, by event type.
+var unhandledEvents = expvar.NewMap("unhandled_events")
+
+// errHookMismatch is returned when a ping comes from a hook we don't know about.
+var errHookMismatch = errors.New("hook ID does not match the stored hook ID")
+
+// serveHook returns the handler of the webhook deliveries of a provider.
+func (h *handler) serveHook(pr Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, event := pr.Delivery(r)
+
+		d, err := h.ds.GetByID(id)
+		if err != nil {
+			log.Printf("error while getting delivery from the datastore. err=%v", err)
+			writeInternalServerError(w)
+			return
+		}
+
+		if d != nil && d.Processed {
+			log.Printf("delivery %s already processed", id)
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, "OK")
+			return
+		}
 
-	var hb hookBody
-	dec := json.NewDecoder(r.Body)
-	if err := dec.Decode(&hb); err != nil {
-		log.Printf("error while decoding json. err=%v", err)
-		writeInternalServerError(w)
-		return
+		rewind(r.Body)
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("error while reading body. err=%v", err)
+			writeInternalServerError(w)
+			return
+		}
+
+		err = h.handleEvent(pr, event, body)
+		switch {
+		case err == errHookMismatch:
+			log.Printf("%v", err)
+			writeBadRequest(w)
+			return
+		case err != nil:
+			log.Printf("%v", err)
+			writeInternalServerError(w)
+			return
+		}
+
+		if d != nil {
+			if err := h.ds.MarkProcessed(id); err != nil {
+				log.Printf("error while marking delivery %s as processed. err=%v", id, err)
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "OK")
 	}
+}
 
+// handleEvent routes a webhook event of a provider to the handler for its type.
+//
+// The repository ID of the event is replaced by the ID under which the repository is stored.
+func (h *handler) handleEvent(pr Provider, event string, body []byte) error {
+	event, hb, err := pr.ParseEvent(event, body)
+	if err != nil {
+		return err
+	}
+
+	if hb.Repository.ID != 0 {
+		hb.Repository.ID, err = repositoryID(pr, hb.Repository.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch event {
+	case "push", "create", "delete":
+		return h.handleSync(pr, hb)
+	case "release":
+		return h.handleRelease(pr, hb)
+	case "gollum":
+		return h.handleWiki(hb)
+	case "issues", "issue_comment", "pull_request", "pull_request_review_comment":
+		return h.handleMetadata(hb)
+	case "ping":
+		return h.handlePing(hb)
+	default:
+		log.Printf("ignoring unhandled event %q for repository %d", event, hb.Repository.ID)
+		unhandledEvents.Add(event, 1)
+		return nil
+	}
+}
+
+// handleSync updates the local copy of the repository, adding it to the datastore if needed.
+func (h *handler) handleSync(pr Provider, hb *hookBody) error {
 	// TODO(vincent): transactions
 
 	ok, err := h.rs.Has(hb.Repository.ID)
 	if err != nil {
-		log.Printf("error while checking for repository in the datastore. err=%v", err)
-		writeInternalServerError(w)
-		return
+		return fmt.Errorf("error while checking for repository in the datastore. err=%v", err)
 	}
 
 	var repo *internal.Repository
 	if !ok {
+		// Organization webhooks send us the events of every repository, including the blacklisted ones.
+		provider, _ := repositoryProvider(pr)
+		owner := ownerKey(provider, hb.Repository.Owner.Login)
+
+		blacklisted, err := h.obs.IsBlacklisted(owner)
+		if err != nil {
+			return fmt.Errorf("error while checking for blacklisted owners in the datastore. err=%v", err)
+		}
+
+		if !blacklisted {
+			blacklisted, err = h.rbs.IsBlacklisted(owner, hb.Repository.Name)
+			if err != nil {
+				return fmt.Errorf("error while checking for blacklisted repositories in the datastore. err=%v", err)
+			}
+		}
+
+		if blacklisted {
+			log.Printf("ignoring repository %s because it is blacklisted", hb.Repository.FullName)
+			return nil
+		}
+
+		if err := checkCloneURL(pr.CloneHost(), hb.Repository.CloneURL); err != nil {
+			return err
+		}
+
+		cloneURL := hb.Repository.CloneURL
+		if g, ok := pr.(*githubProvider); ok {
+			if !g.mirrors(hb.Repository.Owner.Login) {
+				log.Printf("ignoring repository %s because its owner is not mirrored with %s", hb.Repository.FullName, pr.Name())
+				return nil
+			}
+
+			cloneURL = g.cloneURL(cloneURL)
+		}
+
 		log.Printf("repository %d does not exist yet, adding it", hb.Repository.ID)
 
-		localPath := filepath.Join(conf.RepositoriesPath, hb.Repository.FullName)
 		repo = internal.NewRepository(
 			hb.Repository.ID,
+			hb.Repository.Owner.Login,
 			hb.Repository.Name,
-			localPath,
-			hb.Repository.CloneURL,
+			repositoryPath(pr, hb.Repository.FullName),
+			cloneURL,
 		)
+		repo.Private = hb.Repository.Private
+		repo.Provider, repo.Account = repositoryProvider(pr)
 
 		if err := h.rs.Add(repo); err != nil {
-			log.Printf("error while adding repository to the datastore. err=%v", err)
-			writeInternalServerError(w)
-			return
+			return fmt.Errorf("error while adding repository to the datastore. err=%v", err)
 		}
 	} else {
 		repo, err = h.rs.GetByID(hb.Repository.ID)
 		if err != nil {
-			log.Printf("error while getting repository from the datastore. err=%v", err)
-			writeInternalServerError(w)
-			return
+			return fmt.Errorf("error while getting repository from the datastore. err=%v", err)
+		}
+
+		// The owner isn't stored for older rows.
+		repo.Owner = hb.Repository.Owner.Login
+
+		if repo.Private != hb.Repository.Private {
+			if err := h.rs.SetPrivate(repo.ID, hb.Repository.Private); err != nil {
+				return fmt.Errorf("error while setting repository visibility in the datastore. err=%v", err)
+			}
+			repo.Private = hb.Repository.Private
 		}
 	}
 
 	log.Printf("updating repo %d, %s", repo.ID, hb.Repository.FullName)
 
-	if err := UpdateRepository(repo); err != nil {
-		log.Printf("error while cloning repository. err=%v", err)
-		writeInternalServerError(w)
-		return
+	if err := syncRepository(h.rs, h.ss, repo); err != nil {
+		return fmt.Errorf("error while cloning repository. err=%v", err)
 	}
 
 	log.Printf("repo %d, %s updated", repo.ID, hb.Repository.FullName)
 
-	w.WriteHeader(http.StatusOK)
-	io.WriteString(w, "OK")
+	schedulePush(h.ps, repo)
+
+	return nil
+}
+
+// handleRelease mirrors the tag of a new release and backs up the release.
+func (h *handler) handleRelease(pr Provider, hb *hookBody) error {
+	if err := h.handleSync(pr, hb); err != nil {
+		return err
+	}
+
+	// We keep the backup of deleted releases.
+	if !h.conf.Releases.Enabled || hb.Action == "deleted" {
+		return nil
+	}
+
+	repo, err := h.rs.GetByID(hb.Repository.ID)
+	if err != nil {
+		return fmt.Errorf("error while getting repository from the datastore. err=%v", err)
+	}
+
+	// The repository is blacklisted.
+	if repo == nil {
+		return nil
+	}
+
+	owner := hb.Repository.Owner.Login
+	gh := accountClient(h.providers, repo)
+
+	release, _, err := gh.Repositories.GetRelease(owner, repo.Name, hb.Release.ID)
+	if err != nil {
+		return fmt.Errorf("unable to get release %d. err=%v", hb.Release.ID, err)
+	}
+
+	if err := backupRelease(gh, h.rls, owner, repo, release); err != nil {
+		return fmt.Errorf("error while backing up release. err=%v", err)
+	}
+
+	return nil
+}
+
+// handleWiki updates the local copy of the wiki of a repository we already mirror.
+func (h *handler) handleWiki(hb *hookBody) error {
+	repo, err := h.rs.GetByID(hb.Repository.ID)
+	if err != nil {
+		return fmt.Errorf("error while getting repository from the datastore. err=%v", err)
+	}
+
+	if repo == nil {
+		log.Printf("ignoring wiki update of unknown repository %d, %s", hb.Repository.ID, hb.Repository.FullName)
+		return nil
+	}
+
+	log.Printf("updating wiki of repo %d, %s", repo.ID, hb.Repository.FullName)
+
+	if err := updateWiki(h.ws, repo); err != nil {
+		return fmt.Errorf("error while updating wiki. err=%v", err)
+	}
+
+	log.Printf("wiki of repo %d, %s updated", repo.ID, hb.Repository.FullName)
+
+	return nil
+}
+
+// handleMetadata backs up the issues and pull requests updated since the last backup.
+func (h *handler) handleMetadata(hb *hookBody) error {
+	if !h.conf.Metadata.Enabled {
+		return nil
+	}
+
+	repo, err := h.rs.GetByID(hb.Repository.ID)
+	if err != nil {
+		return fmt.Errorf("error while getting repository from the datastore. err=%v", err)
+	}
+
+	if repo == nil {
+		log.Printf("ignoring metadata update of unknown repository %d, %s", hb.Repository.ID, hb.Repository.FullName)
+		return nil
+	}
+
+	if err := backupMetadata(accountClient(h.providers, repo), h.ms, hb.Repository.Owner.Login, repo); err != nil {
+		return fmt.Errorf("error while backing up metadata. err=%v", err)
+	}
+
+	return nil
+}
+
+// handlePing checks that the ping sent by GitHub when creating a hook comes from the hook we stored.
+func (h *handler) handlePing(hb *hookBody) error {
+	if hb.Repository.ID == 0 && hb.Organization.Login != "" {
+		return h.handleOrganizationPing(hb)
+	}
+
+	repo, err := h.rs.GetByID(hb.Repository.ID)
+	if err != nil {
+		return fmt.Errorf("error while getting repository from the datastore. err=%v", err)
+	}
+
+	// The poller creates the hook before adding the repository, so the ping can arrive first.
+	if repo == nil {
+		log.Printf("got ping from hook %d for unknown repository %d, %s", hb.HookID, hb.Repository.ID, hb.Repository.FullName)
+		return nil
+	}
+
+	if repo.HookID != hb.HookID {
+		log.Printf("got ping from hook %d for repo %d, %s but the stored hook is %d", hb.HookID, repo.ID, hb.Repository.FullName, repo.HookID)
+		return errHookMismatch
+	}
+
+	log.Printf("got ping from hook %d for repo %d, %s", hb.HookID, repo.ID, hb.Repository.FullName)
+
+	return nil
+}
+
+func (h *handler) handleOrganizationPing(hb *hookBody) error {
+	hook, err := h.ohs.GetByName(hb.Organization.Login)
+	if err != nil {
+		return fmt.Errorf("error while getting organization hook from the datastore. err=%v", err)
+	}
+
+	if hook == nil {
+		log.Printf("got ping from hook %d for unknown organization %s", hb.HookID, hb.Organization.Login)
+		return nil
+	}
+
+	if hook.HookID != hb.HookID {
+		log.Printf("got ping from hook %d for organization %s but the stored hook is %d", hb.HookID, hb.Organization.Login, hook.HookID)
+		return errHookMismatch
+	}
+
+	log.Printf("got ping from hook %d for organization %s", hb.HookID, hb.Organization.Login)
+
+	return nil
+}
+
+func writeBadRequest(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusBadRequest)
+	io.WriteString(w, "Bad Request")
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="ghmirror"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	io.WriteString(w, "Unauthorized")
 }
 
 func writeForbidden(w http.ResponseWriter) {
@@ -110,6 +430,11 @@ func writeForbidden(w http.ResponseWriter) {
 	io.WriteString(w, "Forbidden")
 }
 
+func writeRequestEntityTooLarge(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	io.WriteString(w, "Request Entity Too Large")
+}
+
 func writeInternalServerError(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
 	io.WriteString(w, "Oh Noes !")
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+type testDeliveryStore struct {
+	datastore.Delivery
+
+	deliveries map[string]*internal.Delivery
+}
+
+func (s *testDeliveryStore) GetByID(id string) (*internal.Delivery, error) {
+	return s.deliveries[id], nil
+}
+
+func (s *testDeliveryStore) MarkProcessed(id string) error {
+	s.deliveries[id].Processed = true
+	return nil
+}
+
+type testWikiStore struct {
+	datastore.Wiki
+
+	mu    sync.Mutex
+	wikis []*internal.Wiki
+}
+
+func (s *testWikiStore) GetByRepositoryID(id int64) (*internal.Wiki, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, w := range s.wikis {
+		if w.RepositoryID == id {
+			return w, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *testWikiStore) Add(wiki *internal.Wiki) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.wikis = append(s.wikis, wiki)
+	return nil
+}
+
+type testReleaseStore struct {
+	datastore.Release
+
+	releases map[int64]*internal.Release
+	assets   map[int64]*internal.ReleaseAsset
+}
+
+func (s *testReleaseStore) Has(id int64) (bool, error) {
+	_, ok := s.releases[id]
+	return ok, nil
+}
+
+func (s *testReleaseStore) Add(release *internal.Release) error {
+	s.releases[release.ID] = release
+	return nil
+}
+
+func (s *testReleaseStore) HasAsset(id int64) (bool, error) {
+	_, ok := s.assets[id]
+	return ok, nil
+}
+
+func (s *testReleaseStore) AddAsset(asset *internal.ReleaseAsset) error {
+	s.assets[asset.ID] = asset
+	return nil
+}
+
+type testMetadataBackupStore struct {
+	datastore.MetadataBackup
+
+	backups map[int64]time.Time
+}
+
+func (s *testMetadataBackupStore) GetLastBackup(id int64) (time.Time, error) {
+	return s.backups[id], nil
+}
+
+func (s *testMetadataBackupStore) SetLastBackup(id int64, t time.Time) error {
+	s.backups[id] = t
+	return nil
+}
+
+type testSyncStore struct {
+	datastore.Sync
+
+	mu    sync.Mutex
+	syncs internal.Syncs
+}
+
+func (s *testSyncStore) Add(sync *internal.Sync) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.syncs = append(s.syncs, sync)
+	return nil
+}
+
+// newTestHandler returns a handler with a mirrored repository foo/bar, whose upstream is a local repository.
+func newTestHandler(t *testing.T, dir string) (*handler, *internal.Repository) {
+	t.Helper()
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "hello\n")
+
+	r := &internal.Repository{
+		ID:        1,
+		Owner:     "foo",
+		Name:      "bar",
+		LocalPath: filepath.Join(dir, "repositories", "foo", "bar"),
+		CloneURL:  "file://" + upstream,
+	}
+
+	c := conf
+	h := &handler{
+		conf: &c,
+		rs:   &testRepositoryStore{repos: internal.Repositories{r}},
+		ss:   &testSyncStore{},
+		ds:   &testDeliveryStore{deliveries: make(map[string]*internal.Delivery)},
+	}
+
+	return h, r
+}
+
+func TestServeHookProcessedDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h, r := newTestHandler(t, dir)
+	ds, ss := h.ds.(*testDeliveryStore), h.ss.(*testSyncStore)
+
+	ds.deliveries["redelivered"] = &internal.Delivery{ID: "redelivered", SignatureValid: true, Processed: true}
+	ds.deliveries["new"] = &internal.Delivery{ID: "new", SignatureValid: true}
+
+	serve := h.serveHook(&githubProvider{})
+	body := fmt.Sprintf(`{"repository": {"id": %d, "name": "bar", "full_name": "foo/bar", "owner": {"login": "foo"}}}`, r.ID)
+
+	deliver := func(id string) int {
+		req := httptest.NewRequest("POST", "/hook", nil)
+		req.Body = newRewindableReader([]byte(body))
+		req.Header.Set("X-GitHub-Delivery", id)
+		req.Header.Set("X-GitHub-Event", "push")
+
+		w := httptest.NewRecorder()
+		serve(w, req)
+		return w.Code
+	}
+
+	// A delivery already processed is acknowledged without syncing again.
+	if code := deliver("redelivered"); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if len(ss.syncs) != 0 {
+		t.Errorf("expected the processed delivery to not be handled again, got %d syncs", len(ss.syncs))
+	}
+
+	if code := deliver("new"); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if len(ss.syncs) != 1 || ss.syncs[0].Error != "" {
+		t.Fatalf("expected the new delivery to sync the repository, got %+v", ss.syncs)
+	}
+	if !ds.deliveries["new"].Processed {
+		t.Error("expected the new delivery to be marked as processed")
+	}
+
+	// And so is the new delivery when it's sent again.
+	if code := deliver("new"); code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if len(ss.syncs) != 1 {
+		t.Errorf("expected the redelivery to not be handled again, got %d syncs", len(ss.syncs))
+	}
+
+	if _, err := os.Stat(filepath.Join(r.LocalPath, "README")); err != nil {
+		t.Errorf("expected the repository to be cloned. err=%v", err)
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		mu.Unlock()
+
+		switch {
+		case req.URL.Path == "/repos/foo/bar/releases/5":
+			fmt.Fprint(w, `{"id": 5, "tag_name": "v1"}`)
+		case req.Method == "GET":
+			fmt.Fprint(w, `[]`)
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer srv.Close()
+
+	gh := github.NewClient(nil)
+	gh.BaseURL, _ = url.Parse(srv.URL + "/")
+
+	h, r := newTestHandler(t, dir)
+	h.conf.Releases.Enabled = true
+	h.conf.Metadata.Enabled = true
+	h.providers = []Provider{&githubProvider{gh: gh}}
+	h.ws = &testWikiStore{}
+	h.rls = &testReleaseStore{releases: make(map[int64]*internal.Release), assets: make(map[int64]*internal.ReleaseAsset)}
+	h.ms = &testMetadataBackupStore{backups: make(map[int64]time.Time)}
+
+	r.HookID = 10
+	testGit(t, dir, "init", "-q", filepath.Join(dir, "upstream.wiki.git"))
+	testCommitFile(t, filepath.Join(dir, "upstream.wiki.git"), "Home.md", "welcome\n")
+
+	ss := h.ss.(*testSyncStore)
+	pr := &githubProvider{}
+
+	handle := func(event, extra string) error {
+		mu.Lock()
+		requests = nil
+		mu.Unlock()
+
+		body := `{"repository": {"id": 1, "name": "bar", "full_name": "foo/bar", "owner": {"login": "foo"}}` + extra + `}`
+		return h.handleEvent(pr, event, []byte(body))
+	}
+
+	hasRequest := func(exp string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, req := range requests {
+			if req == exp {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i, event := range []string{"push", "create", "delete"} {
+		if err := handle(event, ""); err != nil {
+			t.Fatalf("%s: %v", event, err)
+		}
+		if len(ss.syncs) != i+1 {
+			t.Errorf("%s: expected the repository to be synced, got %d syncs", event, len(ss.syncs))
+		}
+	}
+
+	t.Run("release", func(t *testing.T) {
+		syncs := len(ss.syncs)
+
+		if err := handle("release", `, "action": "published", "release": {"id": 5}`); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ss.syncs) != syncs+1 {
+			t.Error("expected the repository to be synced for its new tag")
+		}
+		if !hasRequest("GET /repos/foo/bar/releases/5") {
+			t.Errorf("expected the release to be fetched, got requests %v", requests)
+		}
+		if _, ok := h.rls.(*testReleaseStore).releases[5]; !ok {
+			t.Error("expected the release to be backed up")
+		}
+	})
+
+	t.Run("gollum", func(t *testing.T) {
+		if err := handle("gollum", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		if w, _ := h.ws.GetByRepositoryID(1); w == nil {
+			t.Error("expected the wiki to be added")
+		}
+		if _, err := os.Stat(filepath.Join(r.LocalPath+".wiki", "Home.md")); err != nil {
+			t.Errorf("expected the wiki to be mirrored. err=%v", err)
+		}
+	})
+
+	t.Run("issues", func(t *testing.T) {
+		if err := handle("issues", `, "action": "opened"`); err != nil {
+			t.Fatal(err)
+		}
+
+		if !hasRequest("GET /repos/foo/bar/issues") {
+			t.Errorf("expected the issues to be backed up, got requests %v", requests)
+		}
+		if h.ms.(*testMetadataBackupStore).backups[1].IsZero() {
+			t.Error("expected the metadata backup to be recorded")
+		}
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		if err := handle("ping", `, "hook_id": 10`); err != nil {
+			t.Errorf("expected the ping of the stored hook to succeed, got %v", err)
+		}
+
+		if err := handle("ping", `, "hook_id": 11`); err != errHookMismatch {
+			t.Errorf("expected errHookMismatch, got %v", err)
+		}
+
+		// A ping for a repository we don't have yet is accepted, the poller creates the hook first.
+		body := `{"hook_id": 11, "repository": {"id": 2, "name": "baz", "full_name": "foo/baz", "owner": {"login": "foo"}}}`
+		if err := h.handleEvent(pr, "ping", []byte(body)); err != nil {
+			t.Errorf("expected the ping of an unknown repository to succeed, got %v", err)
+		}
+	})
+
+	t.Run("unhandled", func(t *testing.T) {
+		count := func() int64 {
+			if v, ok := unhandledEvents.Get("watch").(*expvar.Int); ok {
+				return v.Value()
+			}
+			return 0
+		}
+
+		before := count()
+		syncs := len(ss.syncs)
+
+		if err := handle("watch", `, "action": "started"`); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := count(); got != before+1 {
+			t.Errorf("expected the unhandled events count to be incremented from %d, got %d", before, got)
+		}
+		if len(ss.syncs) != syncs {
+			t.Error("expected the unhandled event to not sync the repository")
+		}
+	})
+}
@@ -1,24 +1,207 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/datastore"
 )
 
 func UpdateRepository(r *internal.Repository) error {
-	_, err := os.Stat(r.LocalPath)
+	return updateMirror(r.CloneURL, r.LocalPath)
+}
+
+// syncRepository updates the local copy of a repository and records the sync in the history.
+func syncRepository(rs datastore.Repository, ss datastore.Sync, r *internal.Repository) error {
+	defer lockRepository(r.LocalPath)()
+
+	s := &internal.Sync{
+		RepositoryID: r.ID,
+		StartedAt:    time.Now(),
+	}
+
+	err := syncLocalCopy(rs, r)
+
+	s.Duration = time.Since(s.StartedAt)
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	if err := ss.Add(s); err != nil {
+		log.Printf("error while adding sync to the datastore. err=%v", err)
+	}
+
+	return err
+}
+
+// syncLocalCopy updates the local copy of a repository, then fetches its pull request refs if configured to
+// and its LFS objects if it uses LFS. The refs overwritten by the update are kept in the overwrittenRefs namespace.
+func syncLocalCopy(rs datastore.Repository, r *internal.Repository) error {
+	// Record the ref tips before updating, to keep those a force push or a deletion would lose.
+	var before map[string]string
+	if _, err := os.Stat(r.LocalPath); err == nil {
+		before, err = gitForEachRef(r.LocalPath, mirroredRefs...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := UpdateRepository(r); err != nil {
+		return err
+	}
+
+	if err := rs.IncrementFetchCount(r.ID); err != nil {
+		return fmt.Errorf("error while incrementing the fetch count in the datastore. err=%v", err)
+	}
+
+	if conf.PullRequestRefs.Enabled || stringSliceContains(conf.PullRequestRefs.Repositories, r.Owner+"/"+r.Name) {
+		log.Printf("git fetch pull requests in %s", r.LocalPath)
+
+		if err := gitFetchPullRequests(r.CloneURL, r.LocalPath); err != nil {
+			return err
+		}
+	}
+
+	if err := preserveOverwrittenRefs(r.LocalPath, before); err != nil {
+		return err
+	}
+
+	if err := pruneOverwrittenRefs(r.LocalPath, conf.Overwritten.Retention); err != nil {
+		return err
+	}
+
+	if conf.GitHTTP.Enabled {
+		if err := exposeRefs(r.LocalPath); err != nil {
+			return err
+		}
+	}
+
+	ok, err := usesLFS(r.LocalPath)
+	if err != nil || !ok {
+		return err
+	}
+
+	log.Printf("git lfs fetch in %s", r.LocalPath)
+
+	if err := gitLFSFetch(r.CloneURL, r.LocalPath); err != nil {
+		return err
+	}
+
+	size, err := dirSize(filepath.Join(r.LocalPath, ".git", "lfs", "objects"))
+	if err != nil {
+		return fmt.Errorf("unable to compute the LFS storage size. err=%v", err)
+	}
+
+	log.Printf("LFS storage size of repo %d, %s is %d bytes", r.ID, r.LocalPath, size)
+
+	if size != r.LFSSize {
+		r.LFSSize = size
+		if err := rs.SetLFSSize(r.ID, size); err != nil {
+			return fmt.Errorf("error while setting the LFS storage size in the datastore. err=%v", err)
+		}
+	}
+
+	return nil
+}
+
+func UpdateWiki(w *internal.Wiki) error {
+	return updateMirror(w.CloneURL, w.LocalPath)
+}
+
+func UpdateGist(g *internal.Gist) error {
+	return updateMirror(g.CloneURL, g.LocalPath)
+}
+
+// updateMirror clones the repository at url into localPath, or updates it if it was already cloned.
+func updateMirror(url, localPath string) error {
+	_, err := os.Stat(localPath)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
 	if os.IsNotExist(err) {
-		log.Printf("git clone from %s to %s", r.CloneURL, r.LocalPath)
-		return gitClone(r.CloneURL, r.LocalPath)
+		log.Printf("git clone from %s to %s", url, localPath)
+		return gitClone(url, localPath)
+	}
+
+	log.Printf("git pull in %s", localPath)
+
+	return gitPull(url, localPath)
+}
+
+// updateWiki mirrors the wiki of a repository next to it, adding the wiki to the datastore if needed. It holds the
+// lock of the local copy of the wiki like syncRepository, since the handler and the poller can update it at once.
+func updateWiki(ws datastore.Wiki, r *internal.Repository) error {
+	localPath := r.LocalPath + ".wiki"
+	defer lockRepository(localPath)()
+
+	w, err := ws.GetByRepositoryID(r.ID)
+	if err != nil {
+		return fmt.Errorf("error while getting wiki from the datastore. err=%v", err)
 	}
 
-	log.Printf("git pull in %s", r.LocalPath)
+	if w == nil {
+		w = internal.NewWiki(r.ID, localPath, wikiCloneURL(r.CloneURL))
+
+		if err := ws.Add(w); err != nil {
+			return fmt.Errorf("error while adding wiki to the datastore. err=%v", err)
+		}
+	}
+
+	return UpdateWiki(w)
+}
+
+// wikiCloneURL returns the URL of the wiki repository, which works for both the HTTPS and SSH URLs.
+func wikiCloneURL(cloneURL string) string {
+	return strings.TrimSuffix(cloneURL, ".git") + ".wiki.git"
+}
+
+// usesLFS checks if any .gitattributes of the branches of the repository at dir has LFS filters.
+func usesLFS(dir string) (bool, error) {
+	refs, err := gitForEachRef(dir, "refs/heads/", "refs/remotes/origin/")
+	if err != nil {
+		return false, err
+	}
+
+	seen := make(map[string]bool)
+	var tips []string
+	for _, object := range refs {
+		if !seen[object] {
+			seen[object] = true
+			tips = append(tips, object)
+		}
+	}
+
+	if len(tips) == 0 {
+		return false, nil
+	}
+
+	return gitGrepTips(dir, "filter=lfs", ":(glob)**/.gitattributes", tips)
+}
+
+// dirSize returns the total size of the files in dir, or 0 if it doesn't exist.
+func dirSize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			return nil
+		case err != nil:
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+
+		return nil
+	})
 
-	return gitPull(r.LocalPath)
+	return size, err
 }
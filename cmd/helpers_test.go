@@ -0,0 +1,259 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// testGit runs git in dir for a test, with a fixed identity for the commits.
+func testGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	args = append([]string{"-c", "user.name=ghmirror", "-c", "user.email=ghmirror@example.com", "-c", "init.defaultBranch=master"}, args...)
+
+	c := exec.Command("git", args...)
+	c.Dir = dir
+
+	out, err := c.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed. err=%v, output=%s", args, err, out)
+	}
+
+	return string(out)
+}
+
+// testCommitFile writes a file in the working copy at dir and commits it.
+func testCommitFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testGit(t, dir, "add", name)
+	testGit(t, dir, "commit", "-q", "-m", "add "+name)
+}
+
+func TestUsesLFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "filter=lfs is only a string here\n")
+	testCommitFile(t, upstream, ".gitattributes", "*.txt text\n")
+
+	clone := func(name string) string {
+		path := filepath.Join(dir, name)
+		testGit(t, dir, "clone", "-q", upstream, path)
+		return path
+	}
+
+	without := clone("without")
+
+	ok, err := usesLFS(without)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected a repository without LFS filters to not use LFS")
+	}
+
+	// The filters are in a subdirectory of a branch other than master.
+	testGit(t, upstream, "checkout", "-q", "-b", "assets")
+	testCommitFile(t, upstream, "assets/images/.gitattributes", "*.png filter=lfs diff=lfs merge=lfs -text\n")
+	testGit(t, upstream, "checkout", "-q", "master")
+
+	with := clone("with")
+
+	ok, err = usesLFS(with)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("expected a repository with LFS filters in a branch to use LFS")
+	}
+
+	empty := filepath.Join(dir, "empty")
+	testGit(t, dir, "init", "-q", empty)
+
+	ok, err = usesLFS(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("expected an empty repository to not use LFS")
+	}
+}
+
+func TestLFSMissingObjects(t *testing.T) {
+	storage, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(storage)
+
+	const (
+		present = "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+		missing = "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"
+	)
+
+	if err := os.MkdirAll(filepath.Join(storage, present[0:2], present[2:4]), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(storage, present[0:2], present[2:4], present), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := present + " * images/present.png\n" + missing + " - images/with space.png\n"
+
+	got := lfsMissingObjects(storage, output)
+	if expected := []string{"images/with space.png"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	if got := lfsMissingObjects(storage, ""); got != nil {
+		t.Errorf("expected no missing object, got %v", got)
+	}
+}
+
+func TestUpdateWiki(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream.wiki.git")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "Home.md", "welcome\n")
+
+	r := &internal.Repository{
+		ID:        1,
+		LocalPath: filepath.Join(dir, "repositories", "foo", "bar"),
+		CloneURL:  "file://" + filepath.Join(dir, "upstream.git"),
+	}
+	ws := &testWikiStore{}
+
+	// The handler and the poller can mirror the wiki at the same time, the first one clones it.
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() { errs <- updateWiki(ws, r) }()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if len(ws.wikis) != 1 || ws.wikis[0].LocalPath != r.LocalPath+".wiki" {
+		t.Fatalf("expected the wiki to be added once, got %+v", ws.wikis)
+	}
+
+	testCommitFile(t, upstream, "Install.md", "make\n")
+
+	if err := updateWiki(ws, r); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, page := range []string{"Home.md", "Install.md"} {
+		if _, err := os.Stat(filepath.Join(r.LocalPath+".wiki", page)); err != nil {
+			t.Errorf("expected the page %s to be mirrored. err=%v", page, err)
+		}
+	}
+}
+
+func TestSyncPullRequestRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	conf.PullRequestRefs.Enabled = false
+	conf.PullRequestRefs.Repositories = []string{"foo/bar"}
+	conf.Overwritten.Retention = 0
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "hello\n")
+	head := strings.TrimSpace(testGit(t, upstream, "rev-parse", "HEAD"))
+
+	for _, ref := range []string{"refs/pull/1/head", "refs/pull/1/merge", "refs/pull/2/head"} {
+		testGit(t, upstream, "update-ref", ref, head)
+	}
+
+	r := &internal.Repository{
+		ID:        1,
+		Owner:     "foo",
+		Name:      "bar",
+		LocalPath: filepath.Join(dir, "mirror"),
+		CloneURL:  "file://" + upstream,
+	}
+	rs := &testRepositoryStore{repos: internal.Repositories{r}}
+
+	if err := syncLocalCopy(rs, r); err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := gitForEachRef(r.LocalPath, pullRequestRefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]string{
+		pullRequestRefs + "1/head":  head,
+		pullRequestRefs + "1/merge": head,
+		pullRequestRefs + "2/head":  head,
+	}
+	if !reflect.DeepEqual(refs, exp) {
+		t.Errorf("expected pull request refs %v, got %v", exp, refs)
+	}
+
+	// The merge ref of a merged pull request is pruned, and kept as an overwritten ref.
+	testGit(t, upstream, "update-ref", "-d", "refs/pull/1/merge")
+
+	if err := syncLocalCopy(rs, r); err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err = gitForEachRef(r.LocalPath, pullRequestRefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(exp, pullRequestRefs+"1/merge")
+	if !reflect.DeepEqual(refs, exp) {
+		t.Errorf("expected pull request refs %v, got %v", exp, refs)
+	}
+
+	if got, exp := testOverwritten(t, r.LocalPath), map[string]string{"ghmirror/pull/1/merge": head}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected overwritten refs %v, got %v", exp, got)
+	}
+
+	// The pull request refs of the other repositories aren't fetched.
+	other := &internal.Repository{ID: 2, Owner: "foo", Name: "other", LocalPath: filepath.Join(dir, "other"), CloneURL: "file://" + upstream}
+	rs.Add(other)
+
+	if err := syncLocalCopy(rs, other); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := gitForEachRef(other.LocalPath, pullRequestRefs); err != nil || len(refs) != 0 {
+		t.Errorf("expected no pull request refs for foo/other, got %v and err=%v", refs, err)
+	}
+}
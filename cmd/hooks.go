@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+// hookEvents returns the events our webhooks subscribe to.
+func hookEvents() []string {
+	events := []string{"push", "create", "delete", "release", "gollum"}
+	if conf.Metadata.Enabled {
+		events = append(events, "issues", "issue_comment", "pull_request", "pull_request_review_comment")
+	}
+
+	return events
+}
+
+// hookTarget is where the webhooks of a GitHub account send the events, and the secret they sign them with.
+type hookTarget struct {
+	endpoint string
+	secret   string
+}
+
+// defaultHookTarget is the hook target of the default account.
+func defaultHookTarget() hookTarget {
+	return hookTarget{endpoint: conf.Webhook.Endpoint, secret: conf.Secret}
+}
+
+// desiredHook returns the webhook as we want it configured on GitHub.
+func desiredHook(t hookTarget) *github.Hook {
+	name := "web"
+	active := true
+
+	return &github.Hook{
+		Name:   &name,
+		Events: hookEvents(),
+		Config: map[string]interface{}{
+			"url":          t.endpoint,
+			"content_type": "json",
+			"secret":       t.secret,
+		},
+		Active: &active,
+	}
+}
+
+// hookFingerprint identifies the configuration applied by desiredHook.
+//
+// GitHub never gives back the secret of a hook, so comparing the fingerprint stored when
+// we last configured a hook with the current one is the only way to notice the secret changed.
+func hookFingerprint(t hookTarget) string {
+	h := sha256.New()
+	io.WriteString(h, t.endpoint+"\n")
+	io.WriteString(h, strings.Join(hookEvents(), ",")+"\n")
+	io.WriteString(h, "json\n")
+	io.WriteString(h, t.secret)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hookUpToDate checks that a hook as returned by GitHub matches desiredHook, except for the secret.
+func hookUpToDate(hook *github.Hook, t hookTarget) bool {
+	if hook.Active == nil || !*hook.Active {
+		return false
+	}
+
+	if hookConfigString(hook, "url") != t.endpoint || hookConfigString(hook, "content_type") != "json" {
+		return false
+	}
+
+	// GitHub masks the secret but still tells us if there is one.
+	if t.secret != "" && hookConfigString(hook, "secret") == "" {
+		return false
+	}
+
+	wanted := hookEvents()
+	if len(hook.Events) != len(wanted) {
+		return false
+	}
+
+	events := append([]string(nil), hook.Events...)
+	sort.Strings(events)
+	sort.Strings(wanted)
+
+	for i := range events {
+		if events[i] != wanted[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hookConfigString(hook *github.Hook, key string) string {
+	v, ok := hook.Config[key]
+	if !ok {
+		return ""
+	}
+
+	s, _ := v.(string)
+
+	return s
+}
+
+// hookPolicy returns the hook policy of an owner or organization.
+func hookPolicy(owner string) config.HookPolicy {
+	for _, p := range conf.Webhook.OwnerPolicies {
+		if p.Owner == owner {
+			return p.Policy
+		}
+	}
+
+	return conf.Webhook.Policy
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestHookFingerprint(t *testing.T) {
+	conf.Metadata.Enabled = false
+	defer func() { conf.Metadata.Enabled = false }()
+
+	target := hookTarget{endpoint: "https://example.com/hook", secret: "secret"}
+	fingerprint := hookFingerprint(target)
+
+	if fingerprint != hookFingerprint(target) {
+		t.Fatal("the fingerprint is not stable")
+	}
+
+	testCases := []hookTarget{
+		{endpoint: "https://example.com/other", secret: "secret"},
+		{endpoint: "https://example.com/hook", secret: "other"},
+		{endpoint: "https://example.com/hook"},
+	}
+
+	for _, tc := range testCases {
+		if hookFingerprint(tc) == fingerprint {
+			t.Errorf("%+v: expected a different fingerprint", tc)
+		}
+	}
+
+	conf.Metadata.Enabled = true
+	if hookFingerprint(target) == fingerprint {
+		t.Error("expected a different fingerprint when the events change")
+	}
+}
+
+func TestHookUpToDate(t *testing.T) {
+	conf.Metadata.Enabled = false
+
+	target := hookTarget{endpoint: "https://example.com/hook", secret: "secret"}
+
+	upToDate := func() *github.Hook {
+		hook := desiredHook(target)
+		hook.Config["secret"] = "********"
+
+		// GitHub doesn't keep the order of the events.
+		events := hook.Events
+		for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+			events[i], events[j] = events[j], events[i]
+		}
+
+		return hook
+	}
+
+	inactive := false
+
+	testCases := []struct {
+		name   string
+		change func(h *github.Hook)
+		ok     bool
+	}{
+		{"up to date", func(h *github.Hook) {}, true},
+		{"inactive", func(h *github.Hook) { h.Active = &inactive }, false},
+		{"no active flag", func(h *github.Hook) { h.Active = nil }, false},
+		{"other url", func(h *github.Hook) { h.Config["url"] = "https://example.com/other" }, false},
+		{"form content type", func(h *github.Hook) { h.Config["content_type"] = "form" }, false},
+		{"no secret", func(h *github.Hook) { delete(h.Config, "secret") }, false},
+		{"missing event", func(h *github.Hook) { h.Events = h.Events[1:] }, false},
+		{"other event", func(h *github.Hook) { h.Events[0] = "fork" }, false},
+	}
+
+	for _, tc := range testCases {
+		hook := upToDate()
+		tc.change(hook)
+
+		if got := hookUpToDate(hook, target); got != tc.ok {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.ok, got)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "sync"
+
+var (
+	repositoryLocksMu sync.Mutex
+	repositoryLocks   = make(map[string]*sync.Mutex)
+)
+
+// lockRepository serializes the operations on the local copy of a repository and returns the unlock function.
+func lockRepository(localPath string) func() {
+	repositoryLocksMu.Lock()
+	mu, ok := repositoryLocks[localPath]
+	if !ok {
+		mu = new(sync.Mutex)
+		repositoryLocks[localPath] = mu
+	}
+	repositoryLocksMu.Unlock()
+
+	mu.Lock()
+
+	return mu.Unlock
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"expvar"
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/codegangsta/negroni"
 	"github.com/vrischmann/envconfig"
@@ -22,6 +24,27 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if err := setupCABundle(&conf.Github); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := setupGitHubApp(&conf); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 {
+		cmd, ok := commands[os.Args[1]]
+		if !ok {
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+
+		if err := cmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
 	log.Printf("ghmirror %s-%s", version, commit)
 	log.Printf("listen address: %v", conf.ListenAddress)
 	log.Printf("postgres conf: %+v", conf.Postgres)
@@ -34,20 +57,76 @@ func main() {
 	}
 	go poller.run()
 
+	if conf.Snapshots.Path != "" {
+		snapshotter, err := newSnapshotter(&conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go snapshotter.run()
+	}
+
+	if conf.Fsck.Enabled {
+		checker, err := newChecker(&conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go checker.run()
+	}
+
+	// The maintainer measures the size of the local copies even when the maintenance is disabled.
+	maintainer, err := newMaintainer(&conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go maintainer.run()
+
 	handler, err := newHandler(&conf)
 	if err != nil {
 		log.Fatal(err)
 	}
+	go handler.pruneDeliveries()
 
-	mux := http.NewServeMux()
-	mux.Handle("/hook", handler)
+	status, err := newStatusHandler(&conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dashboard, err := newDashboardHandler(&conf)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// TODO(vincent): replace negroni
 
+	mux := http.NewServeMux()
+
+	for _, pr := range handler.providers {
+		hook := negroni.New()
+		hook.UseFunc(makeBodyRewindable)
+		hook.UseFunc(handler.recordDelivery(pr))
+		hook.UseFunc(hookAuthentication(pr))
+		hook.UseHandler(handler.serveHook(pr))
+
+		// The GitHub webhooks created before there were providers send the events to /hook.
+		if pr.Name() == githubProviderName {
+			mux.Handle("/hook", hook)
+		}
+		mux.Handle("/hook/"+pr.Name(), hook)
+	}
+
+	mux.Handle("/status", adminAuthentication(status))
+	mux.Handle(dashboardPrefix, adminAuthentication(dashboard))
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	if conf.GitHTTP.Enabled {
+		git, err := newGitHTTPHandler(&conf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux.Handle(gitHTTPPrefix, git)
+	}
+
 	n := negroni.Classic()
-	n.UseFunc(makeBodyRewindable)
-	n.UseFunc(hookAuthentication)
-	n.UseFunc(eventTypeValidation)
 	n.UseHandler(mux)
 	n.Run(string(conf.ListenAddress.StringSlice()[0]))
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+	"github.com/vrischmann/ghmirror/internal/postgres"
+)
+
+// reclaimedBytes is the total disk space reclaimed by the repository maintenance.
+var reclaimedBytes = expvar.NewInt("maintenance_reclaimed_bytes")
+
+// maintainer regularly runs git gc, git repack and git commit-graph write on the repositories which need it,
+// if the maintenance is enabled, and measures the size of their local copies.
+type maintainer struct {
+	conf *config.Config
+
+	rs datastore.Repository
+}
+
+func newMaintainer(conf *config.Config) (*maintainer, error) {
+	m := &maintainer{conf: conf}
+
+	var err error
+
+	m.rs, err = postgres.NewRepositoryStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create repository store. err=%v", err)
+	}
+
+	return m, nil
+}
+
+func (m *maintainer) run() {
+	ticker := time.NewTicker(m.conf.Maintenance.Frequency)
+
+	for range ticker.C {
+		m.maintainRepositories()
+	}
+}
+
+func (m *maintainer) maintainRepositories() {
+	repos, err := m.rs.GetAll()
+	if err != nil {
+		log.Printf("error while getting repositories from the datastore. err=%v", err)
+		return
+	}
+
+	var total int64
+	for _, r := range repos {
+		if m.conf.Maintenance.Enabled {
+			reclaimed, err := m.maintain(r)
+			if err != nil {
+				log.Printf("error while maintaining repository %d, %s. err=%v", r.ID, r.LocalPath, err)
+			}
+
+			total += reclaimed
+		}
+
+		if err := m.measure(r); err != nil {
+			log.Printf("error while measuring repository %d, %s. err=%v", r.ID, r.LocalPath, err)
+		}
+	}
+
+	if m.conf.Maintenance.Enabled {
+		reclaimedBytes.Add(total)
+
+		log.Printf("repository maintenance reclaimed %d bytes", total)
+	}
+}
+
+// measure records the size of the local copy of a repository. It walks the whole local copy, so it's done on
+// the maintenance schedule rather than after each sync. It doesn't lock the repository: a sync running meanwhile
+// only makes the size a bit off.
+func (m *maintainer) measure(r *internal.Repository) error {
+	size, err := dirSize(r.LocalPath)
+	if err != nil {
+		return fmt.Errorf("unable to compute the size. err=%v", err)
+	}
+
+	if size == r.Size {
+		return nil
+	}
+
+	if err := m.rs.SetSize(r.ID, size); err != nil {
+		return fmt.Errorf("error while setting the size in the datastore. err=%v", err)
+	}
+
+	return nil
+}
+
+// maintain runs git gc if the repository has too many loose objects or packs, or only repacks it
+// if it was fetched many times. It returns the space reclaimed in bytes.
+func (m *maintainer) maintain(r *internal.Repository) (int64, error) {
+	defer lockRepository(r.LocalPath)()
+
+	before, err := gitCountObjects(r.LocalPath)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case before["count"] >= m.conf.Maintenance.LooseObjectsThreshold || before["packs"] >= m.conf.Maintenance.PacksThreshold:
+		log.Printf("git gc in %s, %d loose objects and %d packs", r.LocalPath, before["count"], before["packs"])
+
+		if err := gitGC(r.LocalPath); err != nil {
+			return 0, err
+		}
+
+	case r.FetchCount >= m.conf.Maintenance.FetchThreshold:
+		log.Printf("git repack in %s, fetched %d times", r.LocalPath, r.FetchCount)
+
+		if err := gitRepack(r.LocalPath); err != nil {
+			return 0, err
+		}
+
+	default:
+		return 0, nil
+	}
+
+	if err := gitCommitGraphWrite(r.LocalPath); err != nil {
+		return 0, err
+	}
+
+	if err := m.rs.ResetFetchCount(r.ID); err != nil {
+		return 0, fmt.Errorf("error while resetting the fetch count in the datastore. err=%v", err)
+	}
+
+	after, err := gitCountObjects(r.LocalPath)
+	if err != nil {
+		return 0, err
+	}
+
+	// git count-objects gives the sizes in KiB.
+	reclaimed := (objectsSize(before) - objectsSize(after)) * 1024
+
+	log.Printf("maintenance of %s reclaimed %d bytes", r.LocalPath, reclaimed)
+
+	return reclaimed, nil
+}
+
+func objectsSize(counts map[string]int64) int64 {
+	return counts["size"] + counts["size-pack"] + counts["size-garbage"]
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+type testSizeStore struct {
+	testRepositoryStore
+
+	sizes map[int64]int64
+}
+
+func (s *testSizeStore) SetSize(id, size int64) error {
+	s.sizes[id] = size
+	return nil
+}
+
+func TestMaintainerMeasure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "foo", ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{"README": 100, ".git/pack": 1000} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "foo", name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs := &testSizeStore{sizes: make(map[int64]int64)}
+	m := &maintainer{conf: &config.Config{}, rs: rs}
+
+	r := &internal.Repository{ID: 1, LocalPath: filepath.Join(dir, "foo")}
+	if err := m.measure(r); err != nil {
+		t.Fatal(err)
+	}
+	if rs.sizes[1] != 1100 {
+		t.Errorf("expected a size of 1100 bytes, got %d", rs.sizes[1])
+	}
+
+	// The size isn't written again if it didn't change.
+	delete(rs.sizes, 1)
+	r.Size = 1100
+	if err := m.measure(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rs.sizes[1]; ok {
+		t.Error("expected the unchanged size to not be written")
+	}
+
+	// A local copy which doesn't exist yet has no size.
+	r = &internal.Repository{ID: 2, LocalPath: filepath.Join(dir, "bar"), Size: 10}
+	if err := m.measure(r); err != nil {
+		t.Fatal(err)
+	}
+	if size, ok := rs.sizes[2]; !ok || size != 0 {
+		t.Errorf("expected a size of 0, got %d", size)
+	}
+}
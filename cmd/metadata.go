@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+// metadataVersion is the version of the format of the files written by the metadata backup.
+const metadataVersion = 1
+
+// metadataFile is the envelope of every file written by the metadata backup.
+type metadataFile struct {
+	Version    int         `json:"version"`
+	Kind       string      `json:"kind"`
+	BackedUpAt time.Time   `json:"backed_up_at"`
+	Data       interface{} `json:"data"`
+}
+
+// backupDir returns the directory, next to the mirror, where everything not in git is backed up.
+func backupDir(r *internal.Repository) string {
+	return r.LocalPath + ".backup"
+}
+
+// backupMetadata exports the issues, pull requests, comments, labels and milestones of a repository as JSON files.
+//
+// Only what was updated since the last backup is fetched, except for the labels and milestones which are few.
+func backupMetadata(gh *github.Client, ms datastore.MetadataBackup, owner string, r *internal.Repository) error {
+	since, err := ms.GetLastBackup(r.ID)
+	if err != nil {
+		return fmt.Errorf("error while getting last metadata backup from the datastore. err=%v", err)
+	}
+
+	start := time.Now()
+	dir := filepath.Join(backupDir(r), "metadata")
+
+	// Issues include the pull requests, but not their review specific fields.
+	count := 0
+	for page := 0; ; {
+		opts := &github.IssueListByRepoOptions{
+			State:       "all",
+			Sort:        "updated",
+			Direction:   "asc",
+			Since:       since,
+			ListOptions: github.ListOptions{Page: page, PerPage: 100},
+		}
+
+		issues, resp, err := gh.Issues.ListByRepo(owner, r.Name, opts)
+		if err != nil {
+			return fmt.Errorf("unable to get issues. err=%v", err)
+		}
+
+		for _, issue := range issues {
+			if err := writeMetadataFile(filepath.Join(dir, "issues", strconv.Itoa(*issue.Number)+".json"), "issue", issue); err != nil {
+				return err
+			}
+			count++
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		page = resp.NextPage
+	}
+
+	// The pull requests list can't be filtered by date, so stop at the first one not updated since the last backup.
+pulls:
+	for page := 0; ; {
+		opts := &github.PullRequestListOptions{
+			State:       "all",
+			Sort:        "updated",
+			Direction:   "desc",
+			ListOptions: github.ListOptions{Page: page, PerPage: 100},
+		}
+
+		pulls, resp, err := gh.PullRequests.List(owner, r.Name, opts)
+		if err != nil {
+			return fmt.Errorf("unable to get pull requests. err=%v", err)
+		}
+
+		for _, pull := range pulls {
+			if pull.UpdatedAt != nil && pull.UpdatedAt.Before(since) {
+				break pulls
+			}
+
+			if err := writeMetadataFile(filepath.Join(dir, "pulls", strconv.Itoa(*pull.Number)+".json"), "pull_request", pull); err != nil {
+				return err
+			}
+			count++
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		page = resp.NextPage
+	}
+
+	for page := 0; ; {
+		opts := &github.IssueListCommentsOptions{
+			Since:       since,
+			ListOptions: github.ListOptions{Page: page, PerPage: 100},
+		}
+
+		comments, resp, err := gh.Issues.ListComments(owner, r.Name, 0, opts)
+		if err != nil {
+			return fmt.Errorf("unable to get issue comments. err=%v", err)
+		}
+
+		for _, comment := range comments {
+			if err := writeMetadataFile(filepath.Join(dir, "comments", strconv.Itoa(*comment.ID)+".json"), "comment", comment); err != nil {
+				return err
+			}
+			count++
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		page = resp.NextPage
+	}
+
+	for page := 0; ; {
+		opts := &github.PullRequestListCommentsOptions{
+			Since:       since,
+			ListOptions: github.ListOptions{Page: page, PerPage: 100},
+		}
+
+		comments, resp, err := gh.PullRequests.ListComments(owner, r.Name, 0, opts)
+		if err != nil {
+			return fmt.Errorf("unable to get review comments. err=%v", err)
+		}
+
+		for _, comment := range comments {
+			if err := writeMetadataFile(filepath.Join(dir, "review_comments", strconv.Itoa(*comment.ID)+".json"), "review_comment", comment); err != nil {
+				return err
+			}
+			count++
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		page = resp.NextPage
+	}
+
+	var labels []github.Label
+	for page := 0; ; {
+		l, resp, err := gh.Issues.ListLabels(owner, r.Name, &github.ListOptions{Page: page, PerPage: 100})
+		if err != nil {
+			return fmt.Errorf("unable to get labels. err=%v", err)
+		}
+
+		labels = append(labels, l...)
+
+		if resp.NextPage == 0 {
+			break
+		}
+		page = resp.NextPage
+	}
+
+	if err := writeMetadataFile(filepath.Join(dir, "labels.json"), "labels", labels); err != nil {
+		return err
+	}
+
+	milestones, err := listMilestones(gh, owner, r.Name)
+	if err != nil {
+		return fmt.Errorf("unable to get milestones. err=%v", err)
+	}
+
+	if err := writeMetadataFile(filepath.Join(dir, "milestones.json"), "milestones", milestones); err != nil {
+		return err
+	}
+
+	if err := ms.SetLastBackup(r.ID, start); err != nil {
+		return fmt.Errorf("error while setting last metadata backup in the datastore. err=%v", err)
+	}
+
+	log.Printf("backed up %d issues, pull requests and comments of repo %d, %s/%s", count, r.ID, owner, r.Name)
+
+	return nil
+}
+
+// listMilestones returns all the milestones of a repository, open or closed.
+//
+// MilestoneListOptions of this client has no pagination options, so the pages are requested by hand.
+func listMilestones(gh *github.Client, owner, repo string) ([]github.Milestone, error) {
+	var milestones []github.Milestone
+
+	for page := 0; ; {
+		req, err := gh.NewRequest("GET", fmt.Sprintf("repos/%s/%s/milestones?state=all&page=%d&per_page=100", owner, repo, page), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var m []github.Milestone
+		resp, err := gh.Do(req, &m)
+		if err != nil {
+			return nil, err
+		}
+
+		milestones = append(milestones, m...)
+
+		if resp.NextPage == 0 {
+			break
+		}
+		page = resp.NextPage
+	}
+
+	return milestones, nil
+}
+
+// writeMetadataFile atomically replaces the file at path with data wrapped in a metadataFile.
+func writeMetadataFile(path, kind string, data interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("unable to create directory. err=%v", err)
+	}
+
+	buf, err := json.MarshalIndent(metadataFile{
+		Version:    metadataVersion,
+		Kind:       kind,
+		BackedUpAt: time.Now(),
+		Data:       data,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode %s. err=%v", kind, err)
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return fmt.Errorf("unable to write %s. err=%v", tmp, err)
+	}
+
+	return os.Rename(tmp, path)
+}
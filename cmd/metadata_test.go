@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestListMilestones(t *testing.T) {
+	const total = 250
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/foo/bar/milestones" {
+			http.NotFound(w, r)
+			return
+		}
+
+		q := r.URL.Query()
+		if q.Get("state") != "all" || q.Get("per_page") != "100" {
+			t.Errorf("unexpected query %s", r.URL.RawQuery)
+		}
+
+		page, _ := strconv.Atoi(q.Get("page"))
+		if page == 0 {
+			page = 1
+		}
+
+		var milestones []github.Milestone
+		for i := (page - 1) * 100; i < page*100 && i < total; i++ {
+			number := i + 1
+			milestones = append(milestones, github.Milestone{Number: &number})
+		}
+
+		if page*100 < total {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/repos/foo/bar/milestones?page=%d>; rel="next"`, srv.URL, page+1))
+		}
+
+		json.NewEncoder(w).Encode(milestones)
+	}))
+	defer srv.Close()
+
+	gh := github.NewClient(nil)
+	gh.BaseURL, _ = url.Parse(srv.URL + "/")
+
+	milestones, err := listMilestones(gh, "foo", "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(milestones) != total {
+		t.Fatalf("expected %d milestones, got %d", total, len(milestones))
+	}
+	for i, m := range milestones {
+		if *m.Number != i+1 {
+			t.Fatalf("expected milestone %d at index %d, got %d", i+1, i, *m.Number)
+		}
+	}
+}
@@ -9,11 +9,20 @@ import (
 	"log"
 	"net/http"
 	"strings"
+
+	"github.com/codegangsta/negroni"
 )
 
-// makeBodyRewindable turns a request's Body into a rewind-able body.
+// maxHookBodySize is the size of the largest webhook payload GitHub sends.
+const maxHookBodySize = 25 << 20
+
+// makeBodyRewindable turns a request's Body into a rewind-able body, refusing the bodies larger than maxHookBodySize.
 func makeBodyRewindable(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	body, err := ioutil.ReadAll(r.Body)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBodySize))
+	if _, ok := err.(*http.MaxBytesError); ok {
+		writeRequestEntityTooLarge(w)
+		return
+	}
 	if err != nil {
 		log.Printf("error while reading body. err=%v", err)
 		writeInternalServerError(w)
@@ -26,43 +35,48 @@ func makeBodyRewindable(w http.ResponseWriter, r *http.Request, next http.Handle
 	next(w, r)
 }
 
-// hookAuthentication checks that the webhook event is authenticated.
-func hookAuthentication(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+// adminAuthentication only lets through the requests authenticated with one of the admin tokens.
+func adminAuthentication(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validToken(r, conf.Admin.Tokens) {
+			writeUnauthorized(w)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// hookAuthentication checks that the webhook event is authenticated, as the provider does it.
+func hookAuthentication(pr Provider) negroni.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		if !pr.VerifySignature(r) {
+			writeForbidden(w)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// validSignature checks the request body against the signature in the X-Hub-Signature header.
+func validSignature(r *http.Request, secret string) bool {
 	rewind(r.Body)
 
 	sign := r.Header.Get("X-Hub-Signature")
 	if !strings.HasPrefix(sign, "sha1=") {
-		writeForbidden(w)
-		return
+		return false
 	}
 
 	messageMAC, err := hex.DecodeString(strings.Split(sign, "=")[1])
 	if err != nil {
 		log.Printf("error while decoding message MAC. err=%v", err)
-		writeForbidden(w)
-		return
+		return false
 	}
 
-	mac := hmac.New(sha1.New, []byte(conf.Secret))
+	mac := hmac.New(sha1.New, []byte(secret))
 	io.Copy(mac, r.Body)
 	expectedMAC := mac.Sum(nil)
 
-	if !hmac.Equal(expectedMAC, messageMAC) {
-		writeForbidden(w)
-		return
-	}
-
-	next(w, r)
-}
-
-// eventTypeValidation checks that the webhook event is of the correct type.
-func eventTypeValidation(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	et := r.Header.Get("X-GitHub-Event")
-	if et != "push" {
-		w.WriteHeader(http.StatusOK)
-		io.WriteString(w, "OK")
-		return
-	}
-
-	next(w, r)
+	return hmac.Equal(expectedMAC, messageMAC)
 }
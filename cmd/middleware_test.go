@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMakeBodyRewindable(t *testing.T) {
+	testCases := []struct {
+		size   int
+		status int
+	}{
+		{0, http.StatusOK},
+		{1024, http.StatusOK},
+		{maxHookBodySize, http.StatusOK},
+		{maxHookBodySize + 1, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tc := range testCases {
+		body := bytes.Repeat([]byte("a"), tc.size)
+
+		var read []byte
+		next := func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			rewind(r.Body)
+			read, _ = ioutil.ReadAll(r.Body)
+		}
+
+		w := httptest.NewRecorder()
+		makeBodyRewindable(w, httptest.NewRequest("POST", "/hook", bytes.NewReader(body)), next)
+
+		if w.Code != tc.status {
+			t.Errorf("size %d: expected status %d, got %d", tc.size, tc.status, w.Code)
+		}
+		if tc.status == http.StatusOK && !bytes.Equal(read, body) {
+			t.Errorf("size %d: the body read after rewinding is %d bytes", tc.size, len(read))
+		}
+	}
+}
+
+func TestValidSignature(t *testing.T) {
+	body := `{"zen":"Keep it logically awesome."}`
+
+	sign := func(secret string) string {
+		mac := hmac.New(sha1.New, []byte(secret))
+		mac.Write([]byte(body))
+		return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	testCases := []struct {
+		header string
+		valid  bool
+	}{
+		{sign("secret"), true},
+		{sign("other"), false},
+		{"", false},
+		{"sha1=zz", false},
+		{strings.TrimPrefix(sign("secret"), "sha1="), false},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest("POST", "/hook", nil)
+		r.Body = newRewindableReader([]byte(body))
+		r.Header.Set("X-Hub-Signature", tc.header)
+
+		if got := validSignature(r, "secret"); got != tc.valid {
+			t.Errorf("signature %q: expected %v, got %v", tc.header, tc.valid, got)
+		}
+	}
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	oldTokens := conf.Admin.Tokens
+	defer func() { conf.Admin.Tokens = oldTokens }()
+
+	h := adminAuthentication(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	testCases := []struct {
+		tokens []string
+		auth   func(r *http.Request)
+		status int
+	}{
+		{[]string{"admin"}, func(r *http.Request) { r.SetBasicAuth("", "admin") }, http.StatusOK},
+		{[]string{"admin"}, func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin") }, http.StatusOK},
+		{[]string{"admin"}, func(r *http.Request) { r.SetBasicAuth("admin", "other") }, http.StatusUnauthorized},
+		{[]string{"admin"}, func(r *http.Request) {}, http.StatusUnauthorized},
+		{nil, func(r *http.Request) { r.SetBasicAuth("", "") }, http.StatusUnauthorized},
+		{nil, func(r *http.Request) {}, http.StatusUnauthorized},
+	}
+
+	for i, tc := range testCases {
+		conf.Admin.Tokens = tc.tokens
+
+		r := httptest.NewRequest("GET", "/status", nil)
+		tc.auth(r)
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("case %d: expected status %d, got %d", i, tc.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// overwrittenRefs is the namespace where the old tip of the refs moved by a force push or deleted
+// are kept, as refs/ghmirror/overwritten/<timestamp>/<ref>.
+const overwrittenRefs = "refs/ghmirror/overwritten/"
+
+const overwrittenTimeFormat = "20060102T150405Z"
+
+// mirroredRefs are the refs which are preserved when they're overwritten.
+var mirroredRefs = []string{"refs/remotes/origin/", "refs/tags/", pullRequestRefs}
+
+// preserveOverwrittenRefs compares the ref tips recorded before a sync with the current ones, and keeps
+// the old tip of every ref which was deleted or didn't move fast-forward.
+func preserveOverwrittenRefs(dir string, before map[string]string) error {
+	after, err := gitForEachRef(dir, mirroredRefs...)
+	if err != nil {
+		return err
+	}
+
+	prefix := overwrittenRefs + time.Now().UTC().Format(overwrittenTimeFormat) + "/"
+
+	for ref, old := range before {
+		if ref == "refs/remotes/origin/HEAD" {
+			continue
+		}
+
+		tip, ok := after[ref]
+		if ok && tip == old {
+			continue
+		}
+
+		if ok {
+			ff, err := gitIsAncestor(dir, old, tip)
+			if err != nil {
+				return err
+			}
+
+			if ff {
+				continue
+			}
+		}
+
+		preserved := prefix + strings.TrimPrefix(ref, "refs/")
+
+		log.Printf("ref %s was overwritten in %s, keeping %s as %s", ref, dir, old, preserved)
+
+		if err := gitUpdateRef(dir, preserved, old); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneOverwrittenRefs deletes the overwritten refs older than the retention. A zero retention keeps them forever.
+func pruneOverwrittenRefs(dir string, retention time.Duration) error {
+	if retention == 0 {
+		return nil
+	}
+
+	refs, err := gitForEachRef(dir, overwrittenRefs)
+	if err != nil {
+		return err
+	}
+
+	for ref := range refs {
+		t, err := overwrittenAt(ref)
+		if err != nil {
+			return err
+		}
+
+		if time.Since(t) < retention {
+			continue
+		}
+
+		if err := gitDeleteRef(dir, ref); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func overwrittenAt(ref string) (time.Time, error) {
+	s := strings.SplitN(strings.TrimPrefix(ref, overwrittenRefs), "/", 2)[0]
+
+	return time.Parse(overwrittenTimeFormat, s)
+}
+
+// overwrittenCommand lists or restores the overwritten refs of a repository.
+func overwrittenCommand(args []string) error {
+	const usage = "usage: ghmirror overwritten list <repository path>\n       ghmirror overwritten restore [-to <remote url>] [-yes] <repository path> <overwritten ref> <branch>"
+
+	if len(args) < 1 {
+		return errors.New(usage)
+	}
+
+	switch args[0] {
+	case "list":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+
+		dir, err := localRepositoryPath(args[1])
+		if err != nil {
+			return err
+		}
+
+		refs, err := gitForEachRef(dir, overwrittenRefs)
+		if err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(refs))
+		for ref := range refs {
+			names = append(names, ref)
+		}
+		sort.Strings(names)
+
+		for _, ref := range names {
+			fmt.Printf("%s %s\n", refs[ref], ref)
+		}
+
+		return nil
+
+	case "restore":
+		fs := flag.NewFlagSet("restore", flag.ExitOnError)
+		flTo := fs.String("to", "", "Push the restored branch to this remote instead of creating it in the mirror")
+		flYes := fs.Bool("yes", false, "Really push, otherwise only print what would be pushed")
+		positional := parseFlags(fs, args[1:])
+
+		if len(positional) != 3 {
+			return errors.New(usage)
+		}
+
+		dir, err := localRepositoryPath(positional[0])
+		if err != nil {
+			return err
+		}
+		ref, branch := positional[1], positional[2]
+
+		if !strings.HasPrefix(ref, overwrittenRefs) {
+			ref = overwrittenRefs + ref
+		}
+
+		defer lockRepository(dir)()
+
+		refs, err := gitForEachRef(dir, ref)
+		if err != nil {
+			return err
+		}
+
+		object, ok := refs[ref]
+		if !ok {
+			return fmt.Errorf("ref %s does not exist", ref)
+		}
+
+		if *flTo != "" {
+			if !*flYes {
+				fmt.Printf("%s would be pushed to %s as refs/heads/%s, run again with -yes to push it\n", object, redactURL(*flTo), branch)
+				return nil
+			}
+
+			return gitPush(nil, dir, *flTo, object+":refs/heads/"+branch)
+		}
+
+		return gitUpdateRef(dir, "refs/heads/"+branch, object)
+
+	default:
+		return errors.New(usage)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// testOverwritten returns the overwritten refs of the repository at dir without their timestamp, with their object.
+func testOverwritten(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	refs, err := gitForEachRef(dir, overwrittenRefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overwritten := make(map[string]string)
+	for ref, object := range refs {
+		overwritten[strings.SplitN(strings.TrimPrefix(ref, overwrittenRefs), "/", 2)[1]] = object
+	}
+
+	return overwritten
+}
+
+// testStdout returns what f prints on the standard output.
+func testStdout(t *testing.T, f func() error) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := os.Stdout
+	os.Stdout = w
+
+	err = f()
+
+	os.Stdout = old
+	w.Close()
+
+	out, _ := ioutil.ReadAll(r)
+	r.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+func TestPreserveOverwrittenRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	conf.RepositoriesPath = filepath.Join(dir, "repositories")
+	conf.Overwritten.Retention = 0
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "hello\n")
+	testCommitFile(t, upstream, "CHANGELOG", "v1\n")
+	testGit(t, upstream, "branch", "feature")
+	testGit(t, upstream, "branch", "fast-forward")
+	testGit(t, upstream, "tag", "v1")
+
+	r := &internal.Repository{
+		ID:        1,
+		Owner:     "foo",
+		Name:      "bar",
+		LocalPath: filepath.Join(conf.RepositoriesPath, "foo", "bar"),
+		CloneURL:  "file://" + upstream,
+	}
+	rs := &testRepositoryStore{repos: internal.Repositories{r}}
+
+	if err := syncLocalCopy(rs, r); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := gitForEachRef(r.LocalPath, mirroredRefs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// master is force pushed, feature and v1 are deleted, and fast-forward moves fast-forward.
+	testGit(t, upstream, "reset", "-q", "--hard", "HEAD~1")
+	testCommitFile(t, upstream, "NEWS", "rewritten\n")
+	testGit(t, upstream, "branch", "-D", "feature")
+	testGit(t, upstream, "tag", "-d", "v1")
+	testGit(t, upstream, "checkout", "-q", "fast-forward")
+	testCommitFile(t, upstream, "TODO", "more\n")
+	testGit(t, upstream, "checkout", "-q", "master")
+
+	if err := syncLocalCopy(rs, r); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]string{
+		"remotes/origin/master":  before["refs/remotes/origin/master"],
+		"remotes/origin/feature": before["refs/remotes/origin/feature"],
+		"tags/v1":                before["refs/tags/v1"],
+	}
+	if got := testOverwritten(t, r.LocalPath); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected overwritten refs %v, got %v", exp, got)
+	}
+
+	after, err := gitForEachRef(r.LocalPath, mirroredRefs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"refs/remotes/origin/feature", "refs/tags/v1"} {
+		if _, ok := after[ref]; ok {
+			t.Errorf("expected %s to be deleted from the mirror", ref)
+		}
+	}
+
+	// Nothing is preserved when nothing was overwritten.
+	if err := syncLocalCopy(rs, r); err != nil {
+		t.Fatal(err)
+	}
+	if got := testOverwritten(t, r.LocalPath); len(got) != len(exp) {
+		t.Errorf("expected %d overwritten refs, got %v", len(exp), got)
+	}
+}
+
+func TestPruneOverwrittenRefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testGit(t, dir, "init", "-q", dir)
+	testCommitFile(t, dir, "README", "hello\n")
+	head := strings.TrimSpace(testGit(t, dir, "rev-parse", "HEAD"))
+
+	now := time.Now().UTC()
+	old := overwrittenRefs + now.Add(-2*time.Hour).Format(overwrittenTimeFormat) + "/tags/old"
+	recent := overwrittenRefs + now.Add(-time.Minute).Format(overwrittenTimeFormat) + "/tags/recent"
+
+	for _, ref := range []string{old, recent} {
+		if err := gitUpdateRef(dir, ref, head); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		retention time.Duration
+		exp       []string
+	}{
+		{0, []string{old, recent}},
+		{time.Hour, []string{recent}},
+	}
+
+	for _, tc := range testCases {
+		if err := pruneOverwrittenRefs(dir, tc.retention); err != nil {
+			t.Fatal(err)
+		}
+
+		refs, err := gitForEachRef(dir, overwrittenRefs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for ref := range refs {
+			got = append(got, ref)
+		}
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, tc.exp) {
+			t.Errorf("retention %s: expected refs %v, got %v", tc.retention, tc.exp, got)
+		}
+	}
+}
+
+func TestOverwrittenCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	conf.RepositoriesPath = filepath.Join(dir, "repositories")
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "hello\n")
+	head := strings.TrimSpace(testGit(t, upstream, "rev-parse", "HEAD"))
+
+	mirror := filepath.Join(conf.RepositoriesPath, "foo", "bar")
+	if err := UpdateRepository(&internal.Repository{LocalPath: mirror, CloneURL: "file://" + upstream}); err != nil {
+		t.Fatal(err)
+	}
+
+	const timestamp = "20160102T030405Z"
+	ref := overwrittenRefs + timestamp + "/remotes/origin/feature"
+	if err := gitUpdateRef(mirror, ref, head); err != nil {
+		t.Fatal(err)
+	}
+
+	out := testStdout(t, func() error { return overwrittenCommand([]string{"list", "foo/bar"}) })
+	if exp := head + " " + ref + "\n"; out != exp {
+		t.Errorf("expected the list %q, got %q", exp, out)
+	}
+
+	// Restored as a branch of the mirror.
+	if err := overwrittenCommand([]string{"restore", "foo/bar", timestamp + "/remotes/origin/feature", "restored"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(testGit(t, mirror, "rev-parse", "refs/heads/restored")); got != head {
+		t.Errorf("expected the restored branch to point to %s, got %s", head, got)
+	}
+
+	// Pushed to a remote, only with -yes.
+	remote := filepath.Join(dir, "remote.git")
+	testGit(t, dir, "init", "-q", "--bare", remote)
+
+	args := []string{"restore", "-to", "file://" + remote, "foo/bar", timestamp + "/remotes/origin/feature", "feature"}
+
+	out = testStdout(t, func() error { return overwrittenCommand(args) })
+	if !strings.Contains(out, "-yes") {
+		t.Errorf("expected the dry run to mention -yes, got %q", out)
+	}
+	if got := testRefs(t, remote); len(got) != 0 {
+		t.Errorf("expected nothing to be pushed without -yes, got %v", got)
+	}
+
+	if err := overwrittenCommand(append(args, "-yes")); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(testGit(t, remote, "rev-parse", "refs/heads/feature")); got != head {
+		t.Errorf("expected the pushed branch to point to %s, got %s", head, got)
+	}
+
+	if err := overwrittenCommand([]string{"restore", "foo/bar", timestamp + "/remotes/origin/missing", "missing"}); err == nil {
+		t.Error("expected restoring a missing ref to fail")
+	}
+}
@@ -3,11 +3,8 @@ package main
 import (
 	"fmt"
 	"log"
-	"path/filepath"
 	"time"
 
-	"golang.org/x/oauth2"
-
 	"github.com/google/go-github/github"
 	"github.com/vrischmann/ghmirror/internal"
 	"github.com/vrischmann/ghmirror/internal/config"
@@ -15,26 +12,40 @@ import (
 	"github.com/vrischmann/ghmirror/internal/postgres"
 )
 
-// poller poll regularly the GitHub API for new repositories
+// poller poll regularly the providers for new repositories
 type poller struct {
 	conf *config.Config
 
 	rs  datastore.Repository
 	obs datastore.OwnerBlacklist
 	rbs datastore.RepositoryBlacklist
-
-	gh *github.Client
+	ohs datastore.OrganizationHook
+	ws  datastore.Wiki
+	ms  datastore.MetadataBackup
+	rls datastore.Release
+	ps  datastore.PushStatus
+	ss  datastore.Sync
+	gs  datastore.Gist
+
+	gh        *github.Client
+	providers []Provider
 }
 
 func newPoller(conf *config.Config) (*poller, error) {
 	p := &poller{conf: conf}
 
-	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: conf.PersonalAccessToken})
-	tc := oauth2.NewClient(oauth2.NoContext, ts)
-	p.gh = github.NewClient(tc)
-
 	var err error
 
+	p.gh, err = newGitHubClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	p.providers, err = newProviders(conf, p.gh)
+	if err != nil {
+		return nil, err
+	}
+
 	p.rs, err = postgres.NewRepositoryStore(&conf.Postgres)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create repository store. err=%v", err)
@@ -50,11 +61,47 @@ func newPoller(conf *config.Config) (*poller, error) {
 		return nil, fmt.Errorf("unable to create repository blacklist store. err=%v", err)
 	}
 
+	p.ohs, err = postgres.NewOrganizationHookStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create organization hook store. err=%v", err)
+	}
+
+	p.ws, err = postgres.NewWikiStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create wiki store. err=%v", err)
+	}
+
+	p.ms, err = postgres.NewMetadataBackupStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create metadata backup store. err=%v", err)
+	}
+
+	p.rls, err = postgres.NewReleaseStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create release store. err=%v", err)
+	}
+
+	p.ps, err = postgres.NewPushStatusStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create push status store. err=%v", err)
+	}
+
+	p.ss, err = postgres.NewSyncStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create sync store. err=%v", err)
+	}
+
+	p.gs, err = postgres.NewGistStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create gist store. err=%v", err)
+	}
+
 	return p, nil
 }
 
 func (p *poller) run() {
 	ticker := time.NewTicker(p.conf.PollFrequency)
+	reconcile := time.NewTicker(p.conf.Webhook.ReconcileFrequency)
 
 	force := make(chan struct{}, 1)
 	force <- struct{}{}
@@ -64,75 +111,90 @@ func (p *poller) run() {
 		case <-ticker.C:
 			p.updateRepositories()
 		case <-force:
+			// The poll doesn't create the webhooks of the repositories of Webhook.Organizations, so their
+			// organization webhooks must exist first. Reconcile at startup too, the webhooks may have drifted
+			// while we were down.
+			p.reconcileOrganizationWebHooks()
 			p.updateRepositories()
+			p.reconcileWebHooks()
+		case <-reconcile.C:
+			p.reconcileWebHooks()
 		}
 	}
 }
 
 func (p *poller) updateRepositories() {
-	count := 0
-	for page := 0; ; {
-		repos, nextPage, err := p.updateRepositoriesForPage(page)
+	for _, pr := range p.providers {
+		count, err := p.updateProviderRepositories(pr)
 		if err != nil {
 			log.Printf("%v", err)
-			return
-		}
-
-		count += repos
-
-		if nextPage == 0 {
-			break
+			continue
 		}
 
-		page = nextPage
+		log.Printf("%d %s repositories updated", count, pr.Name())
 	}
 
-	log.Printf("%d repositories updated", count)
+	switch {
+	case p.conf.Gists.Enabled && ghApp != nil:
+		log.Printf("the gists can't be mirrored with a GitHub App, which has no user")
+	case p.conf.Gists.Enabled:
+		p.updateGists()
+	}
 }
 
-func (p *poller) updateRepositoriesForPage(page int) (int, int, error) {
-	var opts github.RepositoryListOptions
-	opts.ListOptions.Page = page
-
-	repos, resp, err := p.gh.Repositories.List("", &opts)
+func (p *poller) updateProviderRepositories(pr Provider) (int, error) {
+	repos, err := pr.ListRepositories()
 	if err != nil {
-		return 0, 0, fmt.Errorf("unable to get user repositories. err=%v", err)
+		return 0, err
 	}
 
 	// TODO(vincent): transactions !
 
-	log.Printf("got %d repositories for page %d", len(repos), page)
+	count := 0
+	for _, repo := range repos {
+		id, err := repositoryID(pr, repo.ID)
+		if err != nil {
+			log.Printf("ignoring repository %s. err=%v", repo.FullName, err)
+			continue
+		}
 
-	nextPage := resp.NextPage
+		cloneURL := repo.CloneURL
+		if repo.Private {
+			cloneURL = repo.SSHURL
+		}
 
-	if len(repos) == 0 {
-		return 0, 0, nil
-	}
+		if err := checkCloneURL(pr.CloneHost(), cloneURL); err != nil {
+			log.Printf("ignoring repository %s. err=%v", repo.FullName, err)
+			continue
+		}
 
-	count := 0
-	for _, repo := range repos {
-		id := int64(*repo.ID)
+		provider, _ := repositoryProvider(pr)
+		owner := ownerKey(provider, repo.Owner)
 
-		cloneURL := *repo.CloneURL
+		ok, err := p.obs.IsBlacklisted(owner)
+		if err != nil {
+			return 0, fmt.Errorf("error while checking for blacklisted owners in the datastore. err=%v", err)
+		}
 
-		if repo.Private != nil && *repo.Private {
-			cloneURL = *repo.SSHURL
+		if ok {
+			log.Printf("ignoring repository %s because the owner is blacklisted", repo.FullName)
+			continue
 		}
 
-		ok, err := p.obs.IsBlacklisted(*repo.Owner.Login)
+		ok, err = p.rbs.IsBlacklisted(owner, repo.Name)
 		if err != nil {
-			return 0, 0, fmt.Errorf("error while checking for blacklisted owners in the datastore. err=%v", err)
+			return 0, fmt.Errorf("error while checking for blacklisted repositories in the datastore. err=%v", err)
 		}
 
 		if ok {
-			log.Printf("ignoring repository %s because the owner is blacklisted", *repo.FullName)
+			log.Printf("ignoring repository %s because it is blacklisted", repo.FullName)
 			continue
 		}
 
 		var r *internal.Repository
 
 		if ok, err = p.rs.Has(id); err != nil {
-			return 0, 0, fmt.Errorf("error while checking for repository in the datastore. err=%v", err)
+			return 0, fmt.Errorf("error while checking for repository in the datastore. err=%v", err)
 		}
 
 		switch {
@@ -140,67 +202,97 @@ func (p *poller) updateRepositoriesForPage(page int) (int, int, error) {
 			// Let's add the new repository if it does not exist
 			log.Printf("repository %d does not exist yet, adding it", id)
 
-			localPath := filepath.Join(conf.RepositoriesPath, *repo.FullName)
 			r = internal.NewRepository(
 				id,
-				*repo.Name,
-				localPath,
+				repo.Owner,
+				repo.Name,
+				repositoryPath(pr, repo.FullName),
 				cloneURL,
 			)
-
-			login := *repo.Owner.Login
-
-			log.Printf("check the webhook exist for %s", *repo.FullName)
-
-			ok, hookID, err := p.webHookExist(login, *repo.Name)
-			if err != nil {
-				return 0, 0, fmt.Errorf("error while checking the webhook exist. err=%v", err)
-			}
+			r.Private = repo.Private
+			r.Provider, r.Account = repositoryProvider(pr)
 
 			switch {
-			case !ok:
-				log.Printf("webhook does not exists for %d, %s", id, *repo.FullName)
-				log.Printf("creating webhook for repository %d, %s", id, *repo.FullName)
+			case hookPolicy(owner) == config.HookPolicyNone:
+				log.Printf("not creating a webhook for %s, the hook policy is %s", repo.FullName, config.HookPolicyNone)
 
-				hookID, err = p.createWebHook(*repo.Owner.Login, *repo.Name, p.gh)
-				if err != nil {
-					return 0, 0, fmt.Errorf("error while creating webhook. err=%v", err)
-				}
+			case r.Provider == githubProviderName && stringSliceContains(p.conf.Webhook.Organizations, repo.Owner):
+				log.Printf("not creating a webhook for %s, the organization webhook covers it", repo.FullName)
 
 			default:
-				log.Printf("webhook already exists for %d, %s", id, *repo.FullName)
+				// A webhook failure must not prevent the repository from being mirrored by polling.
+				if err := pr.AddHook(r); err != nil {
+					log.Printf("error while adding webhook for %s. err=%v", repo.FullName, err)
+					r.HookError = err.Error()
+				}
 			}
 
-			r.HookID = int64(hookID)
-
 			if err := p.rs.Add(r); err != nil {
-				return 0, 0, fmt.Errorf("error while adding repository to the datastore. err=%v", err)
+				return 0, fmt.Errorf("error while adding repository to the datastore. err=%v", err)
 			}
 
 		default:
 			r, err = p.rs.GetByID(id)
 			if err != nil {
-				return 0, 0, fmt.Errorf("error while getting repository from the datastore. err=%v", err)
+				return 0, fmt.Errorf("error while getting repository from the datastore. err=%v", err)
+			}
+
+			if _, account := repositoryProvider(pr); r.Account != account {
+				log.Printf("ignoring repository %s, it is mirrored with another account", repo.FullName)
+				continue
+			}
+
+			r.Owner = repo.Owner
+
+			if r.Private != repo.Private {
+				if err := p.rs.SetPrivate(id, repo.Private); err != nil {
+					return 0, fmt.Errorf("error while setting repository visibility in the datastore. err=%v", err)
+				}
+				r.Private = repo.Private
 			}
 		}
 
-		log.Printf("updating repo %d, %s", r.ID, *repo.FullName)
+		log.Printf("updating repo %d, %s", r.ID, repo.FullName)
 
-		if err := UpdateRepository(r); err != nil {
-			log.Printf("error while updating repository %d, %s. err=%v", r.ID, *repo.FullName, err)
+		if err := syncRepository(p.rs, p.ss, r); err != nil {
+			log.Printf("error while updating repository %d, %s. err=%v", r.ID, repo.FullName, err)
 			continue
 		}
 
 		count++
 
-		log.Printf("repo %d, %s updated", r.ID, *repo.FullName)
+		log.Printf("repo %d, %s updated", r.ID, repo.FullName)
+
+		schedulePush(p.ps, r)
+
+		// The metadata and the releases are only backed up from GitHub, with the account the repository is mirrored with.
+		if r.Provider == githubProviderName && p.conf.Metadata.Enabled {
+			if err := backupMetadata(accountClient(p.providers, r), p.ms, repo.Owner, r); err != nil {
+				log.Printf("error while backing up metadata of repository %d, %s. err=%v", r.ID, repo.FullName, err)
+			}
+		}
+
+		if r.Provider == githubProviderName && p.conf.Releases.Enabled {
+			if err := backupReleases(accountClient(p.providers, r), p.rls, repo.Owner, r); err != nil {
+				log.Printf("error while backing up releases of repository %d, %s. err=%v", r.ID, repo.FullName, err)
+			}
+		}
+
+		if repo.HasWiki {
+			log.Printf("updating wiki of repo %d, %s", r.ID, repo.FullName)
+
+			// GitHub only creates the wiki repository with the first page, so this can fail and that's fine.
+			if err := updateWiki(p.ws, r); err != nil {
+				log.Printf("error while updating wiki of repository %d, %s. err=%v", r.ID, repo.FullName, err)
+			}
+		}
 	}
 
-	return count, nextPage, nil
+	return count, nil
 }
 
-func (p *poller) webHookExist(owner, repo string) (bool, int, error) {
-	hooks, _, err := p.gh.Repositories.ListHooks(owner, repo, nil)
+func webHookExist(gh *github.Client, owner, repo, endpoint string) (bool, int, error) {
+	hooks, _, err := gh.Repositories.ListHooks(owner, repo, nil)
 	if err != nil {
 		return false, 0, err
 	}
@@ -218,7 +310,7 @@ func (p *poller) webHookExist(owner, repo string) (bool, int, error) {
 			continue
 		}
 
-		if v2 == conf.Webhook.Endpoint {
+		if v2 == endpoint {
 			exist = true
 			id = *hook.ID
 		}
@@ -227,22 +319,8 @@ func (p *poller) webHookExist(owner, repo string) (bool, int, error) {
 	return exist, id, nil
 }
 
-func (p *poller) createWebHook(owner, repo string, gh *github.Client) (int, error) {
-	name := "web"
-	active := true
-
-	hook := &github.Hook{
-		Name:   &name,
-		Events: []string{"push"},
-		Config: map[string]interface{}{
-			"url":          conf.Webhook.Endpoint,
-			"content_type": "json",
-			"secret":       conf.Secret,
-		},
-		Active: &active,
-	}
-
-	hook, _, err := gh.Repositories.CreateHook(owner, repo, hook)
+func createWebHook(gh *github.Client, owner, repo string, t hookTarget) (int, error) {
+	hook, _, err := gh.Repositories.CreateHook(owner, repo, desiredHook(t))
 	if err != nil {
 		return -1, err
 	}
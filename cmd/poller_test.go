@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+// testProvider lists local repositories, and fails to add the webhook of those in hookErrors.
+type testProvider struct {
+	repos      []*remoteRepository
+	hookErrors map[string]error
+}
+
+func (p *testProvider) Name() string      { return "test" }
+func (p *testProvider) CloneHost() string { return "file" }
+
+func (p *testProvider) ListRepositories() ([]*remoteRepository, error) { return p.repos, nil }
+
+func (p *testProvider) AddHook(r *internal.Repository) error {
+	if err := p.hookErrors[r.Name]; err != nil {
+		return err
+	}
+
+	r.HookID = 1
+	return nil
+}
+
+func (p *testProvider) Delivery(r *http.Request) (string, string) { return "", "" }
+func (p *testProvider) VerifySignature(r *http.Request) bool      { return false }
+func (p *testProvider) ParseEvent(string, []byte) (string, *hookBody, error) {
+	return "", nil, errors.New("unsupported")
+}
+
+type testOwnerBlacklistStore struct {
+	datastore.OwnerBlacklist
+}
+
+func (s *testOwnerBlacklistStore) IsBlacklisted(name string) (bool, error) { return false, nil }
+
+type testRepositoryBlacklistStore struct {
+	datastore.RepositoryBlacklist
+}
+
+func (s *testRepositoryBlacklistStore) IsBlacklisted(organization, name string) (bool, error) {
+	return false, nil
+}
+
+func TestUpdateProviderRepositoriesHookError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldConf := conf
+	defer func() { conf = oldConf }()
+
+	conf.RepositoriesPath = filepath.Join(dir, "repositories")
+
+	pr := &testProvider{hookErrors: map[string]error{"b": errors.New("403 Must have admin rights to Repository.")}}
+	for i, name := range []string{"a", "b", "c"} {
+		upstream := filepath.Join(dir, "upstream", name)
+		testGit(t, dir, "init", "-q", upstream)
+		testCommitFile(t, upstream, "README", name+"\n")
+
+		pr.repos = append(pr.repos, &remoteRepository{
+			ID:       int64(i + 1),
+			Owner:    "foo",
+			Name:     name,
+			FullName: "foo/" + name,
+			CloneURL: "file://" + upstream,
+		})
+	}
+
+	rs := &testRepositoryStore{}
+	ss := &testSyncStore{}
+	p := &poller{
+		conf: &conf,
+		rs:   rs,
+		obs:  &testOwnerBlacklistStore{},
+		rbs:  &testRepositoryBlacklistStore{},
+		ss:   ss,
+	}
+
+	count, err := p.updateProviderRepositories(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 3 {
+		t.Errorf("expected the 3 repositories to be updated, got %d", count)
+	}
+
+	repos, _ := rs.GetAll()
+	if len(repos) != 3 {
+		t.Fatalf("expected 3 repositories in the datastore, got %d", len(repos))
+	}
+
+	for _, r := range repos {
+		switch {
+		case r.Name == "b" && r.HookError != "403 Must have admin rights to Repository.":
+			t.Errorf("expected the hook error of b to be recorded, got %q", r.HookError)
+		case r.Name != "b" && (r.HookError != "" || r.HookID != 1):
+			t.Errorf("expected the hook of %s to be added, got ID %d and error %q", r.Name, r.HookID, r.HookError)
+		}
+
+		if _, err := os.Stat(filepath.Join(r.LocalPath, "README")); err != nil {
+			t.Errorf("expected %s to be cloned. err=%v", r.Name, err)
+		}
+	}
+
+	if len(ss.syncs) != 3 {
+		t.Errorf("expected 3 syncs, got %d", len(ss.syncs))
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+// githubProviderName is the name of the GitHub provider, which is always there.
+const githubProviderName = "github"
+
+// Provider is a forge the repositories are mirrored from.
+//
+// The webhook events are given to the handler as GitHub events: the providers decode their payloads into a
+// hookBody, and name the events with the name of the GitHub event with the same meaning.
+type Provider interface {
+	// Name identifies the provider in its webhook route and in the repository rows.
+	Name() string
+	// CloneHost is the host the clone URLs of its repositories must point to.
+	CloneHost() string
+
+	// ListRepositories returns the repositories the account can see.
+	ListRepositories() ([]*remoteRepository, error)
+	// AddHook finds or creates the webhook of a repository, and sets its ID in r.
+	AddHook(r *internal.Repository) error
+
+	// Delivery returns the ID and the event of a webhook delivery, from its headers.
+	Delivery(r *http.Request) (id, event string)
+	// VerifySignature checks that a webhook delivery was sent by the provider.
+	VerifySignature(r *http.Request) bool
+	// ParseEvent decodes a webhook delivery. The events we don't handle are prefixed with the provider name,
+	// so that they can't be mistaken for a GitHub event.
+	ParseEvent(event string, body []byte) (string, *hookBody, error)
+}
+
+// remoteRepository is a repository as listed by a provider.
+type remoteRepository struct {
+	ID       int64
+	Owner    string
+	Name     string
+	FullName string
+	CloneURL string
+	SSHURL   string
+	Private  bool
+	HasWiki  bool
+}
+
+// newProviders returns GitHub with the default account, followed by the other GitHub accounts and the configured
+// providers.
+func newProviders(conf *config.Config, gh *github.Client) ([]Provider, error) {
+	providers := []Provider{&githubProvider{gh: gh}}
+
+	if ghApp != nil && len(conf.Accounts) > 0 {
+		return nil, errors.New("ACCOUNTS can't be used with a GitHub App")
+	}
+
+	seen := map[string]bool{githubProviderName: true}
+	for i := range conf.Accounts {
+		a := &conf.Accounts[i]
+
+		// The name is the user of the clone URLs, see accountCloneURL.
+		if !validPathElement(a.Name) || url.QueryEscape(a.Name) != a.Name || seen[a.Name] {
+			return nil, fmt.Errorf("invalid or duplicate account name %q", a.Name)
+		}
+		seen[a.Name] = true
+
+		// The deliveries of the account are checked with its own secret, so an empty one would accept any.
+		if a.Secret == "" {
+			return nil, fmt.Errorf("the webhook secret of account %s is required", a.Name)
+		}
+
+		if a.RepositoriesPath == "" {
+			a.RepositoriesPath = a.Name
+		}
+
+		root := filepath.Clean(a.RepositoriesPath)
+		if filepath.IsAbs(root) || root == "." || root == ".." || strings.HasPrefix(root, "../") {
+			return nil, fmt.Errorf("repositories path %q of account %s is not a directory in REPOSITORIES_PATH", a.RepositoriesPath, a.Name)
+		}
+		a.RepositoriesPath = root
+
+		client, err := newGitHubTokenClient(conf, a.Token)
+		if err != nil {
+			return nil, err
+		}
+
+		providers = append(providers, &githubProvider{gh: client, account: a})
+	}
+
+	for i := range conf.Providers {
+		c := &conf.Providers[i]
+
+		if !validPathElement(c.Name) || seen[c.Name] {
+			return nil, fmt.Errorf("invalid or duplicate provider name %q", c.Name)
+		}
+		seen[c.Name] = true
+
+		if _, err := parseAPIURL(c.URL); err != nil {
+			return nil, fmt.Errorf("invalid URL for provider %s. err=%v", c.Name, err)
+		}
+
+		// An empty secret would make every webhook delivery valid, GitLab only compares it to a header.
+		if c.Secret == "" {
+			return nil, fmt.Errorf("the webhook secret of provider %s is required", c.Name)
+		}
+
+		switch c.Type {
+		case config.ProviderGitea:
+			providers = append(providers, newGiteaProvider(c))
+		case config.ProviderGitLab:
+			providers = append(providers, newGitLabProvider(c))
+		default:
+			return nil, fmt.Errorf("invalid type %q for provider %s", c.Type, c.Name)
+		}
+	}
+
+	return providers, nil
+}
+
+// findProvider returns the provider with this name, or nil.
+func findProvider(providers []Provider, name string) Provider {
+	for _, pr := range providers {
+		if pr.Name() == name {
+			return pr
+		}
+	}
+
+	return nil
+}
+
+// repositoryProvider returns the provider and the account recorded in the rows of the repositories of a provider.
+// Every GitHub account records github as the provider, and its name as the account.
+func repositoryProvider(pr Provider) (string, string) {
+	g, ok := pr.(*githubProvider)
+	switch {
+	case ok && g.account != nil:
+		return githubProviderName, g.account.Name
+	case ok:
+		return githubProviderName, ""
+	default:
+		return pr.Name(), ""
+	}
+}
+
+// ownerKey returns the name an owner of a provider is blacklisted and given a hook policy under: the owner itself
+// on GitHub, whatever the account, and <provider>/<owner> elsewhere, like the directory of its repositories.
+func ownerKey(provider, owner string) string {
+	if provider == "" || provider == githubProviderName {
+		return owner
+	}
+
+	return provider + "/" + owner
+}
+
+// repositoryID returns the ID under which a repository of a provider is stored.
+//
+// The GitHub repositories keep their GitHub ID, whatever the account. The others get a negative ID made of a hash
+// of the provider name and of their ID on the provider, so that they never collide with each other.
+func repositoryID(pr Provider, remoteID int64) (int64, error) {
+	provider, _ := repositoryProvider(pr)
+	if provider == githubProviderName {
+		return remoteID, nil
+	}
+
+	if remoteID <= 0 || remoteID >= 1<<32 {
+		return 0, fmt.Errorf("repository ID %d of provider %s is out of range", remoteID, provider)
+	}
+
+	h := fnv.New32a()
+	io.WriteString(h, provider)
+	ns := int64(h.Sum32() & 0x7fffffff)
+
+	return -(ns<<32 | remoteID), nil
+}
+
+// repositoryPath returns the path of the local copy of a repository. The GitHub repositories of the default
+// account are at the root of RepositoriesPath, those of the other accounts in their repositories path, and the
+// others in the directory of their provider.
+func repositoryPath(pr Provider, fullName string) string {
+	g, ok := pr.(*githubProvider)
+	switch {
+	case ok && g.account != nil:
+		return filepath.Join(conf.RepositoriesPath, g.account.RepositoriesPath, fullName)
+	case ok:
+		return filepath.Join(conf.RepositoriesPath, fullName)
+	default:
+		return filepath.Join(conf.RepositoriesPath, pr.Name(), fullName)
+	}
+}
+
+// accountClient returns the client of the GitHub account a repository is mirrored with, or the client of the
+// default account if its account isn't configured anymore.
+func accountClient(providers []Provider, r *internal.Repository) *github.Client {
+	if r.Account != "" {
+		if g, ok := findProvider(providers, r.Account).(*githubProvider); ok {
+			return g.gh
+		}
+	}
+
+	return providers[0].(*githubProvider).gh
+}
+
+// accountCloneURL adds the name of an account as the user of an HTTPS clone URL. gitCredentials gives git the
+// token of the account for the URLs with this user, so that a repository is always fetched with the credentials
+// of the account it's mirrored with.
+func accountCloneURL(account, cloneURL string) string {
+	u, err := url.Parse(cloneURL)
+	if err != nil || u.Scheme != "https" {
+		return cloneURL
+	}
+
+	u.User = url.User(account)
+
+	return u.String()
+}
+
+// providerHookURL returns the URL the webhooks of a provider send the events to.
+func providerHookURL(provider string) string {
+	return strings.TrimSuffix(conf.Webhook.Endpoint, "/") + "/" + provider
+}
+
+// splitFullName splits an owner/name full name on its last /, as a GitLab owner can be a group with subgroups.
+func splitFullName(fullName string) (string, string) {
+	i := strings.LastIndex(fullName, "/")
+	if i < 0 {
+		return "", fullName
+	}
+
+	return fullName[:i], fullName[i+1:]
+}
+
+// providerHTTPClient is used to call the APIs of the Gitea and GitLab providers.
+var providerHTTPClient = &http.Client{Timeout: time.Minute}
+
+// doJSON sends a request to the API of a provider with client, with in encoded as JSON if it isn't nil, and
+// decodes the response into out if it isn't nil.
+func doJSON(client *http.Client, method, url string, header http.Header, in, out interface{}) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp, fmt.Errorf("%s %s returned %s: %s", method, req.URL.Path, resp.Status, msg)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, fmt.Errorf("error while decoding json. err=%v", err)
+		}
+	}
+
+	return resp, nil
+}
+
+// githubProvider mirrors the repositories of a GitHub account: the default one, authenticated with the personal
+// access token or the GitHub App, or one of the other accounts, named after it.
+//
+// The organization webhooks, the webhooks reconciliation, the metadata and releases backups and the gists only
+// exist for GitHub, and use the client directly. The organization webhooks and the gists only use the default
+// account.
+type githubProvider struct {
+	gh *github.Client
+	// account is nil for the default account.
+	account *config.Account
+}
+
+func (g *githubProvider) Name() string {
+	if g.account != nil {
+		return g.account.Name
+	}
+
+	return githubProviderName
+}
+
+func (g *githubProvider) CloneHost() string { return cloneHost(&conf.Github) }
+
+// hookTarget returns where the webhooks of the account send the events. Those of the default account use /hook,
+// for the webhooks created before there were accounts.
+func (g *githubProvider) hookTarget() hookTarget {
+	if g.account != nil {
+		return hookTarget{endpoint: providerHookURL(g.account.Name), secret: g.account.Secret}
+	}
+
+	return defaultHookTarget()
+}
+
+// mirrors tells whether the repositories of an owner are mirrored with the account.
+func (g *githubProvider) mirrors(owner string) bool {
+	return g.account == nil || len(g.account.Owners) == 0 || stringSliceContains(g.account.Owners, owner)
+}
+
+// cloneURL returns the URL the repository with this HTTPS clone URL is cloned from. The repositories of the
+// default account are cloned from it, the others from it with the credentials of their account.
+func (g *githubProvider) cloneURL(cloneURL string) string {
+	if g.account == nil {
+		return cloneURL
+	}
+
+	return accountCloneURL(g.account.Name, cloneURL)
+}
+
+// ListRepositories returns the repositories of the authenticated user or, with a GitHub App, the repositories
+// its installations can access. The repositories of the other accounts are filtered by owner, and always cloned
+// over HTTPS with the token of the account.
+func (g *githubProvider) ListRepositories() ([]*remoteRepository, error) {
+	if ghApp != nil {
+		repos, err := ghApp.repositories()
+		if err != nil {
+			return nil, err
+		}
+
+		res := make([]*remoteRepository, len(repos))
+		for i := range repos {
+			res[i] = newGitHubRemoteRepository(&repos[i])
+
+			// The installation tokens can't be used over SSH, the private repositories are cloned over HTTPS too.
+			res[i].SSHURL = res[i].CloneURL
+		}
+
+		return res, nil
+	}
+
+	var res []*remoteRepository
+
+	for page := 0; ; {
+		var opts github.RepositoryListOptions
+		opts.ListOptions.Page = page
+
+		repos, resp, err := g.gh.Repositories.List("", &opts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get user repositories. err=%v", err)
+		}
+
+		log.Printf("got %d repositories of %s for page %d, %d API calls remaining", len(repos), g.Name(), page, resp.Remaining)
+
+		for i := range repos {
+			repo := newGitHubRemoteRepository(&repos[i])
+			if !g.mirrors(repo.Owner) {
+				continue
+			}
+
+			if g.account != nil {
+				repo.CloneURL = g.cloneURL(repo.CloneURL)
+				repo.SSHURL = repo.CloneURL
+			}
+
+			res = append(res, repo)
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		page = resp.NextPage
+	}
+
+	return res, nil
+}
+
+func newGitHubRemoteRepository(repo *github.Repository) *remoteRepository {
+	return &remoteRepository{
+		ID:       int64(*repo.ID),
+		Owner:    *repo.Owner.Login,
+		Name:     *repo.Name,
+		FullName: *repo.FullName,
+		CloneURL: *repo.CloneURL,
+		SSHURL:   *repo.SSHURL,
+		Private:  repo.Private != nil && *repo.Private,
+		HasWiki:  repo.HasWiki != nil && *repo.HasWiki,
+	}
+}
+
+func (g *githubProvider) AddHook(r *internal.Repository) error {
+	fullName := r.Owner + "/" + r.Name
+
+	log.Printf("check the webhook exist for %s", fullName)
+
+	t := g.hookTarget()
+
+	ok, hookID, err := webHookExist(g.gh, r.Owner, r.Name, t.endpoint)
+	if err != nil {
+		return fmt.Errorf("error while checking the webhook exist. err=%v", err)
+	}
+
+	switch {
+	case !ok:
+		log.Printf("webhook does not exists for %d, %s", r.ID, fullName)
+		log.Printf("creating webhook for repository %d, %s", r.ID, fullName)
+
+		hookID, err = createWebHook(g.gh, r.Owner, r.Name, t)
+		if err != nil {
+			return fmt.Errorf("error while creating webhook. err=%v", err)
+		}
+
+	default:
+		log.Printf("webhook already exists for %d, %s", r.ID, fullName)
+	}
+
+	r.HookID = int64(hookID)
+	r.HookFingerprint = hookFingerprint(t)
+
+	return nil
+}
+
+func (g *githubProvider) Delivery(r *http.Request) (string, string) {
+	return r.Header.Get("X-GitHub-Delivery"), r.Header.Get("X-GitHub-Event")
+}
+
+func (g *githubProvider) VerifySignature(r *http.Request) bool {
+	return validSignature(r, g.hookTarget().secret)
+}
+
+func (g *githubProvider) ParseEvent(event string, body []byte) (string, *hookBody, error) {
+	var hb hookBody
+	if err := json.Unmarshal(body, &hb); err != nil {
+		return "", nil, fmt.Errorf("error while decoding json. err=%v", err)
+	}
+
+	return event, &hb, nil
+}
+
+var _ Provider = (*githubProvider)(nil)
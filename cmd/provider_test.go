@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+func TestRepositoryID(t *testing.T) {
+	gitea := newGiteaProvider(&config.Provider{Name: "gitea", Type: config.ProviderGitea, URL: "https://gitea.example.com"})
+	gitlab := newGitLabProvider(&config.Provider{Name: "gitlab", Type: config.ProviderGitLab, URL: "https://gitlab.example.com"})
+
+	// The GitHub repositories keep their ID, whatever the account.
+	for _, pr := range []Provider{&githubProvider{}, &githubProvider{account: &config.Account{Name: "alice"}}} {
+		id, err := repositoryID(pr, 1234)
+		if err != nil || id != 1234 {
+			t.Errorf("%s: expected 1234, got %d and err=%v", pr.Name(), id, err)
+		}
+	}
+
+	seen := make(map[int64]string)
+	for _, pr := range []Provider{gitea, gitlab} {
+		for _, remoteID := range []int64{1, 1234, 1<<32 - 1} {
+			id, err := repositoryID(pr, remoteID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if id >= 0 {
+				t.Errorf("%s: expected a negative ID for %d, got %d", pr.Name(), remoteID, id)
+			}
+
+			if again, _ := repositoryID(pr, remoteID); again != id {
+				t.Errorf("%s: expected the ID of %d to be stable, got %d and %d", pr.Name(), remoteID, id, again)
+			}
+
+			if other, ok := seen[id]; ok {
+				t.Errorf("%s: ID %d of %d collides with %s", pr.Name(), id, remoteID, other)
+			}
+			seen[id] = pr.Name()
+		}
+
+		for _, remoteID := range []int64{0, -1, 1 << 32} {
+			if _, err := repositoryID(pr, remoteID); err == nil {
+				t.Errorf("%s: expected an error for the out of range ID %d", pr.Name(), remoteID)
+			}
+		}
+	}
+}
+
+func TestOwnerKey(t *testing.T) {
+	testCases := []struct {
+		provider string
+		owner    string
+		exp      string
+	}{
+		{"", "foo", "foo"},
+		{githubProviderName, "foo", "foo"},
+		{"gitlab", "group/subgroup", "gitlab/group/subgroup"},
+	}
+
+	for _, tc := range testCases {
+		if got := ownerKey(tc.provider, tc.owner); got != tc.exp {
+			t.Errorf("%s %s: expected %q, got %q", tc.provider, tc.owner, tc.exp, got)
+		}
+	}
+}
+
+func TestNewProvidersSecret(t *testing.T) {
+	c := &config.Config{
+		Providers: []config.Provider{
+			{Name: "gitea", Type: config.ProviderGitea, URL: "https://gitea.example.com", Secret: "secret"},
+			{Name: "gitlab", Type: config.ProviderGitLab, URL: "https://gitlab.example.com"},
+		},
+	}
+
+	_, err := newProviders(c, nil)
+	if err == nil || !strings.Contains(err.Error(), "secret of provider gitlab") {
+		t.Errorf("expected an error about the secret of gitlab, got %v", err)
+	}
+
+	c.Providers[1].Secret = "secret"
+	c.Accounts = []config.Account{{Name: "alice", Token: "token"}}
+
+	_, err = newProviders(c, nil)
+	if err == nil || !strings.Contains(err.Error(), "secret of account alice") {
+		t.Errorf("expected an error about the secret of alice, got %v", err)
+	}
+
+	c.Accounts[0].Secret = "secret"
+
+	providers, err := newProviders(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 4 {
+		t.Errorf("expected 4 providers, got %d", len(providers))
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+// pushRefspecs push the same refs as git push --mirror would, except that the local copy is a
+// working clone, so the branches are its remote-tracking branches.
+var pushRefspecs = []string{
+	"+refs/remotes/origin/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+	"+refs/ghmirror/*:refs/ghmirror/*",
+}
+
+var (
+	pushesMu sync.Mutex
+	// pushes has an entry for each repository being pushed, by local path. It's true when another push of the
+	// repository was scheduled meanwhile.
+	pushes = make(map[string]bool)
+)
+
+// schedulePush pushes a repository to its push targets in the background, so that a sync never waits for the
+// pushes. A repository is never pushed twice at the same time: when a push is scheduled while one is running,
+// the repository is pushed once more after it, however many pushes were scheduled.
+func schedulePush(ps datastore.PushStatus, r *internal.Repository) {
+	if len(conf.PushTargets) == 0 {
+		return
+	}
+
+	pushesMu.Lock()
+	defer pushesMu.Unlock()
+
+	if _, ok := pushes[r.LocalPath]; ok {
+		pushes[r.LocalPath] = true
+		return
+	}
+	pushes[r.LocalPath] = false
+
+	go func() {
+		for {
+			pushMirrors(ps, r)
+
+			pushesMu.Lock()
+			again := pushes[r.LocalPath]
+			if !again {
+				delete(pushes, r.LocalPath)
+			} else {
+				pushes[r.LocalPath] = false
+			}
+			pushesMu.Unlock()
+
+			if !again {
+				return
+			}
+		}
+	}()
+}
+
+// pushMirrors pushes a repository to each push target whose scope covers it, and records the result.
+func pushMirrors(ps datastore.PushStatus, r *internal.Repository) {
+	for _, target := range conf.PushTargets {
+		if target.Scope != "" && target.Scope != r.Owner && target.Scope != r.Owner+"/"+r.Name {
+			continue
+		}
+
+		status := &internal.PushStatus{
+			RepositoryID: r.ID,
+			Target:       target.Name,
+		}
+
+		status.Attempts, status.Error = pushMirror(&target, r)
+		status.PushedAt = time.Now()
+
+		if status.Error != "" {
+			log.Printf("error while pushing repository %d, %s to %s. err=%v", r.ID, r.LocalPath, target.Name, status.Error)
+		}
+
+		if err := ps.Set(status); err != nil {
+			log.Printf("error while setting push status in the datastore. err=%v", err)
+		}
+	}
+}
+
+// pushMirror pushes a repository to a push target, retrying with a backoff. It returns the number of attempts
+// and the last error, if any. The repository is only locked while it's copied for each attempt, so that it can
+// be synced during the push and while we wait to retry.
+func pushMirror(target *config.PushTarget, r *internal.Repository) (int, string) {
+	remote := strings.NewReplacer("{{owner}}", r.Owner, "{{name}}", r.Name).Replace(target.URLTemplate)
+
+	var env []string
+	if target.SSHKey != "" {
+		env = append(env, "GIT_SSH_COMMAND=ssh -i "+shellQuote(target.SSHKey)+" -o IdentitiesOnly=yes")
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := pushMirrorAttempt(r, remote, env)
+		if err == nil {
+			return attempt, ""
+		}
+
+		if attempt > target.Retries {
+			return attempt, err.Error()
+		}
+
+		time.Sleep(time.Duration(1<<uint(attempt-1)) * time.Second)
+	}
+}
+
+func pushMirrorAttempt(r *internal.Repository, remote string, env []string) error {
+	// The refs are pushed from a copy of the mirror, since refs/remotes/origin/HEAD must be deleted first and
+	// the mirror needs it to know the default branch. The copy is next to the mirror so that its objects are
+	// hard links.
+	tmp, err := ioutil.TempDir(filepath.Dir(r.LocalPath), "."+filepath.Base(r.LocalPath)+".push")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary directory. err=%v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	src := filepath.Join(tmp, "mirror.git")
+
+	unlock := lockRepository(r.LocalPath)
+	err = gitCloneMirror(r.LocalPath, src)
+	unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := deleteOriginHEAD(src); err != nil {
+		return err
+	}
+
+	log.Printf("git push to %s in %s", redactURL(remote), r.LocalPath)
+
+	var buf bytes.Buffer
+
+	args := append([]string{"push", "-q", "--prune", remote}, pushRefspecs...)
+
+	if err := runGitCommandWithEnv(env, nil, &buf, src, args...); err != nil {
+		// Don't leak the credentials of the target in the logs and the datastore.
+		return fmt.Errorf(`running command "git push %s", err=%v`, redactURL(remote), strings.Replace(buf.String(), remote, redactURL(remote), -1))
+	}
+
+	return nil
+}
+
+// shellQuote quotes s as a single word for sh, since GIT_SSH_COMMAND is run by a shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// deleteOriginHEAD deletes refs/remotes/origin/HEAD, which would otherwise be pushed as a HEAD branch by
+// pushRefspecs: git push ignores negative refspecs. It must only be deleted in a copy of a mirror, where it's
+// a plain ref, since the mirror uses it to know the default branch.
+func deleteOriginHEAD(dir string) error {
+	const ref = "refs/remotes/origin/HEAD"
+
+	refs, err := gitForEachRef(dir, ref)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := refs[ref]; !ok {
+		return nil
+	}
+
+	return gitDeleteRefNoDeref(dir, ref)
+}
+
+// redactURL removes the password from a URL.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+
+	return u.String()
+}
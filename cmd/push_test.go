@@ -0,0 +1,228 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+type testPushStatusStore struct {
+	statuses chan *internal.PushStatus
+}
+
+func (s *testPushStatusStore) Close() error { return nil }
+
+func (s *testPushStatusStore) GetByRepositoryID(id int64) ([]*internal.PushStatus, error) {
+	return nil, nil
+}
+
+func (s *testPushStatusStore) Set(status *internal.PushStatus) error {
+	s.statuses <- status
+	return nil
+}
+
+// testRefs returns the names of the refs of the repository at dir.
+func testRefs(t *testing.T, dir string) []string {
+	var refs []string
+	for _, line := range strings.Split(strings.TrimSpace(testGit(t, dir, "for-each-ref", "--format=%(refname)")), "\n") {
+		if line != "" {
+			refs = append(refs, line)
+		}
+	}
+	sort.Strings(refs)
+
+	return refs
+}
+
+func TestPushMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "hello\n")
+	testGit(t, upstream, "branch", "feature")
+	testGit(t, upstream, "tag", "v1")
+
+	r := &internal.Repository{
+		ID:        1,
+		Owner:     "foo",
+		Name:      "bar",
+		LocalPath: filepath.Join(dir, "mirror"),
+		CloneURL:  "file://" + upstream,
+	}
+
+	if err := UpdateRepository(r); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "targets", "foo", "bar.git")
+	testGit(t, dir, "init", "-q", "--bare", target)
+
+	pushTarget := &config.PushTarget{
+		Name:        "backup",
+		URLTemplate: "file://" + filepath.Join(dir, "targets") + "/{{owner}}/{{name}}.git",
+	}
+
+	attempts, errMsg := pushMirror(pushTarget, r)
+	if errMsg != "" || attempts != 1 {
+		t.Fatalf("expected a successful push at the first attempt, got %d attempts. err=%s", attempts, errMsg)
+	}
+
+	// origin/HEAD must not be pushed as a HEAD branch.
+	expected := []string{"refs/heads/feature", "refs/heads/master", "refs/tags/v1"}
+	if refs := testRefs(t, target); !reflect.DeepEqual(refs, expected) {
+		t.Errorf("expected %v on the target, got %v", expected, refs)
+	}
+
+	// The mirror keeps its origin HEAD, which gives the default branch, and the copy it was pushed from is gone.
+	if head := strings.TrimSpace(testGit(t, r.LocalPath, "symbolic-ref", "refs/remotes/origin/HEAD")); head != "refs/remotes/origin/master" {
+		t.Errorf("expected the mirror to keep refs/remotes/origin/HEAD, got %q", head)
+	}
+
+	if entries, err := ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 3 {
+		t.Errorf("expected only the upstream, the mirror and the targets in %s, got %d entries", dir, len(entries))
+	}
+
+	// An origin HEAD deleted by an older version is set again by the next sync.
+	testGit(t, r.LocalPath, "update-ref", "--no-deref", "-d", "refs/remotes/origin/HEAD")
+	if err := UpdateRepository(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if head := strings.TrimSpace(testGit(t, r.LocalPath, "symbolic-ref", "refs/remotes/origin/HEAD")); head != "refs/remotes/origin/master" {
+		t.Errorf("expected the sync to set refs/remotes/origin/HEAD again, got %q", head)
+	}
+
+	// A branch deleted upstream is deleted on the target.
+	testGit(t, upstream, "branch", "-D", "feature")
+	if err := UpdateRepository(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, errMsg := pushMirror(pushTarget, r); errMsg != "" {
+		t.Fatal(errMsg)
+	}
+
+	expected = []string{"refs/heads/master", "refs/tags/v1"}
+	if refs := testRefs(t, target); !reflect.DeepEqual(refs, expected) {
+		t.Errorf("expected %v on the target, got %v", expected, refs)
+	}
+
+	// The repository isn't locked while waiting to retry.
+	missing := &config.PushTarget{
+		Name:        "missing",
+		URLTemplate: "file://" + filepath.Join(dir, "missing", "{{name}}.git"),
+		Retries:     1,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		attempts, errMsg := pushMirror(missing, r)
+		if attempts != 2 || errMsg == "" {
+			t.Errorf("expected 2 failed attempts, got %d. err=%s", attempts, errMsg)
+		}
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+
+	locked := make(chan struct{})
+	go func() {
+		lockRepository(r.LocalPath)()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(500 * time.Millisecond):
+		t.Error("the repository is locked while waiting to retry the push")
+	}
+
+	<-done
+}
+
+func TestSchedulePush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "hello\n")
+
+	r := &internal.Repository{ID: 1, Owner: "foo", Name: "bar", LocalPath: filepath.Join(dir, "mirror"), CloneURL: "file://" + upstream}
+	if err := UpdateRepository(r); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(dir, "target.git")
+	testGit(t, dir, "init", "-q", "--bare", target)
+
+	oldTargets := conf.PushTargets
+	defer func() { conf.PushTargets = oldTargets }()
+	conf.PushTargets = []config.PushTarget{
+		{Name: "backup", URLTemplate: "file://" + target},
+		{Name: "other", URLTemplate: "file://" + target, Scope: "other"},
+	}
+
+	ps := &testPushStatusStore{statuses: make(chan *internal.PushStatus, 10)}
+
+	// Holding the lock makes the three pushes scheduled meanwhile coalesce into the running one and one more.
+	unlock := lockRepository(r.LocalPath)
+	for i := 0; i < 3; i++ {
+		schedulePush(ps, r)
+	}
+	unlock()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case status := <-ps.statuses:
+			if status.Target != "backup" || status.Error != "" {
+				t.Errorf("unexpected push status %+v", status)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout while waiting for the push")
+		}
+	}
+
+	select {
+	case status := <-ps.statuses:
+		t.Errorf("unexpected push %+v", status)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if refs := testRefs(t, target); !reflect.DeepEqual(refs, []string{"refs/heads/master"}) {
+		t.Errorf("unexpected refs on the target %v", refs)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, s := range []string{"/keys/id_rsa", "/my keys/id_rsa", "/keys/it's", "$(touch /tmp/pwned)", ""} {
+		out, err := exec.Command("sh", "-c", "printf %s "+shellQuote(s)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(out) != s {
+			t.Errorf("expected %q, got %q", s, out)
+		}
+	}
+}
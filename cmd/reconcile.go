@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+// reconcileWebHooks makes sure every mirrored repository has a webhook configured the way we want,
+// and that the repositories we don't mirror anymore don't have one of ours. Each GitHub account reconciles the
+// webhooks of the repositories mirrored with it.
+func (p *poller) reconcileWebHooks() {
+	p.reconcileOrganizationWebHooks()
+
+	for _, pr := range p.providers {
+		g, ok := pr.(*githubProvider)
+		if !ok {
+			continue
+		}
+
+		repos, err := g.ListRepositories()
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+
+		count := 0
+		for _, repo := range repos {
+			if err := p.reconcileWebHook(g, repo); err != nil {
+				log.Printf("error while reconciling webhook of %s. err=%v", repo.FullName, err)
+				continue
+			}
+
+			count++
+		}
+
+		log.Printf("%d webhooks of %s reconciled", count, g.Name())
+	}
+}
+
+// reconcileOrganizationWebHooks makes sure every organization of Webhook.Organizations has our webhook.
+func (p *poller) reconcileOrganizationWebHooks() {
+	for _, org := range p.conf.Webhook.Organizations {
+		if hookPolicy(org) == config.HookPolicyNone {
+			continue
+		}
+
+		if err := p.reconcileOrganizationWebHook(org); err != nil {
+			log.Printf("error while reconciling webhook of organization %s. err=%v", org, err)
+		}
+	}
+}
+
+func (p *poller) reconcileWebHook(g *githubProvider, repo *remoteRepository) error {
+	id := repo.ID
+	owner := repo.Owner
+
+	policy := hookPolicy(owner)
+	if policy == config.HookPolicyNone {
+		return nil
+	}
+
+	r, err := p.rs.GetByID(id)
+	if err != nil {
+		return fmt.Errorf("error while getting repository from the datastore. err=%v", err)
+	}
+
+	// Another account mirrors it and reconciles its webhook.
+	if r != nil {
+		if _, account := repositoryProvider(g); r.Account != account {
+			return nil
+		}
+	}
+
+	blacklisted, err := p.obs.IsBlacklisted(owner)
+	if err != nil {
+		return fmt.Errorf("error while checking for blacklisted owners in the datastore. err=%v", err)
+	}
+
+	if !blacklisted {
+		blacklisted, err = p.rbs.IsBlacklisted(owner, repo.Name)
+		if err != nil {
+			return fmt.Errorf("error while checking for blacklisted repositories in the datastore. err=%v", err)
+		}
+	}
+
+	switch {
+	case policy == config.HookPolicyCreateIfMissing && (r == nil || blacklisted):
+		return nil
+
+	case r == nil:
+		return p.removeWebHooks(g, owner, repo.Name, 0)
+
+	case blacklisted:
+		if err := p.removeWebHooks(g, owner, repo.Name, int(r.HookID)); err != nil {
+			return err
+		}
+
+		return p.rs.SetHook(r.ID, 0, "")
+
+	case stringSliceContains(p.conf.Webhook.Organizations, owner):
+		if policy == config.HookPolicyCreateIfMissing {
+			return nil
+		}
+
+		// The organization webhook already sends us the events, a repository hook would duplicate them.
+		if err := p.removeWebHooks(g, owner, repo.Name, int(r.HookID)); err != nil {
+			return err
+		}
+
+		if r.HookID == 0 {
+			return nil
+		}
+
+		return p.rs.SetHook(r.ID, 0, "")
+	}
+
+	// Repositories added before we stored the owner don't have it.
+	r.Owner = owner
+
+	err = p.ensureWebHook(g, r, repo.FullName, policy)
+
+	// Record the failure against the repository so that one failing hook doesn't go unnoticed.
+	var hookErr string
+	if err != nil {
+		hookErr = err.Error()
+	}
+
+	if hookErr != r.HookError {
+		if err := p.rs.SetHookError(r.ID, hookErr); err != nil {
+			log.Printf("error while setting the hook error of %s. err=%v", repo.FullName, err)
+		}
+	}
+
+	return err
+}
+
+// ensureWebHook creates the webhook of a mirrored repository if it's missing and, depending on the policy, updates it.
+func (p *poller) ensureWebHook(g *githubProvider, r *internal.Repository, fullName string, policy config.HookPolicy) error {
+	var (
+		hook *github.Hook
+		err  error
+	)
+
+	if r.HookID > 0 {
+		var resp *github.Response
+
+		hook, resp, err = g.gh.Repositories.GetHook(r.Owner, r.Name, int(r.HookID))
+		switch {
+		case resp != nil && resp.StatusCode == http.StatusNotFound:
+			log.Printf("webhook %d of %s does not exist anymore", r.HookID, fullName)
+			hook = nil
+		case err != nil:
+			return fmt.Errorf("error while getting webhook %d. err=%v", r.HookID, err)
+		}
+	}
+
+	t := g.hookTarget()
+	fingerprint := hookFingerprint(t)
+
+	switch {
+	case hook == nil:
+		ok, hookID, err := webHookExist(g.gh, r.Owner, r.Name, t.endpoint)
+		if err != nil {
+			return fmt.Errorf("error while checking the webhook exist. err=%v", err)
+		}
+
+		if !ok {
+			log.Printf("creating webhook for repository %d, %s", r.ID, fullName)
+
+			hookID, err = createWebHook(g.gh, r.Owner, r.Name, t)
+			if err != nil {
+				return fmt.Errorf("error while creating webhook. err=%v", err)
+			}
+
+			return p.rs.SetHook(r.ID, int64(hookID), fingerprint)
+		}
+
+		if policy == config.HookPolicyCreateIfMissing {
+			return p.rs.SetHook(r.ID, int64(hookID), "")
+		}
+
+		// We can't know the secret of a hook we find by its URL, so update it anyway.
+		hook, _, err = g.gh.Repositories.GetHook(r.Owner, r.Name, hookID)
+		if err != nil {
+			return fmt.Errorf("error while getting webhook %d. err=%v", hookID, err)
+		}
+
+	case policy == config.HookPolicyCreateIfMissing:
+		return nil
+
+	case hookUpToDate(hook, t) && r.HookFingerprint == fingerprint:
+		return nil
+	}
+
+	log.Printf("updating webhook %d of repository %d, %s", *hook.ID, r.ID, fullName)
+
+	if _, _, err := g.gh.Repositories.EditHook(r.Owner, r.Name, *hook.ID, desiredHook(t)); err != nil {
+		return fmt.Errorf("error while updating webhook %d. err=%v", *hook.ID, err)
+	}
+
+	return p.rs.SetHook(r.ID, int64(*hook.ID), fingerprint)
+}
+
+// removeWebHooks deletes the hooks pointing to our endpoint, and the hook we stored if there is one.
+func (p *poller) removeWebHooks(g *githubProvider, owner, repo string, storedID int) error {
+	hooks, _, err := g.gh.Repositories.ListHooks(owner, repo, nil)
+	if err != nil {
+		return fmt.Errorf("error while listing webhooks. err=%v", err)
+	}
+
+	endpoint := g.hookTarget().endpoint
+
+	for _, hook := range hooks {
+		if *hook.ID != storedID && hookConfigString(&hook, "url") != endpoint {
+			continue
+		}
+
+		log.Printf("removing webhook %d from %s/%s", *hook.ID, owner, repo)
+
+		if _, err := g.gh.Repositories.DeleteHook(owner, repo, *hook.ID); err != nil {
+			return fmt.Errorf("error while deleting webhook %d. err=%v", *hook.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (p *poller) reconcileOrganizationWebHook(org string) error {
+	stored, err := p.ohs.GetByName(org)
+	if err != nil {
+		return fmt.Errorf("error while getting organization hook from the datastore. err=%v", err)
+	}
+
+	if stored == nil {
+		stored = &internal.OrganizationHook{Name: org}
+	}
+
+	var hook *github.Hook
+	if stored.HookID > 0 {
+		var resp *github.Response
+
+		hook, resp, err = p.gh.Organizations.GetHook(org, int(stored.HookID))
+		switch {
+		case resp != nil && resp.StatusCode == http.StatusNotFound:
+			log.Printf("webhook %d of organization %s does not exist anymore", stored.HookID, org)
+			hook = nil
+		case err != nil:
+			return fmt.Errorf("error while getting webhook %d. err=%v", stored.HookID, err)
+		}
+	}
+
+	t := defaultHookTarget()
+	fingerprint := hookFingerprint(t)
+
+	switch {
+	case hook == nil:
+		hooks, _, err := p.gh.Organizations.ListHooks(org, nil)
+		if err != nil {
+			return fmt.Errorf("error while listing webhooks. err=%v", err)
+		}
+
+		for i := range hooks {
+			if hookConfigString(&hooks[i], "url") == t.endpoint {
+				hook = &hooks[i]
+			}
+		}
+
+		if hook == nil {
+			log.Printf("creating webhook for organization %s", org)
+
+			hook, _, err = p.gh.Organizations.CreateHook(org, desiredHook(t))
+			if err != nil {
+				return fmt.Errorf("error while creating webhook. err=%v", err)
+			}
+
+			stored.HookID = int64(*hook.ID)
+			stored.HookFingerprint = fingerprint
+
+			return p.ohs.Set(stored)
+		}
+
+		if hookPolicy(org) == config.HookPolicyCreateIfMissing {
+			stored.HookID = int64(*hook.ID)
+			return p.ohs.Set(stored)
+		}
+
+		// We can't know the secret of a hook we find by its URL, so update it anyway.
+		stored.HookFingerprint = ""
+
+	case hookPolicy(org) == config.HookPolicyCreateIfMissing:
+		return nil
+
+	case hookUpToDate(hook, t) && stored.HookFingerprint == fingerprint:
+		return nil
+	}
+
+	log.Printf("updating webhook %d of organization %s", *hook.ID, org)
+
+	if _, _, err := p.gh.Organizations.EditHook(org, *hook.ID, desiredHook(t)); err != nil {
+		return fmt.Errorf("error while updating webhook %d. err=%v", *hook.ID, err)
+	}
+
+	stored.HookID = int64(*hook.ID)
+	stored.HookFingerprint = fingerprint
+
+	return p.ohs.Set(stored)
+}
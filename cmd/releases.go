@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+// backupReleases backs up every release of a repository we don't have yet.
+func backupReleases(gh *github.Client, rls datastore.Release, owner string, r *internal.Repository) error {
+	for page := 0; ; {
+		releases, resp, err := gh.Repositories.ListReleases(owner, r.Name, &github.ListOptions{Page: page, PerPage: 100})
+		if err != nil {
+			return fmt.Errorf("unable to get releases. err=%v", err)
+		}
+
+		for i := range releases {
+			if err := backupRelease(gh, rls, owner, r, &releases[i]); err != nil {
+				return err
+			}
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		page = resp.NextPage
+	}
+
+	return nil
+}
+
+// backupRelease records the metadata of a release and downloads the assets we don't have yet.
+//
+// The assets are stored by their SHA256 checksum under the releases directory of the repository backup.
+func backupRelease(gh *github.Client, rls datastore.Release, owner string, r *internal.Repository, release *github.RepositoryRelease) error {
+	dir := filepath.Join(backupDir(r), "releases")
+
+	ok, err := rls.Has(int64(*release.ID))
+	if err != nil {
+		return fmt.Errorf("error while checking for release in the datastore. err=%v", err)
+	}
+
+	if !ok {
+		log.Printf("backing up release %s of %s/%s", *release.TagName, owner, r.Name)
+
+		if err := writeMetadataFile(filepath.Join(dir, strconv.Itoa(*release.ID)+".json"), "release", release); err != nil {
+			return err
+		}
+
+		rel := &internal.Release{
+			ID:           int64(*release.ID),
+			RepositoryID: r.ID,
+			TagName:      *release.TagName,
+		}
+		if release.Name != nil {
+			rel.Name = *release.Name
+		}
+		if release.PublishedAt != nil {
+			rel.PublishedAt = release.PublishedAt.Time
+		}
+
+		if err := rls.Add(rel); err != nil {
+			return fmt.Errorf("error while adding release to the datastore. err=%v", err)
+		}
+	}
+
+	for _, asset := range release.Assets {
+		ok, err := rls.HasAsset(int64(*asset.ID))
+		if err != nil {
+			return fmt.Errorf("error while checking for release asset in the datastore. err=%v", err)
+		}
+
+		if ok {
+			continue
+		}
+
+		log.Printf("downloading asset %s of release %s of %s/%s", *asset.Name, *release.TagName, owner, r.Name)
+
+		sum, size, err := downloadReleaseAsset(gh, owner, r.Name, *asset.ID, filepath.Join(dir, "objects"))
+		if err != nil {
+			return fmt.Errorf("unable to download asset %s of release %s. err=%v", *asset.Name, *release.TagName, err)
+		}
+
+		a := &internal.ReleaseAsset{
+			ID:        int64(*asset.ID),
+			ReleaseID: int64(*release.ID),
+			Name:      *asset.Name,
+			Size:      size,
+			SHA256:    sum,
+		}
+		if asset.ContentType != nil {
+			a.ContentType = *asset.ContentType
+		}
+
+		if err := rls.AddAsset(a); err != nil {
+			return fmt.Errorf("error while adding release asset to the datastore. err=%v", err)
+		}
+	}
+
+	return nil
+}
+
+// downloadReleaseAsset downloads an asset into the content-addressed store at dir and returns its SHA256 checksum and size.
+func downloadReleaseAsset(gh *github.Client, owner, repo string, id int, dir string) (string, int64, error) {
+	rc, redirectURL, err := gh.Repositories.DownloadReleaseAsset(owner, repo, id)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if redirectURL != "" {
+		resp, err := (&http.Client{Transport: githubTransport}).Get(redirectURL)
+		if err != nil {
+			return "", 0, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", 0, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+
+		rc = resp.Body
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", 0, err
+	}
+
+	f, err := ioutil.TempFile(dir, "download")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(f.Name())
+
+	h := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(f, h), rc)
+	if err != nil {
+		f.Close()
+		return "", 0, err
+	}
+
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	path := filepath.Join(dir, sum[:2], sum)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", 0, err
+	}
+
+	return sum, size, os.Rename(f.Name(), path)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// testTokenTransport authenticates the requests like the oauth2 transport of the GitHub clients.
+type testTokenTransport struct{}
+
+func (testTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "token secret")
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestBackupReleases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := map[int]string{10: "tarball", 11: "tarball", 12: "zip", 13: "checksums"}
+
+	var (
+		mu sync.Mutex
+		// downloads are the asset IDs requested from the API, storage the Authorization headers sent to the
+		// storage the API redirects to.
+		downloads []int
+		storage   []string
+	)
+
+	storageSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		storage = append(storage, req.Header.Get("Authorization"))
+		mu.Unlock()
+
+		id, _ := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/assets/"))
+		w.Write([]byte(contents[id]))
+	}))
+	defer storageSrv.Close()
+
+	releases := []github.RepositoryRelease{
+		{ID: github.Int(1), TagName: github.String("v1"), Assets: []github.ReleaseAsset{
+			{ID: github.Int(10), Name: github.String("v1.tar.gz")},
+			{ID: github.Int(11), Name: github.String("v1-copy.tar.gz")},
+		}},
+		{ID: github.Int(2), TagName: github.String("v2"), Assets: []github.ReleaseAsset{
+			{ID: github.Int(12), Name: github.String("v2.zip"), ContentType: github.String("application/zip")},
+		}},
+	}
+
+	apiSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "token secret" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case req.URL.Path == "/repos/foo/bar/releases":
+			mu.Lock()
+			json.NewEncoder(w).Encode(releases)
+			mu.Unlock()
+
+		case strings.HasPrefix(req.URL.Path, "/repos/foo/bar/releases/assets/"):
+			id, _ := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/repos/foo/bar/releases/assets/"))
+
+			mu.Lock()
+			downloads = append(downloads, id)
+			mu.Unlock()
+
+			// GitHub redirects to the storage of the assets, except for some which are served directly.
+			if id == 11 {
+				w.Write([]byte(contents[id]))
+				return
+			}
+			http.Redirect(w, req, storageSrv.URL+"/assets/"+strconv.Itoa(id), http.StatusFound)
+
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer apiSrv.Close()
+
+	gh := github.NewClient(&http.Client{Transport: testTokenTransport{}})
+	gh.BaseURL, _ = url.Parse(apiSrv.URL + "/")
+
+	r := &internal.Repository{ID: 1, Owner: "foo", Name: "bar", LocalPath: filepath.Join(dir, "foo", "bar")}
+	rls := &testReleaseStore{releases: make(map[int64]*internal.Release), assets: make(map[int64]*internal.ReleaseAsset)}
+	releasesDir := filepath.Join(backupDir(r), "releases")
+
+	if err := backupReleases(gh, rls, "foo", r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rls.releases) != 2 || len(rls.assets) != 3 {
+		t.Fatalf("expected 2 releases and 3 assets, got %v and %v", rls.releases, rls.assets)
+	}
+	for _, id := range []int{1, 2} {
+		if _, err := os.Stat(filepath.Join(releasesDir, strconv.Itoa(id)+".json")); err != nil {
+			t.Errorf("expected release %d to be exported. err=%v", id, err)
+		}
+	}
+
+	// The assets are stored once per content, by their SHA256 checksum.
+	for id, content := range contents {
+		a, ok := rls.assets[int64(id)]
+		if !ok {
+			continue
+		}
+
+		sum := sha256.Sum256([]byte(content))
+		exp := hex.EncodeToString(sum[:])
+		if a.SHA256 != exp || a.Size != int64(len(content)) {
+			t.Errorf("asset %d: expected checksum %s and size %d, got %s and %d", id, exp, len(content), a.SHA256, a.Size)
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(releasesDir, "objects", exp[:2], exp))
+		if err != nil || string(data) != content {
+			t.Errorf("asset %d: expected the stored object to be %q, got %q and err=%v", id, content, data, err)
+		}
+	}
+	if rls.assets[12].ContentType != "application/zip" {
+		t.Errorf("expected the content type of asset 12 to be recorded, got %q", rls.assets[12].ContentType)
+	}
+
+	objects, err := filepath.Glob(filepath.Join(releasesDir, "objects", "*", "*"))
+	if err != nil || len(objects) != 2 {
+		t.Errorf("expected 2 objects for the 2 distinct contents, got %v and err=%v", objects, err)
+	}
+
+	// The credentials of the API aren't sent to the storage the downloads are redirected to.
+	for _, authorization := range storage {
+		if authorization != "" {
+			t.Errorf("expected no Authorization header on the redirected download, got %q", authorization)
+		}
+	}
+	if len(storage) != 2 {
+		t.Errorf("expected 2 redirected downloads, got %d", len(storage))
+	}
+
+	// The next backup only downloads the assets of the new release.
+	mu.Lock()
+	downloads = nil
+	releases = append(releases, github.RepositoryRelease{ID: github.Int(3), TagName: github.String("v3"), Assets: []github.ReleaseAsset{
+		{ID: github.Int(13), Name: github.String("SHA256SUMS")},
+	}})
+	mu.Unlock()
+
+	if err := os.Remove(filepath.Join(releasesDir, "1.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := backupReleases(gh, rls, "foo", r); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(downloads) != 1 || downloads[0] != 13 {
+		t.Errorf("expected only asset 13 to be downloaded, got %v", downloads)
+	}
+	if _, ok := rls.releases[3]; !ok {
+		t.Error("expected release 3 to be backed up")
+	}
+	if _, err := os.Stat(filepath.Join(releasesDir, "1.json")); !os.IsNotExist(err) {
+		t.Errorf("expected release 1 to not be exported again, got err=%v", err)
+	}
+}
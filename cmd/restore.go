@@ -0,0 +1,488 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal/encryption"
+	"github.com/vrischmann/ghmirror/internal/storage"
+)
+
+// restoreCommand pushes the refs of a mirror or of a snapshot to a new remote, optionally creating the repository
+// on GitHub and restoring its metadata backup. Without -yes it only shows what it would push.
+func restoreCommand(args []string) error {
+	const usage = "usage: ghmirror restore [-to <remote url>] [-create <owner/name>] [-snapshot <bundle>] [-key <private key>] [-metadata] [-api-url <url>] [-yes] <repository path>"
+
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	flTo := fs.String("to", "", "URL of an existing remote to push to")
+	flCreate := fs.String("create", "", "Create the owner/name repository on GitHub and push to it")
+	flPrivate := fs.Bool("private", true, "Create the repository as private")
+	flSnapshot := fs.String("snapshot", "", "Restore this snapshot bundle, or the snapshot with this key in the storage, instead of the mirror")
+	flKey := fs.String("key", "", "Path of the RSA private key to decrypt the snapshot with, if it was encrypted with a public key")
+	flMetadata := fs.Bool("metadata", false, "Restore the labels, milestones, issues and comments into the created repository")
+	flAPIURL := fs.String("api-url", "", "URL of the GitHub API, instead of GITHUB_BASE_URL")
+	flYes := fs.Bool("yes", false, "Restore instead of only showing what would be restored")
+	positional := parseFlags(fs, args)
+
+	switch {
+	case len(positional) != 1:
+		return errors.New(usage)
+	case *flTo == "" && *flCreate == "":
+		return errors.New("one of -to or -create is required")
+	case *flMetadata && *flCreate == "":
+		return errors.New("-metadata needs the repository to be created with -create")
+	}
+
+	tmp, err := ioutil.TempDir("", "ghmirror-restore")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary directory. err=%v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The refs are pushed from a copy so that the mirror, which the server may be syncing, is left untouched.
+	src := filepath.Join(tmp, "mirror.git")
+
+	var metadata string
+	if *flSnapshot != "" {
+		bundle, err := fetchSnapshotFile(*flSnapshot, filepath.Join(tmp, "snapshot.bundle"), *flKey)
+		if err != nil {
+			return err
+		}
+
+		if err := gitCloneMirror(bundle, src); err != nil {
+			return err
+		}
+
+		if *flMetadata {
+			// The metadata backup as it was when the snapshot was taken.
+			archive, err := fetchSnapshotFile(snapshotBackupPath(*flSnapshot), filepath.Join(tmp, "backup.tar.gz"), *flKey)
+			if err != nil {
+				return err
+			}
+
+			if err := extractArchive(archive, filepath.Join(tmp, "backup")); err != nil {
+				return fmt.Errorf("unable to extract %s. err=%v", archive, err)
+			}
+			metadata = filepath.Join(tmp, "backup", "metadata")
+		}
+	} else {
+		dir, err := localRepositoryPath(positional[0])
+		if err != nil {
+			return err
+		}
+
+		if err := gitCloneMirror(dir, src); err != nil {
+			return err
+		}
+		metadata = filepath.Join(dir+".backup", "metadata")
+	}
+
+	refs, err := gitForEachRef(src, "refs/remotes/origin/", "refs/tags/", "refs/ghmirror/")
+	if err != nil {
+		return err
+	}
+
+	pushed := restoredRefs(refs)
+	if len(pushed) == 0 {
+		return fmt.Errorf("no refs to restore in %s", src)
+	}
+
+	names := make([]string, 0, len(pushed))
+	for ref := range pushed {
+		names = append(names, ref)
+	}
+	sort.Strings(names)
+
+	for _, ref := range names {
+		fmt.Printf("%s %s\n", pushed[ref], ref)
+	}
+
+	if !*flYes {
+		fmt.Printf("%d refs would be pushed, run again with -yes to restore\n", len(pushed))
+		return nil
+	}
+
+	gh, err := newGitHubClient(&conf)
+	if err != nil {
+		return err
+	}
+
+	if *flAPIURL != "" {
+		gh.BaseURL, err = parseAPIURL(*flAPIURL)
+		if err != nil {
+			return fmt.Errorf("invalid API URL. err=%v", err)
+		}
+	}
+
+	remote := *flTo
+
+	var (
+		owner, name string
+		env         []string
+	)
+	if *flCreate != "" {
+		tokens := strings.Split(*flCreate, "/")
+		if len(tokens) != 2 {
+			return fmt.Errorf("invalid repository %q, expected owner/name", *flCreate)
+		}
+		owner, name = tokens[0], tokens[1]
+
+		repo, err := createRepository(gh, owner, name, *flPrivate)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case remote != "":
+		case ghApp != nil:
+			// The app has no SSH key, the push to the new repository uses the installation token.
+			remote = *repo.CloneURL
+			env = gitConfigEnv(remote)
+		default:
+			remote = *repo.SSHURL
+		}
+	}
+
+	log.Printf("pushing %d refs from %s to %s", len(pushed), src, redactURL(remote))
+
+	if err := deleteOriginHEAD(src); err != nil {
+		return err
+	}
+
+	if err := gitPush(env, src, remote, pushRefspecs...); err != nil {
+		return err
+	}
+
+	if *flMetadata {
+		return restoreMetadata(gh, metadata, owner, name)
+	}
+
+	return nil
+}
+
+// fetchSnapshotFile returns the path of a clear copy of a snapshot file, which is either a local file or the key
+// of an object in the storage. The object is downloaded to dst, and the file is decrypted next to dst if needed.
+func fetchSnapshotFile(pathOrKey, dst, keyPath string) (string, error) {
+	path := pathOrKey
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		path = dst
+		if err := fetchSnapshot(pathOrKey, path); err != nil {
+			return "", err
+		}
+	}
+
+	encrypted, err := encryption.IsEncrypted(path)
+	if err != nil {
+		return "", err
+	}
+
+	if !encrypted {
+		return path, nil
+	}
+
+	decrypted := dst + ".decrypted"
+	if err := decryptFile(path, decrypted, keyPath); err != nil {
+		return "", err
+	}
+
+	return decrypted, nil
+}
+
+// fetchSnapshot copies the object at key in the storage to path.
+func fetchSnapshot(key, path string) error {
+	st, err := storage.New(&conf)
+	if err != nil {
+		return fmt.Errorf("unable to create storage. err=%v", err)
+	}
+
+	rc, err := st.Get(key)
+	if err != nil {
+		return fmt.Errorf("unable to get snapshot %s. err=%v", key, err)
+	}
+	defer rc.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to download snapshot %s. err=%v", key, err)
+	}
+
+	return f.Close()
+}
+
+// decryptFile decrypts the file at src into dst with the configured passphrase, or with the private key at
+// keyPath if it's not empty.
+func decryptFile(src, dst, keyPath string) error {
+	var private *rsa.PrivateKey
+	if keyPath != "" {
+		var err error
+		private, err = encryption.LoadPrivateKey(keyPath)
+		if err != nil {
+			return fmt.Errorf("unable to load private key. err=%v", err)
+		}
+	}
+
+	if err := encryption.DecryptFile(src, dst, conf.Encryption.Passphrase, private); err != nil {
+		return fmt.Errorf("unable to decrypt %s. err=%v", src, err)
+	}
+
+	return nil
+}
+
+// restoredRefs returns the refs a push with pushRefspecs creates from the refs of a mirror, with their objects.
+func restoredRefs(refs map[string]string) map[string]string {
+	res := make(map[string]string)
+
+	for ref, object := range refs {
+		switch {
+		case ref == "refs/remotes/origin/HEAD", strings.HasPrefix(ref, "refs/namespaces/"):
+		case strings.HasPrefix(ref, "refs/remotes/origin/"):
+			res["refs/heads/"+strings.TrimPrefix(ref, "refs/remotes/origin/")] = object
+		default:
+			res[ref] = object
+		}
+	}
+
+	return res
+}
+
+// createRepository creates an empty repository on GitHub, owned by the authenticated user or by an organization.
+// A GitHub App can only create repositories in the organizations it's installed on.
+func createRepository(gh *github.Client, owner, name string, private bool) (*github.Repository, error) {
+	org := owner
+	if ghApp == nil {
+		user, _, err := gh.Users.Get("")
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the authenticated user. err=%v", err)
+		}
+
+		if user.Login != nil && *user.Login == owner {
+			org = ""
+		}
+	}
+
+	repo, _, err := gh.Repositories.Create(org, &github.Repository{
+		Name:    github.String(name),
+		Private: github.Bool(private),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create repository %s/%s. err=%v", owner, name, err)
+	}
+
+	log.Printf("created repository %s", *repo.FullName)
+
+	return repo, nil
+}
+
+// restoreMetadata recreates the labels, milestones, issues and issue comments of a metadata backup in a repository.
+//
+// The pull requests can't be recreated without their branches so they're skipped, which means the issues don't
+// keep their number: each issue starts with a note with its original number, author and date.
+func restoreMetadata(gh *github.Client, dir, owner, name string) error {
+	var labels []github.Label
+	if err := readMetadataFile(filepath.Join(dir, "labels.json"), &labels); err != nil {
+		return err
+	}
+
+	for _, label := range labels {
+		_, _, err := gh.Issues.CreateLabel(owner, name, &github.Label{Name: label.Name, Color: label.Color})
+		if err != nil {
+			// New repositories come with default labels.
+			log.Printf("unable to create label %s. err=%v", *label.Name, err)
+		}
+	}
+
+	var milestones []github.Milestone
+	if err := readMetadataFile(filepath.Join(dir, "milestones.json"), &milestones); err != nil {
+		return err
+	}
+
+	milestoneNumbers := make(map[int]int)
+	for _, m := range milestones {
+		created, _, err := gh.Issues.CreateMilestone(owner, name, &github.Milestone{
+			Title:       m.Title,
+			State:       m.State,
+			Description: m.Description,
+			DueOn:       m.DueOn,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create milestone %s. err=%v", *m.Title, err)
+		}
+
+		milestoneNumbers[*m.Number] = *created.Number
+	}
+
+	comments, err := readIssueComments(filepath.Join(dir, "comments"))
+	if err != nil {
+		return err
+	}
+
+	issues, err := readIssues(filepath.Join(dir, "issues"))
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, issue := range issues {
+		if issue.PullRequestLinks != nil {
+			log.Printf("skipping pull request #%d", *issue.Number)
+			continue
+		}
+
+		body := fmt.Sprintf("_Originally #%d by @%s on %s._\n\n", *issue.Number, *issue.User.Login, issue.CreatedAt.Format("2006-01-02"))
+		if issue.Body != nil {
+			body += *issue.Body
+		}
+
+		req := &github.IssueRequest{
+			Title: issue.Title,
+			Body:  &body,
+		}
+
+		labelNames := make([]string, 0, len(issue.Labels))
+		for _, l := range issue.Labels {
+			labelNames = append(labelNames, *l.Name)
+		}
+		req.Labels = &labelNames
+
+		if issue.Milestone != nil {
+			if n, ok := milestoneNumbers[*issue.Milestone.Number]; ok {
+				req.Milestone = &n
+			}
+		}
+
+		created, _, err := gh.Issues.Create(owner, name, req)
+		if err != nil {
+			return fmt.Errorf("unable to create issue from #%d. err=%v", *issue.Number, err)
+		}
+
+		for _, c := range comments[*issue.Number] {
+			body := fmt.Sprintf("_Originally by @%s on %s._\n\n%s", *c.User.Login, c.CreatedAt.Format("2006-01-02"), *c.Body)
+
+			if _, _, err := gh.Issues.CreateComment(owner, name, *created.Number, &github.IssueComment{Body: &body}); err != nil {
+				return fmt.Errorf("unable to create comment %d. err=%v", *c.ID, err)
+			}
+		}
+
+		if issue.State != nil && *issue.State == "closed" {
+			if _, _, err := gh.Issues.Edit(owner, name, *created.Number, &github.IssueRequest{State: issue.State}); err != nil {
+				return fmt.Errorf("unable to close issue #%d. err=%v", *created.Number, err)
+			}
+		}
+
+		count++
+	}
+
+	log.Printf("restored %d issues in %s/%s", count, owner, name)
+
+	return nil
+}
+
+// readMetadataFile decodes the data of a file written by writeMetadataFile into v.
+func readMetadataFile(path string, v interface{}) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read %s. err=%v", path, err)
+	}
+
+	var f struct {
+		Version int             `json:"version"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(buf, &f); err != nil {
+		return fmt.Errorf("unable to decode %s. err=%v", path, err)
+	}
+
+	if f.Version != metadataVersion {
+		return fmt.Errorf("unsupported version %d of %s", f.Version, path)
+	}
+
+	if err := json.Unmarshal(f.Data, v); err != nil {
+		return fmt.Errorf("unable to decode %s. err=%v", path, err)
+	}
+
+	return nil
+}
+
+// readIssues returns the backed up issues, ordered by number.
+func readIssues(dir string) ([]*github.Issue, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*github.Issue
+	for _, file := range files {
+		var issue github.Issue
+		if err := readMetadataFile(file, &issue); err != nil {
+			return nil, err
+		}
+
+		res = append(res, &issue)
+	}
+
+	sort.Sort(byIssueNumber(res))
+
+	return res, nil
+}
+
+type byIssueNumber []*github.Issue
+
+func (b byIssueNumber) Len() int           { return len(b) }
+func (b byIssueNumber) Less(i, j int) bool { return *b[i].Number < *b[j].Number }
+func (b byIssueNumber) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// readIssueComments returns the backed up issue comments by issue number, ordered by creation date.
+func readIssueComments(dir string) (map[int][]*github.IssueComment, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[int][]*github.IssueComment)
+	for _, file := range files {
+		var c github.IssueComment
+		if err := readMetadataFile(file, &c); err != nil {
+			return nil, err
+		}
+
+		if c.IssueURL == nil {
+			continue
+		}
+
+		n, err := strconv.Atoi((*c.IssueURL)[strings.LastIndex(*c.IssueURL, "/")+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid issue URL %q in %s", *c.IssueURL, file)
+		}
+
+		res[n] = append(res[n], &c)
+	}
+
+	for _, comments := range res {
+		sort.Sort(byCommentCreatedAt(comments))
+	}
+
+	return res, nil
+}
+
+type byCommentCreatedAt []*github.IssueComment
+
+func (b byCommentCreatedAt) Len() int           { return len(b) }
+func (b byCommentCreatedAt) Less(i, j int) bool { return b[i].CreatedAt.Before(*b[j].CreatedAt) }
+func (b byCommentCreatedAt) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+	"github.com/vrischmann/ghmirror/internal/encryption"
+	"github.com/vrischmann/ghmirror/internal/storage"
+)
+
+type testSnapshotStore struct {
+	datastore.Snapshot
+	snapshots []*internal.Snapshot
+	err       error
+}
+
+func (s *testSnapshotStore) Add(snapshot *internal.Snapshot) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.snapshots = append(s.snapshots, snapshot)
+	return nil
+}
+
+// testRestoreAPI is a GitHub API stand-in which creates the repositories as local bare repositories and records
+// the metadata created in them.
+type testRestoreAPI struct {
+	dir string
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (a *testRestoreAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Name      string
+		Title     string
+		Body      string
+		State     string
+		Milestone int
+	}
+	json.NewDecoder(req.Body).Decode(&body)
+
+	path := strings.TrimPrefix(req.URL.Path, "/api/v3")
+
+	a.mu.Lock()
+	a.requests = append(a.requests, fmt.Sprintf("%s %s %s%s%s", req.Method, path, body.Name, body.Title, body.State))
+	a.mu.Unlock()
+
+	switch {
+	case req.Method == "GET" && path == "/user":
+		fmt.Fprint(w, `{"login": "foo"}`)
+
+	case req.Method == "POST" && path == "/user/repos":
+		remote := filepath.Join(a.dir, "remotes", body.Name+".git")
+		if err := os.MkdirAll(remote, 0755); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		runGitCommand(nil, ioutil.Discard, remote, "init", "-q", "--bare")
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"full_name": "foo/" + body.Name,
+			"ssh_url":   "file://" + remote,
+			"clone_url": "file://" + remote,
+		})
+
+	case req.Method == "POST" && strings.HasSuffix(path, "/milestones"):
+		fmt.Fprint(w, `{"number": 7}`)
+
+	case req.Method == "POST" && strings.HasSuffix(path, "/issues"):
+		if body.Milestone != 7 {
+			http.Error(w, "unexpected milestone", http.StatusUnprocessableEntity)
+			return
+		}
+		fmt.Fprint(w, `{"number": 1}`)
+
+	default:
+		fmt.Fprint(w, `{}`)
+	}
+}
+
+// testMetadataBackup writes a metadata backup with a label, a milestone and a closed issue with a comment.
+func testMetadataBackup(t *testing.T, r *internal.Repository, title string) {
+	t.Helper()
+
+	dir := filepath.Join(backupDir(r), "metadata")
+	created := time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC)
+	user := &github.User{Login: github.String("alice")}
+
+	files := map[string]interface{}{
+		"labels.json":     []github.Label{{Name: github.String("bug"), Color: github.String("ff0000")}},
+		"milestones.json": []github.Milestone{{Number: github.Int(3), Title: github.String("v1")}},
+		"issues/12.json": &github.Issue{
+			Number:    github.Int(12),
+			Title:     github.String(title),
+			State:     github.String("closed"),
+			User:      user,
+			CreatedAt: &created,
+			Milestone: &github.Milestone{Number: github.Int(3)},
+		},
+		"comments/100.json": &github.IssueComment{
+			ID:        github.Int(100),
+			Body:      github.String("me too"),
+			User:      user,
+			CreatedAt: &created,
+			IssueURL:  github.String("https://api.github.com/repos/foo/bar/issues/12"),
+		},
+	}
+
+	for name, data := range files {
+		if err := writeMetadataFile(filepath.Join(dir, filepath.FromSlash(name)), "test", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRestoreCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	api := &testRestoreAPI{dir: dir}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	oldConf, oldApp := conf, ghApp
+	defer func() { conf, ghApp = oldConf, oldApp }()
+
+	ghApp = nil
+	conf.RepositoriesPath = filepath.Join(dir, "repositories")
+	conf.Snapshots.Path = filepath.Join(dir, "snapshots")
+	conf.Storage.Type = config.StorageLocal
+	conf.Encryption = config.Encryption{Passphrase: "secret"}
+	conf.Github = config.GitHub{BaseURL: srv.URL + "/api/v3/"}
+	conf.PersonalAccessToken = "token"
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "hello\n")
+	testGit(t, upstream, "branch", "feature")
+	testGit(t, upstream, "tag", "v1")
+
+	r := &internal.Repository{
+		ID:        1,
+		Owner:     "foo",
+		Name:      "bar",
+		LocalPath: filepath.Join(conf.RepositoriesPath, "foo", "bar"),
+		CloneURL:  "file://" + upstream,
+	}
+
+	if err := UpdateRepository(r); err != nil {
+		t.Fatal(err)
+	}
+	testMetadataBackup(t, r, "snapshotted issue")
+
+	key, err := encryption.NewKey(&conf.Encryption)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss := &testSnapshotStore{}
+	s := &snapshotter{conf: &conf, ss: ss, st: storage.NewLocalStorage(conf.Snapshots.Path), key: key}
+	if err := s.snapshot(r); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := ss.snapshots[0]
+
+	// After the snapshot the upstream gets a new branch and the live backup a new issue.
+	testGit(t, upstream, "branch", "later")
+	if err := UpdateRepository(r); err != nil {
+		t.Fatal(err)
+	}
+	testMetadataBackup(t, r, "live issue")
+
+	mirrorRefs := testRefs(t, r.LocalPath)
+
+	wantRefs := []string{"refs/heads/feature", "refs/heads/master", "refs/tags/v1"}
+	wantRequests := func(name, title string) []string {
+		return []string{
+			"GET /user ",
+			"POST /user/repos " + name,
+			"POST /repos/foo/" + name + "/labels bug",
+			"POST /repos/foo/" + name + "/milestones v1",
+			"POST /repos/foo/" + name + "/issues " + title,
+			"POST /repos/foo/" + name + "/issues/1/comments ",
+			"PATCH /repos/foo/" + name + "/issues/1 closed",
+		}
+	}
+
+	t.Run("mirror", func(t *testing.T) {
+		api.requests = nil
+
+		// The flags come after the repository.
+		if err := restoreCommand([]string{"foo/bar", "-create", "foo/live", "-metadata", "-yes"}); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"refs/heads/feature", "refs/heads/later", "refs/heads/master", "refs/tags/v1"}
+		if got := testRefs(t, filepath.Join(dir, "remotes", "live.git")); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected remote refs %v, got %v", want, got)
+		}
+
+		if got, want := api.requests, wantRequests("live", "live issue"); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected requests %q, got %q", want, got)
+		}
+	})
+
+	// The snapshot is restored with the metadata backup archived with it, even once the live one is gone.
+	if err := os.RemoveAll(backupDir(r)); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("snapshot", func(t *testing.T) {
+		// By key in the storage, then as a local file.
+		path := filepath.Join(conf.Snapshots.Path, filepath.FromSlash(snapshot.Path))
+		for i, bundle := range []string{snapshot.Path, path} {
+			api.requests = nil
+			name := fmt.Sprintf("snapshot%d", i)
+
+			if err := restoreCommand([]string{"-snapshot", bundle, "foo/bar", "-create", "foo/" + name, "-metadata", "-yes"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := testRefs(t, filepath.Join(dir, "remotes", name+".git")); !reflect.DeepEqual(got, wantRefs) {
+				t.Errorf("expected remote refs %v, got %v", wantRefs, got)
+			}
+
+			if got, want := api.requests, wantRequests(name, "snapshotted issue"); !reflect.DeepEqual(got, want) {
+				t.Errorf("expected requests %q, got %q", want, got)
+			}
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		remote := filepath.Join(dir, "remotes", "dry.git")
+		testGit(t, dir, "init", "-q", "--bare", remote)
+
+		if err := restoreCommand([]string{"foo/bar", "-to", "file://" + remote}); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := testRefs(t, remote); len(got) != 0 {
+			t.Errorf("expected no refs to be pushed without -yes, got %v", got)
+		}
+	})
+
+	// The mirror the refs were pushed from is left as it was.
+	if got := testRefs(t, r.LocalPath); !reflect.DeepEqual(got, mirrorRefs) {
+		t.Errorf("expected the mirror refs to stay %v, got %v", mirrorRefs, got)
+	}
+}
+
+// TestRestoreCommandGitHubApp checks that with a GitHub App the repository created is pushed to over HTTPS with
+// the installation token, since the app has no SSH key.
+func TestRestoreCommandGitHubApp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	git, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clone host serves the remotes with git http-backend, and only takes pushes with the installation token.
+	backend := &cgi.Handler{
+		Path: git,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + filepath.Join(dir, "remotes"),
+			"GIT_HTTP_EXPORT_ALL=1",
+			"REMOTE_USER=x-access-token",
+		},
+	}
+	gitSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != strings.TrimPrefix(basicAuthorization("x-access-token", "installation-token"), "Authorization: ") {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		backend.ServeHTTP(w, req)
+	}))
+	defer gitSrv.Close()
+
+	oldNoVerify, ok := os.LookupEnv("GIT_SSL_NO_VERIFY")
+	os.Setenv("GIT_SSL_NO_VERIFY", "1")
+	defer func() {
+		if ok {
+			os.Setenv("GIT_SSL_NO_VERIFY", oldNoVerify)
+		} else {
+			os.Unsetenv("GIT_SSL_NO_VERIFY")
+		}
+	}()
+
+	var created []string
+	_, _, cleanup := newTestGitHubApp(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/api/v3/orgs/foo/repos" {
+			http.NotFound(w, req)
+			return
+		}
+
+		var body struct{ Name string }
+		json.NewDecoder(req.Body).Decode(&body)
+		created = append(created, body.Name)
+
+		remote := filepath.Join(dir, "remotes", "foo", body.Name+".git")
+		testGit(t, dir, "init", "-q", "--bare", remote)
+
+		json.NewEncoder(w).Encode(map[string]string{
+			"full_name": "foo/" + body.Name,
+			"ssh_url":   "git@127.0.0.1:foo/" + body.Name + ".git",
+			"clone_url": gitSrv.URL + "/foo/" + body.Name + ".git",
+		})
+	}))
+	defer cleanup()
+
+	conf.RepositoriesPath = filepath.Join(dir, "repositories")
+	conf.Github.CloneHost = "127.0.0.1"
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "hello\n")
+	testGit(t, upstream, "tag", "v1")
+
+	r := &internal.Repository{
+		ID:        1,
+		Owner:     "foo",
+		Name:      "bar",
+		LocalPath: filepath.Join(conf.RepositoriesPath, "foo", "bar"),
+		CloneURL:  "file://" + upstream,
+	}
+
+	if err := UpdateRepository(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restoreCommand([]string{"foo/bar", "-create", "foo/new", "-yes"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"new"}; !reflect.DeepEqual(created, want) {
+		t.Errorf("expected the repositories %v to be created in the organization, got %v", want, created)
+	}
+
+	want := []string{"refs/heads/master", "refs/tags/v1"}
+	if got := testRefs(t, filepath.Join(dir, "remotes", "foo", "new.git")); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected remote refs %v, got %v", want, got)
+	}
+}
+
+func TestRestoredRefs(t *testing.T) {
+	refs := map[string]string{
+		"refs/remotes/origin/HEAD":                    "b",
+		"refs/remotes/origin/master":                  "b",
+		"refs/remotes/origin/feature":                 "c",
+		"refs/tags/v1":                                "d",
+		"refs/ghmirror/overwritten/master/1":          "e",
+		"refs/namespaces/git-http/refs/heads/master":  "b",
+		"refs/namespaces/git-http/refs/heads/feature": "c",
+	}
+
+	exp := map[string]string{
+		"refs/heads/master":                  "b",
+		"refs/heads/feature":                 "c",
+		"refs/tags/v1":                       "d",
+		"refs/ghmirror/overwritten/master/1": "e",
+	}
+
+	if got := restoredRefs(refs); !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %v, got %v", exp, got)
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+	"github.com/vrischmann/ghmirror/internal/encryption"
+	"github.com/vrischmann/ghmirror/internal/postgres"
+	"github.com/vrischmann/ghmirror/internal/storage"
+)
+
+// snapshotter regularly creates immutable snapshots of the repositories as git bundles.
+type snapshotter struct {
+	conf *config.Config
+
+	rs datastore.Repository
+	ss datastore.Snapshot
+
+	st  storage.Storage
+	key *encryption.Key
+}
+
+func newSnapshotter(conf *config.Config) (*snapshotter, error) {
+	s := &snapshotter{conf: conf}
+
+	var err error
+
+	s.rs, err = postgres.NewRepositoryStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create repository store. err=%v", err)
+	}
+
+	s.ss, err = postgres.NewSnapshotStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create snapshot store. err=%v", err)
+	}
+
+	s.st, err = storage.New(conf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create storage. err=%v", err)
+	}
+
+	s.key, err = encryption.NewKey(&conf.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load encryption key. err=%v", err)
+	}
+
+	return s, nil
+}
+
+func (s *snapshotter) run() {
+	ticker := time.NewTicker(s.conf.Snapshots.Frequency)
+
+	for range ticker.C {
+		s.snapshotRepositories()
+	}
+}
+
+func (s *snapshotter) snapshotRepositories() {
+	repos, err := s.rs.GetAll()
+	if err != nil {
+		log.Printf("error while getting repositories from the datastore. err=%v", err)
+		return
+	}
+
+	count := 0
+	for _, r := range repos {
+		if err := s.snapshot(r); err != nil {
+			log.Printf("error while creating snapshot of repository %d, %s. err=%v", r.ID, r.LocalPath, err)
+			continue
+		}
+
+		if err := s.prune(r); err != nil {
+			log.Printf("error while pruning snapshots of repository %d, %s. err=%v", r.ID, r.LocalPath, err)
+		}
+
+		count++
+	}
+
+	log.Printf("%d snapshots created", count)
+}
+
+// snapshot creates a bundle of all the refs of a repository and an archive of its backup directory, stores them
+// and records them in the catalog.
+//
+// Both are created in a staging directory under Snapshots.Path, and removed from there once stored. When an
+// encryption key is configured, they're encrypted before being stored and their keys get the .enc extension;
+// the checksum of the snapshot is then the one of the encrypted bundle, so it can be verified without the key.
+func (s *snapshotter) snapshot(r *internal.Repository) (err error) {
+	rel, err := filepath.Rel(s.conf.RepositoriesPath, r.LocalPath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	key := filepath.ToSlash(filepath.Join(rel, filepath.Base(rel)+"-"+now.Format("20060102T150405Z")))
+
+	staging := filepath.Join(s.conf.Snapshots.Path, ".staging")
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return err
+	}
+
+	bundle := filepath.Join(staging, strconv.FormatInt(r.ID, 10)+".bundle")
+	defer os.Remove(bundle)
+
+	log.Printf("git bundle create %s in %s", bundle, r.LocalPath)
+
+	unlock := lockRepository(r.LocalPath)
+	err = gitBundleCreate(r.LocalPath, bundle)
+	unlock()
+
+	if err != nil {
+		return err
+	}
+
+	refs, err := gitBundleListHeads(bundle)
+	if err != nil {
+		return err
+	}
+
+	bundle, ext, err := s.encrypt(bundle)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(bundle)
+
+	sum, size, err := fileChecksum(bundle)
+	if err != nil {
+		return err
+	}
+
+	snapshot := &internal.Snapshot{
+		RepositoryID: r.ID,
+		CreatedAt:    now,
+		Path:         key + ".bundle" + ext,
+		Size:         size,
+		SHA256:       sum,
+		Refs:         refs,
+	}
+
+	// The objects are only found by prune through the snapshot table, so they're deleted if the snapshot
+	// can't be recorded.
+	var stored []string
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		for _, key := range stored {
+			if derr := s.deleteObject(key); derr != nil {
+				log.Printf("unable to delete %s. err=%v", key, derr)
+			}
+		}
+	}()
+
+	stored = append(stored, snapshot.Path)
+	if err := storage.PutFile(s.st, snapshot.Path, bundle); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(backupDir(r)); err == nil {
+		archive := filepath.Join(staging, strconv.FormatInt(r.ID, 10)+".backup.tar.gz")
+		defer os.Remove(archive)
+
+		if err := archiveDir(backupDir(r), archive); err != nil {
+			return fmt.Errorf("unable to archive %s. err=%v", backupDir(r), err)
+		}
+
+		archive, _, err := s.encrypt(archive)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(archive)
+
+		snapshot.BackupPath = snapshotBackupPath(snapshot.Path)
+
+		stored = append(stored, snapshot.BackupPath)
+		if err := storage.PutFile(s.st, snapshot.BackupPath, archive); err != nil {
+			return err
+		}
+	}
+
+	if err := s.ss.Add(snapshot); err != nil {
+		return fmt.Errorf("error while adding snapshot to the datastore. err=%v", err)
+	}
+
+	return nil
+}
+
+// encrypt encrypts the file at path when an encryption key is configured, and returns the path of the encrypted
+// file and the extension to add to its key. Otherwise it returns path unchanged.
+func (s *snapshotter) encrypt(path string) (string, string, error) {
+	if s.key == nil {
+		return path, "", nil
+	}
+
+	enc := path + encryption.Extension
+	if err := encryption.EncryptFile(path, enc, s.key); err != nil {
+		return "", "", fmt.Errorf("unable to encrypt %s. err=%v", path, err)
+	}
+
+	return enc, encryption.Extension, nil
+}
+
+// prune deletes the snapshots of a repository not retained by the retention policy.
+func (s *snapshotter) prune(r *internal.Repository) error {
+	snapshots, err := s.ss.GetByRepositoryID(r.ID)
+	if err != nil {
+		return fmt.Errorf("error while getting snapshots from the datastore. err=%v", err)
+	}
+
+	retained := retainedSnapshots(snapshots, s.conf.Snapshots.Daily, s.conf.Snapshots.Weekly, s.conf.Snapshots.Monthly)
+
+	for _, snapshot := range snapshots {
+		if retained[snapshot.ID] {
+			continue
+		}
+
+		log.Printf("removing snapshot %s", snapshot.Path)
+
+		for _, key := range []string{snapshot.Path, snapshot.BackupPath} {
+			if err := s.deleteObject(key); err != nil {
+				return err
+			}
+		}
+
+		if err := s.ss.Delete(snapshot.ID); err != nil {
+			return fmt.Errorf("error while deleting snapshot from the datastore. err=%v", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *snapshotter) deleteObject(key string) error {
+	switch {
+	case key == "":
+		return nil
+	case filepath.IsAbs(key):
+		if err := os.Remove(key); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	default:
+		return s.st.Delete(key)
+	}
+}
+
+// retainedSnapshots applies a grandfather-father-son retention policy: it keeps the most recent snapshot
+// of each of the last daily days, weekly weeks and monthly months which have one.
+func retainedSnapshots(snapshots internal.Snapshots, daily, weekly, monthly int) map[int64]bool {
+	sorted := append(internal.Snapshots(nil), snapshots...)
+	sort.Sort(byCreatedAtDesc(sorted))
+
+	retained := make(map[int64]bool)
+
+	keep := func(n int, period func(t time.Time) string) {
+		seen := make(map[string]bool)
+		for _, snapshot := range sorted {
+			if len(seen) >= n {
+				return
+			}
+
+			p := period(snapshot.CreatedAt.UTC())
+			if seen[p] {
+				continue
+			}
+
+			seen[p] = true
+			retained[snapshot.ID] = true
+		}
+	}
+
+	keep(daily, func(t time.Time) string { return t.Format("2006-01-02") })
+	keep(weekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	keep(monthly, func(t time.Time) string { return t.Format("2006-01") })
+
+	return retained
+}
+
+type byCreatedAtDesc internal.Snapshots
+
+func (s byCreatedAtDesc) Len() int           { return len(s) }
+func (s byCreatedAtDesc) Less(i, j int) bool { return s[i].CreatedAt.After(s[j].CreatedAt) }
+func (s byCreatedAtDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// archiveDir writes the content of dir to file as a gzipped tar archive.
+func archiveDir(dir, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return nil
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(tw, src)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// snapshotBackupPath returns the key of the backup archive stored along the snapshot bundle at key.
+func snapshotBackupPath(key string) string {
+	ext := ""
+	if strings.HasSuffix(key, encryption.Extension) {
+		key, ext = strings.TrimSuffix(key, encryption.Extension), encryption.Extension
+	}
+
+	return strings.TrimSuffix(key, ".bundle") + ".backup.tar.gz" + ext
+}
+
+// extractArchive extracts an archive created by archiveDir into dir. Entries which would end up outside of dir are
+// rejected.
+func extractArchive(file, dir string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid path %q in archive", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+
+			dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(dst, tr)
+			if cerr := dst.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// fileChecksum returns the SHA256 checksum and the size of a file.
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/storage"
+)
+
+func TestRetainedSnapshots(t *testing.T) {
+	at := func(s string) time.Time {
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+
+	// Listed out of order, retainedSnapshots must sort them.
+	snapshots := internal.Snapshots{
+		{ID: 5, CreatedAt: at("2026-03-08T12:00:00Z")}, // Sunday of week 10
+		{ID: 1, CreatedAt: at("2026-03-18T12:00:00Z")}, // Wednesday of week 12
+		{ID: 8, CreatedAt: at("2025-12-31T12:00:00Z")},
+		{ID: 2, CreatedAt: at("2026-03-18T00:00:00Z")},
+		{ID: 3, CreatedAt: at("2026-03-17T12:00:00Z")},
+		{ID: 7, CreatedAt: at("2026-01-31T12:00:00Z")},
+		{ID: 4, CreatedAt: at("2026-03-15T12:00:00Z")}, // Sunday of week 11
+		{ID: 6, CreatedAt: at("2026-02-28T12:00:00Z")},
+		{ID: 9, CreatedAt: at("2026-03-17T23:30:00-02:00")}, // March 18 in UTC
+	}
+
+	testCases := []struct {
+		daily, weekly, monthly int
+		retained               []int64
+	}{
+		{0, 0, 0, nil},
+		{3, 0, 0, []int64{1, 3, 4}},
+		{0, 2, 0, []int64{1, 4}},
+		{0, 0, 2, []int64{1, 6}},
+		{3, 2, 2, []int64{1, 3, 4, 6}},
+		{1, 3, 4, []int64{1, 4, 5, 6, 7, 8}},
+		{100, 100, 100, []int64{1, 3, 4, 5, 6, 7, 8}},
+	}
+
+	for _, tc := range testCases {
+		expected := make(map[int64]bool)
+		for _, id := range tc.retained {
+			expected[id] = true
+		}
+
+		got := retainedSnapshots(snapshots, tc.daily, tc.weekly, tc.monthly)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%d daily, %d weekly, %d monthly: expected %v, got %v", tc.daily, tc.weekly, tc.monthly, expected, got)
+		}
+	}
+}
+
+func TestSnapshotCleanupOnError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghmirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &config.Config{RepositoriesPath: filepath.Join(dir, "repositories")}
+	c.Snapshots.Path = filepath.Join(dir, "snapshots")
+
+	upstream := filepath.Join(dir, "upstream")
+	testGit(t, dir, "init", "-q", upstream)
+	testCommitFile(t, upstream, "README", "hello\n")
+
+	r := &internal.Repository{
+		ID:        1,
+		LocalPath: filepath.Join(c.RepositoriesPath, "foo", "bar"),
+		CloneURL:  "file://" + upstream,
+	}
+
+	if err := UpdateRepository(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMetadataFile(filepath.Join(backupDir(r), "metadata", "labels.json"), "labels", []string{}); err != nil {
+		t.Fatal(err)
+	}
+
+	objects := func() []string {
+		var res []string
+		filepath.Walk(filepath.Join(c.Snapshots.Path, "foo"), func(path string, fi os.FileInfo, err error) error {
+			if err == nil && fi.Mode().IsRegular() {
+				res = append(res, filepath.Base(path))
+			}
+			return nil
+		})
+		return res
+	}
+
+	ss := &testSnapshotStore{err: errors.New("database is down")}
+	s := &snapshotter{conf: c, ss: ss, st: storage.NewLocalStorage(c.Snapshots.Path)}
+
+	if err := s.snapshot(r); err == nil {
+		t.Fatal("expected the snapshot to fail")
+	}
+	if got := objects(); len(got) != 0 {
+		t.Errorf("expected the objects of the failed snapshot to be deleted, got %v", got)
+	}
+
+	ss.err = nil
+
+	if err := s.snapshot(r); err != nil {
+		t.Fatal(err)
+	}
+	if got := objects(); len(got) != 2 {
+		t.Errorf("expected the bundle and the backup archive to be stored, got %v", got)
+	}
+	if got, want := ss.snapshots[0].BackupPath, snapshotBackupPath(ss.snapshots[0].Path); got != want {
+		t.Errorf("expected backup path %q, got %q", want, got)
+	}
+}
+
+func TestSnapshotBackupPath(t *testing.T) {
+	testCases := map[string]string{
+		"foo/bar/bar-20160102T150405Z.bundle":     "foo/bar/bar-20160102T150405Z.backup.tar.gz",
+		"foo/bar/bar-20160102T150405Z.bundle.enc": "foo/bar/bar-20160102T150405Z.backup.tar.gz.enc",
+	}
+
+	for key, exp := range testCases {
+		if got := snapshotBackupPath(key); got != exp {
+			t.Errorf("%s: expected %q, got %q", key, exp, got)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+	"github.com/vrischmann/ghmirror/internal/postgres"
+)
+
+// statusHandler serves the status of every repository as JSON.
+type statusHandler struct {
+	rs datastore.Repository
+	fs datastore.Fsck
+}
+
+type repositoryStatus struct {
+	ID        int64     `json:"id"`
+	Owner     string    `json:"owner"`
+	Name      string    `json:"name"`
+	LocalPath string    `json:"local_path"`
+	HookError string    `json:"hook_error,omitempty"`
+	LFSSize   int64     `json:"lfs_size"`
+	Corrupted bool      `json:"corrupted"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+}
+
+func newStatusHandler(conf *config.Config) (*statusHandler, error) {
+	h := new(statusHandler)
+
+	var err error
+
+	h.rs, err = postgres.NewRepositoryStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create repository store. err=%v", err)
+	}
+
+	h.fs, err = postgres.NewFsckStore(&conf.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create fsck store. err=%v", err)
+	}
+
+	return h, nil
+}
+
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	repos, err := h.rs.GetAll()
+	if err != nil {
+		log.Printf("error while getting repositories from the datastore. err=%v", err)
+		writeInternalServerError(w)
+		return
+	}
+
+	results, err := h.fs.GetLatest()
+	if err != nil {
+		log.Printf("error while getting fsck results from the datastore. err=%v", err)
+		writeInternalServerError(w)
+		return
+	}
+
+	statuses := make(map[int64]*repositoryStatus)
+	res := make([]*repositoryStatus, 0, len(repos))
+
+	for _, r := range repos {
+		s := &repositoryStatus{
+			ID:        r.ID,
+			Owner:     r.Owner,
+			Name:      r.Name,
+			LocalPath: r.LocalPath,
+			HookError: r.HookError,
+			LFSSize:   r.LFSSize,
+		}
+
+		statuses[r.ID] = s
+		res = append(res, s)
+	}
+
+	for _, fr := range results {
+		if s, ok := statuses[fr.RepositoryID]; ok {
+			s.Corrupted = !fr.OK
+			s.CheckedAt = fr.CheckedAt
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("error while encoding status. err=%v", err)
+	}
+}
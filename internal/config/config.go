@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/vrischmann/flagutil"
@@ -15,13 +17,226 @@ type Postgres struct {
 	SSLMode  string
 }
 
+// HookPolicy controls how the webhooks of an owner are managed.
+type HookPolicy string
+
+const (
+	// HookPolicyNone never touches the webhooks, the repositories are only polled.
+	HookPolicyNone HookPolicy = "none"
+	// HookPolicyCreateIfMissing creates the missing webhooks but never updates or removes them.
+	HookPolicyCreateIfMissing HookPolicy = "create-if-missing"
+	// HookPolicyReconcile creates, updates and removes the webhooks as needed.
+	HookPolicyReconcile HookPolicy = "reconcile"
+)
+
+func (p *HookPolicy) Unmarshal(s string) error {
+	switch v := HookPolicy(s); v {
+	case HookPolicyNone, HookPolicyCreateIfMissing, HookPolicyReconcile:
+		*p = v
+		return nil
+	default:
+		return fmt.Errorf("invalid hook policy %q", s)
+	}
+}
+
+// OwnerHookPolicy overrides the hook policy for a single owner or organization.
+type OwnerHookPolicy struct {
+	Owner  string
+	Policy HookPolicy
+}
+
+// StorageType is where the snapshots are stored.
+type StorageType string
+
+const (
+	// StorageLocal stores the snapshots in Snapshots.Path.
+	StorageLocal StorageType = "local"
+	// StorageS3 stores the snapshots in an S3 compatible bucket.
+	StorageS3 StorageType = "s3"
+)
+
+func (t *StorageType) Unmarshal(s string) error {
+	switch v := StorageType(s); v {
+	case StorageLocal, StorageS3:
+		*t = v
+		return nil
+	default:
+		return fmt.Errorf("invalid storage type %q", s)
+	}
+}
+
+// S3 is the configuration of an S3 compatible bucket.
+type S3 struct {
+	// Endpoint is the URL of the S3 API, for example https://s3.eu-west-1.amazonaws.com.
+	Endpoint        string `envconfig:"optional"`
+	Region          string `envconfig:"default=us-east-1"`
+	Bucket          string `envconfig:"optional"`
+	AccessKeyID     string `envconfig:"optional"`
+	SecretAccessKey string `envconfig:"optional"`
+	// Prefix is prepended to every key.
+	Prefix string `envconfig:"optional"`
+	// PathStyle puts the bucket in the path of the URL instead of the host name, as MinIO expects by default.
+	PathStyle bool `envconfig:"optional"`
+}
+
+// GitHub is the GitHub instance the repositories are mirrored from, github.com or a GitHub Enterprise Server.
+type GitHub struct {
+	// BaseURL is the URL of the API, https://api.github.com/ by default and https://<host>/api/v3/ for a
+	// GitHub Enterprise Server.
+	BaseURL string `envconfig:"optional"`
+	// UploadURL is the URL of the uploads API. It defaults to https://<host>/api/uploads/ when BaseURL is set.
+	UploadURL string `envconfig:"optional"`
+	// CloneHost is the host the clone URLs of the repositories must point to. It defaults to the host of BaseURL.
+	CloneHost string `envconfig:"optional"`
+	// CABundle is the path of PEM encoded CA certificates to trust in addition to the system ones.
+	CABundle string `envconfig:"optional"`
+	// AppID is the ID of the GitHub App to authenticate as, instead of with Config.PersonalAccessToken.
+	AppID int64 `envconfig:"optional"`
+	// AppPrivateKey is the path of the PEM encoded private key of the GitHub App.
+	AppPrivateKey string `envconfig:"optional"`
+}
+
+// Encryption is the key the snapshots and backup archives are encrypted with. At most one of Passphrase and
+// PublicKey can be set, and the artifacts are stored in clear when neither is.
+type Encryption struct {
+	Passphrase string `envconfig:"optional"`
+	// PublicKey is the path of a PEM encoded RSA public key.
+	PublicKey string `envconfig:"optional"`
+	// KeyID is recorded in the encrypted files. It defaults to "passphrase" or to the fingerprint of the public key.
+	KeyID string `envconfig:"optional"`
+}
+
+// PushTarget is a secondary git remote the repositories are pushed to after each sync.
+type PushTarget struct {
+	Name string
+	// URLTemplate is the URL of the remote, where {{owner}} and {{name}} are replaced by those of the repository.
+	URLTemplate string
+	// Scope is an owner or an owner/name repository, or empty to push every repository.
+	Scope string
+	// SSHKey is the path of the SSH private key to use, or empty to use the default one.
+	SSHKey  string
+	Retries int
+}
+
+// ProviderType is the kind of forge a provider is.
+type ProviderType string
+
+const (
+	ProviderGitea  ProviderType = "gitea"
+	ProviderGitLab ProviderType = "gitlab"
+)
+
+func (t *ProviderType) Unmarshal(s string) error {
+	switch v := ProviderType(s); v {
+	case ProviderGitea, ProviderGitLab:
+		*t = v
+		return nil
+	default:
+		return fmt.Errorf("invalid provider type %q", s)
+	}
+}
+
+// Provider is a Gitea or GitLab instance the repositories are mirrored from, in addition to GitHub.
+type Provider struct {
+	// Name identifies the provider in its webhook route, /hook/<name>, and in the path of its local copies.
+	Name string
+	Type ProviderType
+	// URL is the URL of the instance, for example https://gitea.example.com.
+	URL   string
+	Token string
+	// Secret is the secret of the webhooks, used like Config.Secret is for GitHub.
+	Secret string
+}
+
+// Owners is a space separated list of owners.
+type Owners []string
+
+func (o *Owners) Unmarshal(s string) error {
+	*o = strings.Fields(s)
+	return nil
+}
+
+// Account is a GitHub account mirrored in addition to the default one, the one of PersonalAccessToken.
+type Account struct {
+	// Name identifies the account in its webhook route, /hook/<name>, and in the repository rows.
+	Name  string
+	Token string
+	// Owners restricts the repositories mirrored to those of these owners. All of them are mirrored when it's empty.
+	Owners Owners
+	// RepositoriesPath is the directory of the local copies, relative to Config.RepositoriesPath. It defaults to
+	// the name of the account.
+	RepositoriesPath string
+	// Secret is the secret of the webhooks, used like Config.Secret is for the default account.
+	Secret string
+}
+
 type Config struct {
 	ListenAddress       flagutil.NetworkAddresses
 	Secret              string
-	PersonalAccessToken string
+	PersonalAccessToken string `envconfig:"optional"`
 	PollFrequency       time.Duration
-	Webhook             struct {
-		Endpoint string
+	// Github isn't spelled GitHub so that the variables are GITHUB_* and not GIT_HUB_*.
+	Github  GitHub
+	Webhook struct {
+		Endpoint           string
+		ReconcileFrequency time.Duration     `envconfig:"default=6h"`
+		Organizations      []string          `envconfig:"optional"`
+		Policy             HookPolicy        `envconfig:"default=reconcile"`
+		OwnerPolicies      []OwnerHookPolicy `envconfig:"optional"`
+	}
+	Metadata struct {
+		Enabled bool `envconfig:"optional"`
+	}
+	Releases struct {
+		Enabled bool `envconfig:"optional"`
+	}
+	Gists struct {
+		Enabled bool `envconfig:"optional"`
+	}
+	PullRequestRefs struct {
+		Enabled      bool     `envconfig:"optional"`
+		Repositories []string `envconfig:"optional"`
+	}
+	Snapshots struct {
+		Path      string        `envconfig:"optional"`
+		Frequency time.Duration `envconfig:"default=24h"`
+		Daily     int           `envconfig:"default=7"`
+		Weekly    int           `envconfig:"default=4"`
+		Monthly   int           `envconfig:"default=12"`
+	}
+	Storage struct {
+		Type StorageType `envconfig:"default=local"`
+		S3   S3
+	}
+	Encryption Encryption
+	Fsck       struct {
+		Enabled             bool          `envconfig:"optional"`
+		Frequency           time.Duration `envconfig:"default=1h"`
+		Period              time.Duration `envconfig:"default=168h"`
+		RecloneOnCorruption bool          `envconfig:"optional"`
+	}
+	Maintenance struct {
+		Enabled               bool          `envconfig:"optional"`
+		Frequency             time.Duration `envconfig:"default=6h"`
+		FetchThreshold        int64         `envconfig:"default=100"`
+		LooseObjectsThreshold int64         `envconfig:"default=1000"`
+		PacksThreshold        int64         `envconfig:"default=50"`
+	}
+	Overwritten struct {
+		Retention time.Duration `envconfig:"default=8760h"`
+	}
+	Admin struct {
+		Tokens []string `envconfig:"optional"`
+	}
+	GitHTTP struct {
+		Enabled bool     `envconfig:"optional"`
+		Tokens  []string `envconfig:"optional"`
+	}
+	PushTargets []PushTarget `envconfig:"optional"`
+	Providers   []Provider   `envconfig:"optional"`
+	Accounts    []Account    `envconfig:"optional"`
+	Deliveries  struct {
+		Retention time.Duration `envconfig:"default=720h"`
 	}
 	RepositoriesPath string
 	Postgres         Postgres
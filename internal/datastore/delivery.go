@@ -0,0 +1,18 @@
+package datastore
+
+import (
+	"io"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// Delivery is used to archive the webhook deliveries.
+type Delivery interface {
+	io.Closer
+
+	GetByID(id string) (*internal.Delivery, error)
+	Add(delivery *internal.Delivery) error
+	MarkProcessed(id string) error
+	DeleteOlderThan(t time.Time) (int64, error)
+}
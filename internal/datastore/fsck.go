@@ -0,0 +1,16 @@
+package datastore
+
+import (
+	"io"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// Fsck is used to record the integrity checks of the repositories.
+type Fsck interface {
+	io.Closer
+
+	// GetLatest returns the latest result of each repository.
+	GetLatest() (internal.FsckResults, error)
+	Add(result *internal.FsckResult) error
+}
@@ -0,0 +1,15 @@
+package datastore
+
+import (
+	"io"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// Gist is used to get and update metadata about gists.
+type Gist interface {
+	io.Closer
+
+	GetByID(id string) (*internal.Gist, error)
+	Add(gist *internal.Gist) error
+}
@@ -0,0 +1,15 @@
+package datastore
+
+import (
+	"io"
+	"time"
+)
+
+// MetadataBackup is used to keep track of the metadata backups, so that they can be incremental.
+type MetadataBackup interface {
+	io.Closer
+
+	// GetLastBackup returns the start time of the last metadata backup of a repository, or the zero time if there was none.
+	GetLastBackup(repositoryID int64) (time.Time, error)
+	SetLastBackup(repositoryID int64, t time.Time) error
+}
@@ -0,0 +1,15 @@
+package datastore
+
+import (
+	"io"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// OrganizationHook is used to keep track of the organization webhooks.
+type OrganizationHook interface {
+	io.Closer
+
+	GetByName(name string) (*internal.OrganizationHook, error)
+	Set(hook *internal.OrganizationHook) error
+}
@@ -1,9 +1,14 @@
 package datastore
 
-import "io"
+import (
+	"io"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
 
 type OwnerBlacklist interface {
 	io.Closer
 
+	Get() (internal.OwnersBlacklist, error)
 	IsBlacklisted(name string) (bool, error)
 }
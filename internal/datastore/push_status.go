@@ -0,0 +1,15 @@
+package datastore
+
+import (
+	"io"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// PushStatus is used to record the pushes to the push targets.
+type PushStatus interface {
+	io.Closer
+
+	GetByRepositoryID(id int64) ([]*internal.PushStatus, error)
+	Set(status *internal.PushStatus) error
+}
@@ -0,0 +1,17 @@
+package datastore
+
+import (
+	"io"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// Release is used to keep track of the releases and release assets we backed up.
+type Release interface {
+	io.Closer
+
+	Has(id int64) (bool, error)
+	Add(release *internal.Release) error
+	HasAsset(id int64) (bool, error)
+	AddAsset(asset *internal.ReleaseAsset) error
+}
@@ -12,6 +12,14 @@ type Repository interface {
 
 	GetAll() (internal.Repositories, error)
 	GetByID(id int64) (*internal.Repository, error)
+	GetByLocalPath(localPath string) (*internal.Repository, error)
 	Has(id int64) (bool, error)
 	Add(repo *internal.Repository) error
+	SetHook(id, hookID int64, fingerprint string) error
+	SetHookError(id int64, hookErr string) error
+	SetLFSSize(id, size int64) error
+	SetSize(id, size int64) error
+	IncrementFetchCount(id int64) error
+	ResetFetchCount(id int64) error
+	SetPrivate(id int64, private bool) error
 }
@@ -10,4 +10,5 @@ type RepositoryBlacklist interface {
 	io.Closer
 
 	Get() (internal.RepositoriesBlacklist, error)
+	IsBlacklisted(organization, name string) (bool, error)
 }
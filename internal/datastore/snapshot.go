@@ -0,0 +1,16 @@
+package datastore
+
+import (
+	"io"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// Snapshot is the catalog of the repository snapshots.
+type Snapshot interface {
+	io.Closer
+
+	GetByRepositoryID(id int64) (internal.Snapshots, error)
+	Add(snapshot *internal.Snapshot) error
+	Delete(id int64) error
+}
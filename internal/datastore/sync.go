@@ -0,0 +1,18 @@
+package datastore
+
+import (
+	"io"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// Sync is used to record the history of the syncs of the repositories.
+type Sync interface {
+	io.Closer
+
+	// GetLatest returns the latest sync of each repository.
+	GetLatest() (internal.Syncs, error)
+	// GetByRepositoryID returns the last syncs of a repository, latest first.
+	GetByRepositoryID(id int64, limit int) (internal.Syncs, error)
+	Add(sync *internal.Sync) error
+}
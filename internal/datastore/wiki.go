@@ -0,0 +1,15 @@
+package datastore
+
+import (
+	"io"
+
+	"github.com/vrischmann/ghmirror/internal"
+)
+
+// Wiki is used to get and update metadata about the wikis of the repositories.
+type Wiki interface {
+	io.Closer
+
+	GetByRepositoryID(id int64) (*internal.Wiki, error)
+	Add(wiki *internal.Wiki) error
+}
@@ -0,0 +1,516 @@
+// Package encryption encrypts the backup artifacts with AES-256-GCM, with a key derived from a passphrase or a
+// random key encrypted with an RSA public key.
+//
+// An encrypted file starts with a header:
+//
+//	magic       "GHMIRROR-ENC"
+//	version     1 byte
+//	mode        1 byte, 1 for a passphrase and 2 for an RSA public key
+//	key ID      uint16 length and bytes
+//	passphrase  16 bytes of salt and the uint32 PBKDF2-SHA256 iteration count
+//	RSA         uint16 length and bytes of the data key encrypted with RSA-OAEP-SHA256
+//	chunk size  uint32
+//
+// followed by the content split in chunks, each sealed with the header as additional data and a nonce made of
+// the chunk counter and a flag set on the last chunk, so that the chunks can't be reordered or truncated.
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+const (
+	magic   = "GHMIRROR-ENC"
+	version = 1
+
+	modePassphrase = 1
+	modeRSA        = 2
+
+	saltSize   = 16
+	iterations = 600000
+	keySize    = 32
+	chunkSize  = 64 * 1024
+
+	// Extension is appended to the name of the encrypted files.
+	Extension = ".enc"
+)
+
+// ErrNotEncrypted is returned when reading a file which doesn't start with the header.
+var ErrNotEncrypted = errors.New("not an encrypted file")
+
+// Key is used to encrypt, either a passphrase or an RSA public key.
+type Key struct {
+	ID string
+
+	passphrase string
+	public     *rsa.PublicKey
+}
+
+// NewKey returns the key configured in conf, or nil if encryption is disabled.
+func NewKey(conf *config.Encryption) (*Key, error) {
+	switch {
+	case conf.Passphrase != "" && conf.PublicKey != "":
+		return nil, errors.New("only one of the encryption passphrase and public key can be set")
+
+	case conf.Passphrase != "":
+		id := conf.KeyID
+		if id == "" {
+			id = "passphrase"
+		}
+		return &Key{ID: id, passphrase: conf.Passphrase}, nil
+
+	case conf.PublicKey != "":
+		pub, err := LoadPublicKey(conf.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		id := conf.KeyID
+		if id == "" {
+			id = Fingerprint(pub)
+		}
+		return &Key{ID: id, public: pub}, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+// Fingerprint returns the first 16 hex characters of the SHA256 checksum of a public key.
+func Fingerprint(pub *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha256.Sum256(der)
+
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// LoadPublicKey reads a PEM encoded RSA public key, in the PKIX or PKCS #1 format.
+func LoadPublicKey(path string) (*rsa.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse public key %s. err=%v", path, err)
+	}
+
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %s is not an RSA key", path)
+	}
+
+	return rsaPub, nil
+}
+
+// LoadPrivateKey reads a PEM encoded RSA private key, in the PKCS #1 or PKCS #8 format.
+func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key %s. err=%v", path, err)
+	}
+
+	rsaPriv, ok := priv.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key %s is not an RSA key", path)
+	}
+
+	return rsaPriv, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	return block, nil
+}
+
+// NewWriter returns a writer which encrypts what is written to it into w. It must be closed to write the last chunk.
+func NewWriter(w io.Writer, key *Key) (io.WriteCloser, error) {
+	var hdr bytes.Buffer
+	hdr.WriteString(magic)
+	hdr.WriteByte(version)
+
+	var dataKey []byte
+
+	switch {
+	case key.passphrase != "":
+		hdr.WriteByte(modePassphrase)
+		writeBytes(&hdr, []byte(key.ID))
+
+		salt := make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		hdr.Write(salt)
+		binary.Write(&hdr, binary.BigEndian, uint32(iterations))
+
+		var err error
+		dataKey, err = pbkdf2.Key(sha256.New, key.passphrase, salt, iterations, keySize)
+		if err != nil {
+			return nil, err
+		}
+
+	case key.public != nil:
+		hdr.WriteByte(modeRSA)
+		writeBytes(&hdr, []byte(key.ID))
+
+		dataKey = make([]byte, keySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, err
+		}
+
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.public, dataKey, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to encrypt the data key. err=%v", err)
+		}
+		writeBytes(&hdr, wrapped)
+
+	default:
+		return nil, errors.New("empty key")
+	}
+
+	binary.Write(&hdr, binary.BigEndian, uint32(chunkSize))
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(hdr.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return &writer{w: w, aead: aead, header: hdr.Bytes()}, nil
+}
+
+type writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	counter uint64
+	buf     []byte
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	// Keep a full chunk until we know it's not the last one.
+	for len(w.buf) > chunkSize {
+		if err := w.seal(w.buf[:chunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buf = append(w.buf[:0], w.buf[chunkSize:]...)
+	}
+
+	return len(p), nil
+}
+
+func (w *writer) Close() error {
+	return w.seal(w.buf, true)
+}
+
+func (w *writer) seal(chunk []byte, last bool) error {
+	out := w.aead.Seal(nil, nonce(w.counter, last), chunk, w.header)
+	w.counter++
+
+	_, err := w.w.Write(out)
+
+	return err
+}
+
+// NewReader returns a reader which decrypts r, with the passphrase or the private key depending on how it
+// was encrypted.
+func NewReader(r io.Reader, passphrase string, private *rsa.PrivateKey) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	var hdr bytes.Buffer
+	tr := io.TeeReader(br, &hdr)
+
+	prefix := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(tr, prefix); err != nil || string(prefix[:len(magic)]) != magic {
+		return nil, ErrNotEncrypted
+	}
+
+	if v := prefix[len(magic)]; v != version {
+		return nil, fmt.Errorf("unsupported encryption version %d", v)
+	}
+
+	keyID, err := readBytes(tr)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataKey []byte
+
+	switch mode := prefix[len(magic)+1]; mode {
+	case modePassphrase:
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(tr, salt); err != nil {
+			return nil, err
+		}
+
+		var iter uint32
+		if err := binary.Read(tr, binary.BigEndian, &iter); err != nil {
+			return nil, err
+		}
+
+		// The header isn't authenticated until the first chunk is opened, so an iteration count chosen by whoever
+		// crafted the file isn't trusted.
+		if iter != iterations {
+			return nil, fmt.Errorf("unsupported PBKDF2 iteration count %d", iter)
+		}
+
+		if passphrase == "" {
+			return nil, fmt.Errorf("encrypted with the passphrase %s, which is not set", keyID)
+		}
+
+		dataKey, err = pbkdf2.Key(sha256.New, passphrase, salt, int(iter), keySize)
+		if err != nil {
+			return nil, err
+		}
+
+	case modeRSA:
+		wrapped, err := readBytes(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		if private == nil {
+			return nil, fmt.Errorf("encrypted with the public key %s, but no private key is set", keyID)
+		}
+
+		dataKey, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, private, wrapped, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt the data key, the file was encrypted with key %s. err=%v", keyID, err)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported encryption mode %d", mode)
+	}
+
+	var size uint32
+	if err := binary.Read(tr, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+
+	if size != chunkSize {
+		return nil, fmt.Errorf("unsupported chunk size %d", size)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reader{
+		r:      br,
+		aead:   aead,
+		header: hdr.Bytes(),
+		keyID:  string(keyID),
+		chunk:  make([]byte, int(size)+aead.Overhead()),
+	}, nil
+}
+
+type reader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	header  []byte
+	keyID   string
+	counter uint64
+	chunk   []byte
+	buf     []byte
+	done    bool
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+func (r *reader) open() error {
+	n, err := io.ReadFull(r.r, r.chunk)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		r.done = true
+	case err != nil:
+		return err
+	default:
+		// A full chunk is the last one if nothing follows it.
+		if _, err := r.r.Peek(1); err == io.EOF {
+			r.done = true
+		}
+	}
+
+	plain, err := r.aead.Open(nil, nonce(r.counter, r.done), r.chunk[:n], r.header)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt, the file is corrupted, truncated or was encrypted with another key than %s", r.keyID)
+	}
+	r.counter++
+	r.buf = plain
+
+	return nil
+}
+
+// IsEncrypted checks if the file at path starts with the header.
+func IsEncrypted(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, len(magic))
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return false, nil
+	}
+
+	return string(buf) == magic, nil
+}
+
+// EncryptFile encrypts the file at src into dst.
+func EncryptFile(src, dst string, key *Key) error {
+	return transformFile(src, dst, func(in io.Reader, out io.Writer) error {
+		w, err := NewWriter(out, key)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(w, in); err != nil {
+			return err
+		}
+
+		return w.Close()
+	})
+}
+
+// DecryptFile decrypts the file at src into dst.
+func DecryptFile(src, dst, passphrase string, private *rsa.PrivateKey) error {
+	return transformFile(src, dst, func(in io.Reader, out io.Writer) error {
+		r, err := NewReader(in, passphrase, private)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(out, r)
+
+		return err
+	})
+}
+
+func transformFile(src, dst string, fn func(in io.Reader, out io.Writer) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(out)
+
+	if err := fn(in, bw); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	return out.Close()
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// nonce is the big endian chunk counter, followed by 1 for the last chunk and 0 otherwise.
+func nonce(counter uint64, last bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[3:11], counter)
+	if last {
+		n[11] = 1
+	}
+
+	return n
+}
+
+func writeBytes(w *bytes.Buffer, b []byte) {
+	binary.Write(w, binary.BigEndian, uint16(len(b)))
+	w.Write(b)
+}
+
+func readBytes(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+
+	return b, err
+}
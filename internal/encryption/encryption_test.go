@@ -0,0 +1,209 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var (
+	testPrivateKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	testOtherKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+
+	testRSAKey = &Key{ID: "test", public: &testPrivateKey.PublicKey}
+)
+
+func encrypt(t *testing.T, key *Key, plain []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	w, err := NewWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Written in uneven pieces so that the chunks don't follow the writes.
+	for len(plain) > 0 {
+		n := 1000
+		if n > len(plain) {
+			n = len(plain)
+		}
+
+		if _, err := w.Write(plain[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plain = plain[n:]
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func decrypt(encrypted []byte, passphrase string, private *rsa.PrivateKey) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(encrypted), passphrase, private)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// testHeaderSize returns the size of the header written for key, the size of an empty encrypted file without
+// its only, empty, chunk.
+func testHeaderSize(t *testing.T, key *Key) int {
+	return len(encrypt(t, key, nil)) - 16
+}
+
+func TestRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3 * chunkSize, 3*chunkSize + 12345}
+
+	for _, size := range sizes {
+		plain := randomBytes(t, size)
+
+		got, err := decrypt(encrypt(t, testRSAKey, plain), "", testPrivateKey)
+		if err != nil {
+			t.Errorf("%d bytes: %v", size, err)
+			continue
+		}
+
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: decrypted content differs", size)
+		}
+	}
+}
+
+func TestRoundTripPassphrase(t *testing.T) {
+	key := &Key{ID: "passphrase", passphrase: "secret"}
+	plain := randomBytes(t, chunkSize+1)
+
+	encrypted := encrypt(t, key, plain)
+
+	got, err := decrypt(encrypted, "secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("decrypted content differs")
+	}
+
+	if _, err := decrypt(encrypted, "wrong", nil); err == nil {
+		t.Error("expected decrypting with the wrong passphrase to fail")
+	}
+
+	if _, err := decrypt(encrypted, "", nil); err == nil {
+		t.Error("expected decrypting without a passphrase to fail")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	encrypted := encrypt(t, testRSAKey, []byte("hello"))
+
+	if _, err := decrypt(encrypted, "", testOtherKey); err == nil {
+		t.Error("expected decrypting with another private key to fail")
+	}
+
+	if _, err := decrypt(encrypted, "secret", nil); err == nil {
+		t.Error("expected decrypting without the private key to fail")
+	}
+}
+
+func TestCorruption(t *testing.T) {
+	plain := randomBytes(t, 3*chunkSize+100)
+	encrypted := encrypt(t, testRSAKey, plain)
+
+	hdrSize := testHeaderSize(t, testRSAKey)
+	sealedSize := chunkSize + 16
+
+	chunk := func(i int) []byte {
+		start := hdrSize + i*sealedSize
+		end := start + sealedSize
+		if end > len(encrypted) {
+			end = len(encrypted)
+		}
+		return encrypted[start:end]
+	}
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	tampered := append([]byte(nil), encrypted...)
+	tampered[hdrSize+sealedSize+10] ^= 1
+
+	tamperedHeader := append([]byte(nil), encrypted...)
+	tamperedHeader[len(magic)+4] ^= 1
+
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{"tampered chunk", tampered},
+		{"tampered header", tamperedHeader},
+		{"truncated in a chunk", encrypted[:len(encrypted)-10]},
+		{"truncated after a chunk", encrypted[:hdrSize+3*sealedSize]},
+		{"only the header", encrypted[:hdrSize]},
+		{"reordered chunks", join(encrypted[:hdrSize], chunk(1), chunk(0), chunk(2), chunk(3))},
+		{"dropped chunk", join(encrypted[:hdrSize], chunk(0), chunk(2), chunk(3))},
+		{"duplicated chunk", join(encrypted[:hdrSize], chunk(0), chunk(0), chunk(1), chunk(2), chunk(3))},
+	}
+
+	for _, tc := range testCases {
+		if _, err := decrypt(tc.data, "", testPrivateKey); err == nil {
+			t.Errorf("%s: expected decrypting to fail", tc.name)
+		}
+	}
+
+	if got, err := decrypt(join(encrypted[:hdrSize], chunk(0), chunk(1), chunk(2), chunk(3)), "", testPrivateKey); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("expected the chunks in order to decrypt, got err=%v", err)
+	}
+}
+
+func TestUntrustedHeader(t *testing.T) {
+	encrypted := encrypt(t, testRSAKey, []byte("hello"))
+	hdrSize := testHeaderSize(t, testRSAKey)
+
+	// The chunk size is the last field of the header.
+	bigChunks := append([]byte(nil), encrypted...)
+	binary.BigEndian.PutUint32(bigChunks[hdrSize-4:], 1<<31)
+
+	_, err := decrypt(bigChunks, "", testPrivateKey)
+	if err == nil || !strings.Contains(err.Error(), "chunk size") {
+		t.Errorf("expected an unsupported chunk size error, got %v", err)
+	}
+
+	key := &Key{ID: "passphrase", passphrase: "secret"}
+	encrypted = encrypt(t, key, []byte("hello"))
+
+	// The iteration count follows the key ID and the salt.
+	offset := len(magic) + 2 + 2 + len(key.ID) + saltSize
+	manyIterations := append([]byte(nil), encrypted...)
+	binary.BigEndian.PutUint32(manyIterations[offset:], 1<<31)
+
+	_, err = decrypt(manyIterations, "secret", nil)
+	if err == nil || !strings.Contains(err.Error(), "iteration count") {
+		t.Errorf("expected an unsupported iteration count error, got %v", err)
+	}
+}
+
+func TestNotEncrypted(t *testing.T) {
+	if _, err := decrypt([]byte("PACK"), "secret", nil); err != ErrNotEncrypted {
+		t.Errorf("expected ErrNotEncrypted, got %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+type deliveryStore struct {
+	db *sql.DB
+}
+
+func NewDeliveryStore(conf *config.Postgres) (datastore.Delivery, error) {
+	s := new(deliveryStore)
+
+	var err error
+	s.db, err = makeDB(conf)
+
+	return s, err
+}
+
+func (s *deliveryStore) Close() error { return s.db.Close() }
+
+func (s *deliveryStore) GetByID(id string) (*internal.Delivery, error) {
+	const q = `SELECT COALESCE(provider, 'github'), event, repository_id, repository_name, received_at, signature_valid, body, processed FROM delivery
+               WHERE id = $1`
+
+	d := &internal.Delivery{ID: id}
+
+	err := s.db.QueryRow(q, id).Scan(&d.Provider, &d.Event, &d.RepositoryID, &d.RepositoryName, &d.ReceivedAt, &d.SignatureValid, &d.Body, &d.Processed)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Add archives a delivery unless it already is. A delivery first archived with an invalid signature is replaced
+// when it's received again with a valid one.
+func (s *deliveryStore) Add(d *internal.Delivery) error {
+	const q = `INSERT INTO delivery(id, provider, event, repository_id, repository_name, received_at, signature_valid, body, processed)
+               VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+               ON CONFLICT (id) DO UPDATE
+               SET event = EXCLUDED.event, repository_id = EXCLUDED.repository_id, repository_name = EXCLUDED.repository_name,
+                   received_at = EXCLUDED.received_at, signature_valid = EXCLUDED.signature_valid, body = EXCLUDED.body
+               WHERE NOT delivery.signature_valid AND EXCLUDED.signature_valid`
+
+	_, err := s.db.Exec(q, d.ID, d.Provider, d.Event, d.RepositoryID, d.RepositoryName, d.ReceivedAt, d.SignatureValid, d.Body, d.Processed)
+
+	return err
+}
+
+func (s *deliveryStore) MarkProcessed(id string) error {
+	const q = `UPDATE delivery SET processed = true
+               WHERE id = $1`
+
+	_, err := s.db.Exec(q, id)
+
+	return err
+}
+
+func (s *deliveryStore) DeleteOlderThan(t time.Time) (int64, error) {
+	const q = `DELETE FROM delivery
+               WHERE received_at < $1`
+
+	res, err := s.db.Exec(q, t)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+var _ datastore.Delivery = (*deliveryStore)(nil)
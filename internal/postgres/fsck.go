@@ -0,0 +1,58 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+type fsckStore struct {
+	db *sql.DB
+}
+
+func NewFsckStore(conf *config.Postgres) (datastore.Fsck, error) {
+	s := new(fsckStore)
+
+	var err error
+	s.db, err = makeDB(conf)
+
+	return s, err
+}
+
+func (s *fsckStore) Close() error { return s.db.Close() }
+
+func (s *fsckStore) GetLatest() (internal.FsckResults, error) {
+	var res internal.FsckResults
+
+	const q = `SELECT DISTINCT ON (repository_id) id, repository_id, checked_at, ok, output FROM fsck
+               ORDER BY repository_id, checked_at DESC`
+
+	rows, err := s.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r internal.FsckResult
+		if err := rows.Scan(&r.ID, &r.RepositoryID, &r.CheckedAt, &r.OK, &r.Output); err != nil {
+			return nil, err
+		}
+
+		res = append(res, &r)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *fsckStore) Add(result *internal.FsckResult) error {
+	const q = `INSERT INTO fsck(repository_id, checked_at, ok, output)
+               VALUES ($1, $2, $3, $4)
+               RETURNING id`
+
+	return s.db.QueryRow(q, result.RepositoryID, result.CheckedAt, result.OK, result.Output).Scan(&result.ID)
+}
+
+var _ datastore.Fsck = (*fsckStore)(nil)
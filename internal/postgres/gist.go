@@ -0,0 +1,52 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+type gistStore struct {
+	db *sql.DB
+}
+
+func NewGistStore(conf *config.Postgres) (datastore.Gist, error) {
+	s := new(gistStore)
+
+	var err error
+	s.db, err = makeDB(conf)
+
+	return s, err
+}
+
+func (s *gistStore) Close() error { return s.db.Close() }
+
+func (s *gistStore) GetByID(id string) (*internal.Gist, error) {
+	const q = `SELECT description, local_path, clone_url FROM gist
+               WHERE id = $1`
+
+	var description, localPath, cloneURL string
+
+	err := s.db.QueryRow(q, id).Scan(&description, &localPath, &cloneURL)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return internal.NewGist(id, description, localPath, cloneURL), nil
+}
+
+func (s *gistStore) Add(gist *internal.Gist) error {
+	const q = `INSERT INTO gist(id, description, local_path, clone_url)
+               VALUES ($1, $2, $3, $4)`
+
+	_, err := s.db.Exec(q, gist.ID, gist.Description, gist.LocalPath, gist.CloneURL)
+
+	return err
+}
+
+var _ datastore.Gist = (*gistStore)(nil)
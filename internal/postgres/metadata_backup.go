@@ -0,0 +1,73 @@
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+type metadataBackupStore struct {
+	db *sql.DB
+}
+
+func NewMetadataBackupStore(conf *config.Postgres) (datastore.MetadataBackup, error) {
+	s := new(metadataBackupStore)
+
+	var err error
+	s.db, err = makeDB(conf)
+
+	return s, err
+}
+
+func (s *metadataBackupStore) Close() error { return s.db.Close() }
+
+func (s *metadataBackupStore) GetLastBackup(repositoryID int64) (time.Time, error) {
+	const q = `SELECT backed_up_at FROM metadata_backup
+               WHERE repository_id = $1`
+
+	var t time.Time
+
+	err := s.db.QueryRow(q, repositoryID).Scan(&t)
+	switch {
+	case err == sql.ErrNoRows:
+		return time.Time{}, nil
+	case err != nil:
+		return time.Time{}, err
+	}
+
+	return t, nil
+}
+
+func (s *metadataBackupStore) SetLastBackup(repositoryID int64, t time.Time) error {
+	const (
+		update = `UPDATE metadata_backup SET backed_up_at = $2
+                  WHERE repository_id = $1`
+		insert = `INSERT INTO metadata_backup(repository_id, backed_up_at)
+                  VALUES ($1, $2)`
+	)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(update, repositoryID, t)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec(insert, repositoryID, t)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+var _ datastore.MetadataBackup = (*metadataBackupStore)(nil)
@@ -0,0 +1,73 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+type organizationHookStore struct {
+	db *sql.DB
+}
+
+func NewOrganizationHookStore(conf *config.Postgres) (datastore.OrganizationHook, error) {
+	s := new(organizationHookStore)
+
+	var err error
+	s.db, err = makeDB(conf)
+
+	return s, err
+}
+
+func (s *organizationHookStore) Close() error { return s.db.Close() }
+
+func (s *organizationHookStore) GetByName(name string) (*internal.OrganizationHook, error) {
+	const q = `SELECT hook_id, hook_fingerprint FROM organization_hook
+               WHERE name = $1`
+
+	hook := &internal.OrganizationHook{Name: name}
+
+	err := s.db.QueryRow(q, name).Scan(&hook.HookID, &hook.HookFingerprint)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return hook, nil
+}
+
+func (s *organizationHookStore) Set(hook *internal.OrganizationHook) error {
+	const (
+		update = `UPDATE organization_hook SET hook_id = $2, hook_fingerprint = $3
+                  WHERE name = $1`
+		insert = `INSERT INTO organization_hook(name, hook_id, hook_fingerprint)
+                  VALUES ($1, $2, $3)`
+	)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(update, hook.Name, hook.HookID, hook.HookFingerprint)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec(insert, hook.Name, hook.HookID, hook.HookFingerprint)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+var _ datastore.OrganizationHook = (*organizationHookStore)(nil)
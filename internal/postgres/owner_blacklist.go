@@ -5,6 +5,7 @@ import (
 
 	_ "github.com/lib/pq"
 
+	"github.com/vrischmann/ghmirror/internal"
 	"github.com/vrischmann/ghmirror/internal/config"
 	"github.com/vrischmann/ghmirror/internal/datastore"
 )
@@ -24,6 +25,29 @@ func NewOwnerBlacklistStore(conf *config.Postgres) (datastore.OwnerBlacklist, er
 
 func (s *ownerBlacklistStore) Close() error { return s.db.Close() }
 
+func (s *ownerBlacklistStore) Get() (internal.OwnersBlacklist, error) {
+	var res internal.OwnersBlacklist
+
+	const q = `SELECT id, name FROM owner_blacklist`
+
+	rows, err := s.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var o internal.BlacklistedOwner
+		if err := rows.Scan(&o.ID, &o.Name); err != nil {
+			return nil, err
+		}
+
+		res = append(res, &o)
+	}
+
+	return res, rows.Err()
+}
+
 func (s *ownerBlacklistStore) IsBlacklisted(name string) (bool, error) {
 	const q = `SELECT 1 FROM owner_blacklist
                WHERE name = $1`
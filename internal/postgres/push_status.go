@@ -0,0 +1,81 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+type pushStatusStore struct {
+	db *sql.DB
+}
+
+func NewPushStatusStore(conf *config.Postgres) (datastore.PushStatus, error) {
+	s := new(pushStatusStore)
+
+	var err error
+	s.db, err = makeDB(conf)
+
+	return s, err
+}
+
+func (s *pushStatusStore) Close() error { return s.db.Close() }
+
+func (s *pushStatusStore) GetByRepositoryID(id int64) ([]*internal.PushStatus, error) {
+	var res []*internal.PushStatus
+
+	const q = `SELECT target, pushed_at, attempts, error FROM push_status
+               WHERE repository_id = $1
+               ORDER BY target`
+
+	rows, err := s.db.Query(q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		status := &internal.PushStatus{RepositoryID: id}
+		if err := rows.Scan(&status.Target, &status.PushedAt, &status.Attempts, &status.Error); err != nil {
+			return nil, err
+		}
+
+		res = append(res, status)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *pushStatusStore) Set(status *internal.PushStatus) error {
+	const (
+		update = `UPDATE push_status SET pushed_at = $3, attempts = $4, error = $5
+                  WHERE repository_id = $1 AND target = $2`
+		insert = `INSERT INTO push_status(repository_id, target, pushed_at, attempts, error)
+                  VALUES ($1, $2, $3, $4, $5)`
+	)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(update, status.RepositoryID, status.Target, status.PushedAt, status.Attempts, status.Error)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = tx.Exec(insert, status.RepositoryID, status.Target, status.PushedAt, status.Attempts, status.Error)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+var _ datastore.PushStatus = (*pushStatusStore)(nil)
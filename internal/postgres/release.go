@@ -0,0 +1,72 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+type releaseStore struct {
+	db *sql.DB
+}
+
+func NewReleaseStore(conf *config.Postgres) (datastore.Release, error) {
+	s := new(releaseStore)
+
+	var err error
+	s.db, err = makeDB(conf)
+
+	return s, err
+}
+
+func (s *releaseStore) Close() error { return s.db.Close() }
+
+func (s *releaseStore) Has(id int64) (bool, error) {
+	const q = `SELECT 1 FROM release
+               WHERE id = $1`
+
+	return s.exists(q, id)
+}
+
+func (s *releaseStore) Add(release *internal.Release) error {
+	const q = `INSERT INTO release(id, repository_id, tag_name, name, published_at)
+               VALUES ($1, $2, $3, $4, $5)`
+
+	_, err := s.db.Exec(q, release.ID, release.RepositoryID, release.TagName, release.Name, release.PublishedAt)
+
+	return err
+}
+
+func (s *releaseStore) HasAsset(id int64) (bool, error) {
+	const q = `SELECT 1 FROM release_asset
+               WHERE id = $1`
+
+	return s.exists(q, id)
+}
+
+func (s *releaseStore) AddAsset(asset *internal.ReleaseAsset) error {
+	const q = `INSERT INTO release_asset(id, release_id, name, content_type, size, sha256)
+               VALUES ($1, $2, $3, $4, $5, $6)`
+
+	_, err := s.db.Exec(q, asset.ID, asset.ReleaseID, asset.Name, asset.ContentType, asset.Size, asset.SHA256)
+
+	return err
+}
+
+func (s *releaseStore) exists(q string, id int64) (bool, error) {
+	var i int
+
+	err := s.db.QueryRow(q, id).Scan(&i)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
+}
+
+var _ datastore.Release = (*releaseStore)(nil)
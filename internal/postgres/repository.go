@@ -26,7 +26,7 @@ func (s *repositoryStore) Close() error { return s.db.Close() }
 func (s *repositoryStore) GetAll() (internal.Repositories, error) {
 	var res internal.Repositories
 
-	const q = `SELECT id, name, local_path, clone_url, hook_id FROM repository`
+	const q = `SELECT id, COALESCE(owner, ''), name, local_path, clone_url, hook_id, COALESCE(hook_fingerprint, ''), COALESCE(hook_error, ''), COALESCE(lfs_size, 0), COALESCE(size, 0), COALESCE(fetch_count, 0), COALESCE(private, true), COALESCE(provider, 'github'), COALESCE(account, '') FROM repository`
 
 	rows, err := s.db.Query(q)
 	if err != nil {
@@ -35,21 +35,32 @@ func (s *repositoryStore) GetAll() (internal.Repositories, error) {
 	defer rows.Close()
 
 	var (
-		id, hookID                int64
-		name, localPath, cloneURL string
+		id, hookID, lfsSize, size, fetchCount                  int64
+		owner, name, localPath, cloneURL, fingerprint, hookErr string
+		private                                                bool
+		provider, account                                      string
 	)
 
 	for rows.Next() {
-		if err := rows.Scan(&id, &name, &localPath, &cloneURL, &hookID); err != nil {
+		if err := rows.Scan(&id, &owner, &name, &localPath, &cloneURL, &hookID, &fingerprint, &hookErr, &lfsSize, &size, &fetchCount, &private, &provider, &account); err != nil {
 			return nil, err
 		}
 
 		repo := &internal.Repository{
-			ID:        id,
-			Name:      name,
-			LocalPath: localPath,
-			CloneURL:  cloneURL,
-			HookID:    hookID,
+			ID:              id,
+			Owner:           owner,
+			Name:            name,
+			LocalPath:       localPath,
+			CloneURL:        cloneURL,
+			HookID:          hookID,
+			HookFingerprint: fingerprint,
+			HookError:       hookErr,
+			LFSSize:         lfsSize,
+			Size:            size,
+			FetchCount:      fetchCount,
+			Private:         private,
+			Provider:        provider,
+			Account:         account,
 		}
 
 		res = append(res, repo)
@@ -59,15 +70,17 @@ func (s *repositoryStore) GetAll() (internal.Repositories, error) {
 }
 
 func (s *repositoryStore) GetByID(id int64) (*internal.Repository, error) {
-	const q = `SELECT name, local_path, clone_url, hook_id FROM repository
+	const q = `SELECT COALESCE(owner, ''), name, local_path, clone_url, hook_id, COALESCE(hook_fingerprint, ''), COALESCE(hook_error, ''), COALESCE(lfs_size, 0), COALESCE(size, 0), COALESCE(fetch_count, 0), COALESCE(private, true), COALESCE(provider, 'github'), COALESCE(account, '') FROM repository
                WHERE id = $1`
 
 	var (
-		name, localPath, cloneURL string
-		hookID                    int64
+		owner, name, localPath, cloneURL, fingerprint, hookErr string
+		hookID, lfsSize, size, fetchCount                      int64
+		private                                                bool
+		provider, account                                      string
 	)
 
-	err := s.db.QueryRow(q, id).Scan(&name, &localPath, &cloneURL, &hookID)
+	err := s.db.QueryRow(q, id).Scan(&owner, &name, &localPath, &cloneURL, &hookID, &fingerprint, &hookErr, &lfsSize, &size, &fetchCount, &private, &provider, &account)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, nil
@@ -76,24 +89,50 @@ func (s *repositoryStore) GetByID(id int64) (*internal.Repository, error) {
 	}
 
 	repo := &internal.Repository{
-		ID:        id,
-		Name:      name,
-		LocalPath: localPath,
-		CloneURL:  cloneURL,
-		HookID:    hookID,
+		ID:              id,
+		Owner:           owner,
+		Name:            name,
+		LocalPath:       localPath,
+		CloneURL:        cloneURL,
+		HookID:          hookID,
+		HookFingerprint: fingerprint,
+		HookError:       hookErr,
+		LFSSize:         lfsSize,
+		Size:            size,
+		FetchCount:      fetchCount,
+		Private:         private,
+		Provider:        provider,
+		Account:         account,
 	}
 
 	return repo, nil
 }
 
+func (s *repositoryStore) GetByLocalPath(localPath string) (*internal.Repository, error) {
+	const q = `SELECT id FROM repository
+               WHERE local_path = $1`
+
+	var id int64
+
+	err := s.db.QueryRow(q, localPath).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return s.GetByID(id)
+}
+
 func (s *repositoryStore) Has(id int64) (bool, error) {
 	repo, err := s.GetByID(id)
 	return repo != nil, err
 }
 
 func (s *repositoryStore) Add(repo *internal.Repository) error {
-	const q = `INSERT INTO repository(id, name, local_path, clone_url, hook_id)
-               VALUES ($1, $2, $3, $4, $5)`
+	const q = `INSERT INTO repository(id, owner, name, local_path, clone_url, hook_id, hook_fingerprint, hook_error, private, provider, account)
+               VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
 
 	tx, err := s.db.Begin()
 	if err != nil {
@@ -101,7 +140,7 @@ func (s *repositoryStore) Add(repo *internal.Repository) error {
 	}
 
 	// TODO(vincent): do we need the last inserted id for something ?
-	_, err = tx.Exec(q, repo.ID, repo.Name, repo.LocalPath, repo.CloneURL, repo.HookID)
+	_, err = tx.Exec(q, repo.ID, repo.Owner, repo.Name, repo.LocalPath, repo.CloneURL, repo.HookID, repo.HookFingerprint, repo.HookError, repo.Private, repo.Provider, repo.Account)
 	if err != nil {
 		return err
 	}
@@ -109,4 +148,67 @@ func (s *repositoryStore) Add(repo *internal.Repository) error {
 	return tx.Commit()
 }
 
+func (s *repositoryStore) SetHook(id, hookID int64, fingerprint string) error {
+	const q = `UPDATE repository SET hook_id = $2, hook_fingerprint = $3
+               WHERE id = $1`
+
+	_, err := s.db.Exec(q, id, hookID, fingerprint)
+
+	return err
+}
+
+func (s *repositoryStore) SetHookError(id int64, hookErr string) error {
+	const q = `UPDATE repository SET hook_error = $2
+               WHERE id = $1`
+
+	_, err := s.db.Exec(q, id, hookErr)
+
+	return err
+}
+
+func (s *repositoryStore) SetLFSSize(id, size int64) error {
+	const q = `UPDATE repository SET lfs_size = $2
+               WHERE id = $1`
+
+	_, err := s.db.Exec(q, id, size)
+
+	return err
+}
+
+func (s *repositoryStore) SetSize(id, size int64) error {
+	const q = `UPDATE repository SET size = $2
+               WHERE id = $1`
+
+	_, err := s.db.Exec(q, id, size)
+
+	return err
+}
+
+func (s *repositoryStore) IncrementFetchCount(id int64) error {
+	const q = `UPDATE repository SET fetch_count = COALESCE(fetch_count, 0) + 1
+               WHERE id = $1`
+
+	_, err := s.db.Exec(q, id)
+
+	return err
+}
+
+func (s *repositoryStore) ResetFetchCount(id int64) error {
+	const q = `UPDATE repository SET fetch_count = 0
+               WHERE id = $1`
+
+	_, err := s.db.Exec(q, id)
+
+	return err
+}
+
+func (s *repositoryStore) SetPrivate(id int64, private bool) error {
+	const q = `UPDATE repository SET private = $2
+               WHERE id = $1`
+
+	_, err := s.db.Exec(q, id, private)
+
+	return err
+}
+
 var _ datastore.Repository = (*repositoryStore)(nil)
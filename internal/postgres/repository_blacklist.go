@@ -15,13 +15,54 @@ type repositoryBlacklistStore struct {
 }
 
 func NewRepositoryBlacklistStore(conf *config.Postgres) (datastore.RepositoryBlacklist, error) {
-	return nil, nil
+	s := new(repositoryBlacklistStore)
+
+	var err error
+	s.db, err = makeDB(conf)
+
+	return s, err
 }
 
 func (s *repositoryBlacklistStore) Close() error { return s.db.Close() }
 
 func (s *repositoryBlacklistStore) Get() (internal.RepositoriesBlacklist, error) {
-	return nil, nil
+	var res internal.RepositoriesBlacklist
+
+	const q = `SELECT id, organization, name FROM repository_blacklist`
+
+	rows, err := s.db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r internal.BlacklistedRepository
+		if err := rows.Scan(&r.ID, &r.Organization, &r.Name); err != nil {
+			return nil, err
+		}
+
+		res = append(res, &r)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *repositoryBlacklistStore) IsBlacklisted(organization, name string) (bool, error) {
+	const q = `SELECT 1 FROM repository_blacklist
+               WHERE organization = $1 AND name = $2`
+
+	var i int
+
+	err := s.db.QueryRow(q, organization, name).Scan(&i)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	default:
+		return true, nil
+	}
 }
 
 var _ datastore.RepositoryBlacklist = (*repositoryBlacklistStore)(nil)
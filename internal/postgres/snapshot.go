@@ -0,0 +1,68 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+type snapshotStore struct {
+	db *sql.DB
+}
+
+func NewSnapshotStore(conf *config.Postgres) (datastore.Snapshot, error) {
+	s := new(snapshotStore)
+
+	var err error
+	s.db, err = makeDB(conf)
+
+	return s, err
+}
+
+func (s *snapshotStore) Close() error { return s.db.Close() }
+
+func (s *snapshotStore) GetByRepositoryID(id int64) (internal.Snapshots, error) {
+	var res internal.Snapshots
+
+	const q = `SELECT id, created_at, path, size, sha256, refs, COALESCE(backup_path, '') FROM snapshot
+               WHERE repository_id = $1
+               ORDER BY created_at DESC`
+
+	rows, err := s.db.Query(q, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		snapshot := &internal.Snapshot{RepositoryID: id}
+		if err := rows.Scan(&snapshot.ID, &snapshot.CreatedAt, &snapshot.Path, &snapshot.Size, &snapshot.SHA256, &snapshot.Refs, &snapshot.BackupPath); err != nil {
+			return nil, err
+		}
+
+		res = append(res, snapshot)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *snapshotStore) Add(snapshot *internal.Snapshot) error {
+	const q = `INSERT INTO snapshot(repository_id, created_at, path, size, sha256, refs, backup_path)
+               VALUES ($1, $2, $3, $4, $5, $6, $7)
+               RETURNING id`
+
+	return s.db.QueryRow(q, snapshot.RepositoryID, snapshot.CreatedAt, snapshot.Path, snapshot.Size, snapshot.SHA256, snapshot.Refs, snapshot.BackupPath).Scan(&snapshot.ID)
+}
+
+func (s *snapshotStore) Delete(id int64) error {
+	const q = `DELETE FROM snapshot
+               WHERE id = $1`
+
+	_, err := s.db.Exec(q, id)
+
+	return err
+}
+
+var _ datastore.Snapshot = (*snapshotStore)(nil)
@@ -0,0 +1,76 @@
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+type syncStore struct {
+	db *sql.DB
+}
+
+func NewSyncStore(conf *config.Postgres) (datastore.Sync, error) {
+	s := new(syncStore)
+
+	var err error
+	s.db, err = makeDB(conf)
+
+	return s, err
+}
+
+func (s *syncStore) Close() error { return s.db.Close() }
+
+func (s *syncStore) GetLatest() (internal.Syncs, error) {
+	const q = `SELECT DISTINCT ON (repository_id) id, repository_id, started_at, duration, error FROM sync
+               ORDER BY repository_id, started_at DESC`
+
+	return s.query(q)
+}
+
+func (s *syncStore) GetByRepositoryID(id int64, limit int) (internal.Syncs, error) {
+	const q = `SELECT id, repository_id, started_at, duration, error FROM sync
+               WHERE repository_id = $1
+               ORDER BY started_at DESC
+               LIMIT $2`
+
+	return s.query(q, id, limit)
+}
+
+func (s *syncStore) query(q string, args ...interface{}) (internal.Syncs, error) {
+	var res internal.Syncs
+
+	rows, err := s.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			sync     internal.Sync
+			duration int64
+		)
+		if err := rows.Scan(&sync.ID, &sync.RepositoryID, &sync.StartedAt, &duration, &sync.Error); err != nil {
+			return nil, err
+		}
+		sync.Duration = time.Duration(duration)
+
+		res = append(res, &sync)
+	}
+
+	return res, rows.Err()
+}
+
+func (s *syncStore) Add(sync *internal.Sync) error {
+	const q = `INSERT INTO sync(repository_id, started_at, duration, error)
+               VALUES ($1, $2, $3, $4)
+               RETURNING id`
+
+	return s.db.QueryRow(q, sync.RepositoryID, sync.StartedAt, int64(sync.Duration), sync.Error).Scan(&sync.ID)
+}
+
+var _ datastore.Sync = (*syncStore)(nil)
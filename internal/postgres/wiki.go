@@ -0,0 +1,52 @@
+package postgres
+
+import (
+	"database/sql"
+
+	"github.com/vrischmann/ghmirror/internal"
+	"github.com/vrischmann/ghmirror/internal/config"
+	"github.com/vrischmann/ghmirror/internal/datastore"
+)
+
+type wikiStore struct {
+	db *sql.DB
+}
+
+func NewWikiStore(conf *config.Postgres) (datastore.Wiki, error) {
+	s := new(wikiStore)
+
+	var err error
+	s.db, err = makeDB(conf)
+
+	return s, err
+}
+
+func (s *wikiStore) Close() error { return s.db.Close() }
+
+func (s *wikiStore) GetByRepositoryID(id int64) (*internal.Wiki, error) {
+	const q = `SELECT local_path, clone_url FROM wiki
+               WHERE repository_id = $1`
+
+	var localPath, cloneURL string
+
+	err := s.db.QueryRow(q, id).Scan(&localPath, &cloneURL)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return internal.NewWiki(id, localPath, cloneURL), nil
+}
+
+func (s *wikiStore) Add(wiki *internal.Wiki) error {
+	const q = `INSERT INTO wiki(repository_id, local_path, clone_url)
+               VALUES ($1, $2, $3)`
+
+	_, err := s.db.Exec(q, wiki.RepositoryID, wiki.LocalPath, wiki.CloneURL)
+
+	return err
+}
+
+var _ datastore.Wiki = (*wikiStore)(nil)
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+// emptySHA256 is the SHA256 checksum of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type s3Storage struct {
+	conf     *config.S3
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Storage returns a storage which keeps the objects in an S3 compatible bucket, using the S3 REST API
+// with signature version 4.
+//
+// Objects are uploaded with a single PUT, so they can't be larger than 5GB.
+func NewS3Storage(conf *config.S3) (Storage, error) {
+	if conf.Endpoint == "" || conf.Bucket == "" {
+		return nil, errors.New("the S3 endpoint and bucket are required")
+	}
+
+	u, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint. err=%v", err)
+	}
+
+	return &s3Storage{
+		conf:     conf,
+		endpoint: u,
+		client:   &http.Client{Timeout: time.Hour},
+	}, nil
+}
+
+func (s *s3Storage) url(key string) *url.URL {
+	u := *s.endpoint
+
+	key = strings.TrimPrefix(s.conf.Prefix+key, "/")
+
+	if s.conf.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.conf.Bucket + "/" + key
+	} else {
+		u.Host = s.conf.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+
+	// Make the URL use the same encoding as the signature.
+	u.RawPath = s3EscapePath(u.Path)
+
+	return &u
+}
+
+// Put uploads an object, with its SHA256 and MD5 checksums so that S3 rejects a corrupted upload. The ETag isn't
+// checked: it's only the MD5 checksum of the object without server-side encryption with KMS keys.
+func (s *s3Storage) Put(key string, r io.ReadSeeker) error {
+	sha, md := sha256.New(), md5.New()
+
+	size, err := io.Copy(io.MultiWriter(sha, md), r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", s.url(key).String(), ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md.Sum(nil)))
+
+	resp, err := s.do(req, hex.EncodeToString(sha.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s *s3Storage) Get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", s.url(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Stat(key string) (*Object, error) {
+	req, err := http.NewRequest("HEAD", s.url(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return &Object{Key: key, Size: resp.ContentLength}, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	req, err := http.NewRequest("DELETE", s.url(key).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, emptySHA256)
+	if err == ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// do signs and sends a request, and turns the error responses into errors.
+func (s *s3Storage) do(req *http.Request, payloadSHA256 string) (*http.Response, error) {
+	signS3Request(req, s.conf, payloadSHA256, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotExist
+	case resp.StatusCode >= 300:
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL.Path, resp.Status, body)
+	}
+
+	return resp, nil
+}
+
+// signS3Request adds the signature version 4 Authorization header to a request. Every header of the request
+// is signed, along with the host.
+func signS3Request(req *http.Request, conf *config.S3, payloadSHA256 string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + conf.Region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadSHA256)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.TrimSpace(v)
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadSHA256,
+	}, "\n")
+
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+conf.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, conf.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", conf.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything except the unreserved characters, and / if keepSlash is set.
+func s3Escape(s string, keepSlash bool) string {
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			buf = append(buf, c)
+		case c == '/' && keepSlash:
+			buf = append(buf, c)
+		default:
+			buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(buf)
+}
+
+func s3EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+
+	return s3Escape(path, true)
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, v := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+var _ Storage = (*s3Storage)(nil)
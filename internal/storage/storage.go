@@ -0,0 +1,70 @@
+// Package storage stores the snapshots either on the local filesystem or in an S3 compatible bucket.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/vrischmann/ghmirror/internal/config"
+)
+
+// ErrNotExist is returned when an object does not exist.
+var ErrNotExist = errors.New("object does not exist")
+
+// Object describes a stored object.
+type Object struct {
+	Key  string
+	Size int64
+}
+
+// Storage stores objects by key. Keys use / as a separator.
+type Storage interface {
+	// Put stores the content of r at key, replacing the existing object if any.
+	Put(key string, r io.ReadSeeker) error
+	Get(key string) (io.ReadCloser, error)
+	Stat(key string) (*Object, error)
+	Delete(key string) error
+}
+
+// New returns the storage configured in conf. The local storage is rooted at Snapshots.Path.
+func New(conf *config.Config) (Storage, error) {
+	switch conf.Storage.Type {
+	case config.StorageLocal, "":
+		return NewLocalStorage(conf.Snapshots.Path), nil
+	case config.StorageS3:
+		return NewS3Storage(&conf.Storage.S3)
+	default:
+		return nil, fmt.Errorf("invalid storage type %q", conf.Storage.Type)
+	}
+}
+
+// PutFile stores the file at path at key, then checks that the stored object has the size of the file.
+func PutFile(s Storage, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := s.Put(key, f); err != nil {
+		return fmt.Errorf("unable to store %s. err=%v", key, err)
+	}
+
+	obj, err := s.Stat(key)
+	if err != nil {
+		return fmt.Errorf("unable to verify %s. err=%v", key, err)
+	}
+
+	if obj.Size != fi.Size() {
+		return fmt.Errorf("stored object %s has %d bytes instead of %d", key, obj.Size, fi.Size())
+	}
+
+	return nil
+}
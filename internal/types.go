@@ -1,16 +1,31 @@
 package internal
 
+import "time"
+
 type Repository struct {
-	ID        int64
-	Name      string
-	LocalPath string
-	CloneURL  string
-	HookID    int64
+	ID              int64
+	Owner           string
+	Name            string
+	LocalPath       string
+	CloneURL        string
+	HookID          int64
+	HookFingerprint string
+	HookError       string
+	LFSSize         int64
+	// Size is the size of the local copy in bytes, as last measured by the maintainer.
+	Size       int64
+	FetchCount int64
+	Private    bool
+	// Provider is the name of the provider the repository is mirrored from, github for the older rows.
+	Provider string
+	// Account is the name of the GitHub account the repository is mirrored with, empty for the default account.
+	Account string
 }
 
-func NewRepository(id int64, name, localPath, cloneURL string) *Repository {
+func NewRepository(id int64, owner, name, localPath, cloneURL string) *Repository {
 	return &Repository{
 		ID:        id,
+		Owner:     owner,
 		Name:      name,
 		LocalPath: localPath,
 		CloneURL:  cloneURL,
@@ -33,3 +48,125 @@ type BlacklistedRepository struct {
 }
 
 type RepositoriesBlacklist []*BlacklistedRepository
+
+// Delivery is a webhook delivery as received from a provider.
+type Delivery struct {
+	ID             string
+	Provider       string
+	Event          string
+	RepositoryID   int64
+	RepositoryName string
+	ReceivedAt     time.Time
+	SignatureValid bool
+	Body           []byte
+	Processed      bool
+}
+
+// OrganizationHook is the webhook installed on a whole organization.
+type OrganizationHook struct {
+	Name            string
+	HookID          int64
+	HookFingerprint string
+}
+
+// Wiki is the wiki of a repository, which GitHub stores in its own git repository.
+type Wiki struct {
+	RepositoryID int64
+	LocalPath    string
+	CloneURL     string
+}
+
+func NewWiki(repositoryID int64, localPath, cloneURL string) *Wiki {
+	return &Wiki{
+		RepositoryID: repositoryID,
+		LocalPath:    localPath,
+		CloneURL:     cloneURL,
+	}
+}
+
+// Release is the metadata of a GitHub release.
+type Release struct {
+	ID           int64
+	RepositoryID int64
+	TagName      string
+	Name         string
+	PublishedAt  time.Time
+}
+
+// ReleaseAsset is a file attached to a release, stored by its SHA256 checksum.
+type ReleaseAsset struct {
+	ID          int64
+	ReleaseID   int64
+	Name        string
+	ContentType string
+	Size        int64
+	SHA256      string
+}
+
+// Gist is a gist of the authenticated user. Gists have their own IDs, which are strings.
+type Gist struct {
+	ID          string
+	Description string
+	LocalPath   string
+	CloneURL    string
+}
+
+func NewGist(id, description, localPath, cloneURL string) *Gist {
+	return &Gist{
+		ID:          id,
+		Description: description,
+		LocalPath:   localPath,
+		CloneURL:    cloneURL,
+	}
+}
+
+// Snapshot is a git bundle of all the refs of a repository at a point in time.
+type Snapshot struct {
+	ID           int64
+	RepositoryID int64
+	CreatedAt    time.Time
+	// Path is the key of the bundle in the storage. It's an absolute path for the snapshots made before the
+	// storage was configurable.
+	Path   string
+	Size   int64
+	SHA256 string
+	// Refs is the output of git bundle list-heads.
+	Refs string
+	// BackupPath is the key of the archive of the metadata and releases backup, if any.
+	BackupPath string
+}
+
+type Snapshots []*Snapshot
+
+// FsckResult is the result of a git fsck of the local copy of a repository.
+type FsckResult struct {
+	ID           int64
+	RepositoryID int64
+	CheckedAt    time.Time
+	OK           bool
+	Output       string
+}
+
+type FsckResults []*FsckResult
+
+// PushStatus is the result of the last push of a repository to a push target.
+type PushStatus struct {
+	RepositoryID int64
+	Target       string
+	PushedAt     time.Time
+	Attempts     int
+	// Error is empty if the push succeeded.
+	Error string
+}
+
+// Sync is a sync of the local copy of a repository with GitHub.
+type Sync struct {
+	ID           int64
+	RepositoryID int64
+	StartedAt    time.Time
+	Duration     time.Duration
+	// Error is empty if the sync succeeded.
+	Error string
+}
+
+type Syncs []*Sync
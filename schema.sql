@@ -1,17 +1,40 @@
 CREATE TABLE IF NOT EXISTS repository(
     id bigint primary key,
+    owner varchar,
     name varchar,
     local_path varchar,
     clone_url varchar,
-    hook_id bigint
+    hook_id bigint,
+    hook_fingerprint varchar,
+    hook_error varchar,
+    lfs_size bigint,
+    fetch_count bigint,
+    private boolean,
+    provider varchar,
+    account varchar,
+    size bigint
 );
 
+-- Columns added after the table was first created, for existing databases.
+ALTER TABLE repository ADD COLUMN IF NOT EXISTS owner varchar;
+ALTER TABLE repository ADD COLUMN IF NOT EXISTS hook_fingerprint varchar;
+ALTER TABLE repository ADD COLUMN IF NOT EXISTS hook_error varchar;
+ALTER TABLE repository ADD COLUMN IF NOT EXISTS lfs_size bigint;
+ALTER TABLE repository ADD COLUMN IF NOT EXISTS fetch_count bigint;
+ALTER TABLE repository ADD COLUMN IF NOT EXISTS private boolean;
+ALTER TABLE repository ADD COLUMN IF NOT EXISTS provider varchar;
+ALTER TABLE repository ADD COLUMN IF NOT EXISTS account varchar;
+ALTER TABLE repository ADD COLUMN IF NOT EXISTS size bigint;
+
+-- The visibility of the repositories mirrored before it was recorded is unknown, so they're private until synced.
+UPDATE repository SET private = true WHERE private IS NULL;
+
 CREATE TABLE IF NOT EXISTS owner_blacklist(
     id serial primary key,
     name varchar
 );
 
-CREATE INDEX owner_blacklist_name_idx ON owner_blacklist(name);
+CREATE INDEX IF NOT EXISTS owner_blacklist_name_idx ON owner_blacklist(name);
 
 CREATE TABLE IF NOT EXISTS repository_blacklist(
     id serial primary key,
@@ -19,4 +42,105 @@ CREATE TABLE IF NOT EXISTS repository_blacklist(
     name varchar
 );
 
-CREATE INDEX repository_blacklist_idx ON repository_blacklist(organization, name);
+CREATE INDEX IF NOT EXISTS repository_blacklist_idx ON repository_blacklist(organization, name);
+
+CREATE TABLE IF NOT EXISTS delivery(
+    id varchar primary key,
+    provider varchar,
+    event varchar,
+    repository_id bigint,
+    repository_name varchar,
+    received_at timestamp with time zone,
+    signature_valid boolean,
+    body bytea,
+    processed boolean
+);
+
+ALTER TABLE delivery ADD COLUMN IF NOT EXISTS provider varchar;
+
+CREATE INDEX IF NOT EXISTS delivery_received_at_idx ON delivery(received_at);
+
+CREATE TABLE IF NOT EXISTS organization_hook(
+    name varchar primary key,
+    hook_id bigint,
+    hook_fingerprint varchar
+);
+
+CREATE TABLE IF NOT EXISTS wiki(
+    repository_id bigint primary key references repository(id),
+    local_path varchar,
+    clone_url varchar
+);
+
+CREATE TABLE IF NOT EXISTS metadata_backup(
+    repository_id bigint primary key references repository(id),
+    backed_up_at timestamp with time zone
+);
+
+CREATE TABLE IF NOT EXISTS release(
+    id bigint primary key,
+    repository_id bigint references repository(id),
+    tag_name varchar,
+    name varchar,
+    published_at timestamp with time zone
+);
+
+CREATE TABLE IF NOT EXISTS release_asset(
+    id bigint primary key,
+    release_id bigint references release(id),
+    name varchar,
+    content_type varchar,
+    size bigint,
+    sha256 varchar
+);
+
+CREATE TABLE IF NOT EXISTS gist(
+    id varchar primary key,
+    description varchar,
+    local_path varchar,
+    clone_url varchar
+);
+
+CREATE TABLE IF NOT EXISTS snapshot(
+    id serial primary key,
+    repository_id bigint references repository(id),
+    created_at timestamp with time zone,
+    path varchar,
+    size bigint,
+    sha256 varchar,
+    refs text,
+    backup_path varchar
+);
+
+ALTER TABLE snapshot ADD COLUMN IF NOT EXISTS backup_path varchar;
+
+CREATE INDEX IF NOT EXISTS snapshot_repository_id_idx ON snapshot(repository_id);
+
+CREATE TABLE IF NOT EXISTS fsck(
+    id serial primary key,
+    repository_id bigint references repository(id),
+    checked_at timestamp with time zone,
+    ok boolean,
+    output text
+);
+
+CREATE INDEX IF NOT EXISTS fsck_repository_id_idx ON fsck(repository_id, checked_at);
+
+CREATE TABLE IF NOT EXISTS push_status(
+    repository_id bigint references repository(id),
+    target varchar,
+    pushed_at timestamp with time zone,
+    attempts int,
+    error varchar,
+    primary key (repository_id, target)
+);
+
+CREATE TABLE IF NOT EXISTS sync(
+    id serial primary key,
+    repository_id bigint references repository(id),
+    started_at timestamp with time zone,
+    duration bigint,
+    error text
+);
+
+CREATE INDEX IF NOT EXISTS sync_repository_id_idx ON sync(repository_id, started_at);